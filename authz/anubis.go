@@ -3,107 +3,367 @@ package authz
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path"
-
-	"reflect"
 	"regexp"
+	"time"
 
 	"github.com/AnubisLMS/authz/core"
 
 	"github.com/docker/docker/pkg/authorization"
-	"github.com/howeyc/fsnotify"
+	"github.com/google/cel-go/cel"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
+// Action is a single docker action (mapped to authz terminology) allowed by an anubis policy.
+// The action name is evaluated as a regular expression, the optional body constrains the
+// JSON body of POST requests matching the action, and the optional query constrains the
+// query parameters of requests matching the action. The optional if condition is a CEL
+// expression evaluated against the request (see celEnv). A deny action (effect: deny) denies
+// the requests matching its query, body and condition.
+type Action struct {
+	Name     string                 `yaml:"name"`               // Name is the action name (regular expression)
+	Body     map[string]interface{} `yaml:"body,omitempty"`     // Body are the constraints applied to the request body
+	Query    map[string]*Matcher    `yaml:"query,omitempty"`    // Query are the constraints applied to the request query parameters
+	Mounts   *MountPolicy           `yaml:"mounts,omitempty"`   // Mounts are the constraints applied to the mounts of container_create requests
+	Images   *ImagePolicy           `yaml:"images,omitempty"`   // Images are the constraints applied to the images of image_create, image_build and container_create requests
+	Patch    *Patch                 `yaml:"patch,omitempty"`    // Patch rewrites the body of requests matching the action (proxy mode only)
+	Use      []string               `yaml:"use,omitempty"`      // Use are the named body fragments merged (in order) into the body
+	Effect   string                 `yaml:"effect,omitempty"`   // Effect is the effect of the action, either allow (default) or deny
+	Response *ResponsePolicy        `yaml:"response,omitempty"` // Response are the constraints applied to the docker daemon responses
+	Owner    bool                   `yaml:"owner,omitempty"`    // Owner restricts the action to the containers, execs, volumes and networks owned by the user
+	If       string                 `yaml:"if,omitempty"`       // If is a CEL condition the request must satisfy
+
+	nameRe    *regexp.Regexp // nameRe is the compiled action name
+	condition cel.Program    // condition is the compiled if condition
+}
+
 // AnubisPolicy represent a single policy object that is evaluated in the authorization flow.
-// Each policy object consists of multiple users and docker actions, where each user belongs to a single policy.
+// Each policy object consists of multiple users, groups and docker actions.
 //
 // The policies are evaluated according to the following flow:
 //
 //	For each policy object check
-//	   If the user belongs to the policy
-//	      If action in request in policy allow otherwise deny
+//	   If the user belongs to the policy (directly or through one of its groups)
+//	      For each action in policy matching the request, decide allow or deny
+//	Combine the decisions (first match by default, see CheckPolicyCombining)
 //	If no appropriate policy found, return deny
 //
-// Remark: In anubis flow, each user must have a unique policy.
-// If a user is used by more than one policy, the results may be inconsistent
-type Action struct {
-	Name string                 `yaml:"name"`
-	Body map[string]interface{} `yaml:"body,omitempty" default:nil`
-}
+// A policy without users and groups applies to every user. The quota of the first policy applying
+// to the user that defines one limits the resources of the user (see Quota), while the rate limits
+// of every policy applying to the user limit the rate of its requests (see RateLimit). A policy with a
+// schedule only applies during its time windows (see Schedule).
 type AnubisPolicy struct {
-	Actions  []Action `yaml:"actions"`  // Actions are the docker actions (mapped to authz terminology) that are allowed according to this policy
-	Name     string   `yaml:"name"`     // Name is the policy name
-	Readonly bool     `yaml:"readonly"` // Readonly indicates this policy only allow get commands
+	Actions    []Action    `yaml:"actions"`              // Actions are the docker actions (mapped to authz terminology) that are allowed according to this policy
+	Users      []string    `yaml:"users,omitempty"`      // Users are the users (TLS common names) for which this policy apply to
+	Groups     []string    `yaml:"groups,omitempty"`     // Groups are the named groups of users for which this policy apply to
+	Name       string      `yaml:"name"`                 // Name is the policy name
+	Readonly   bool        `yaml:"readonly"`             // Readonly indicates this policy only allow get commands
+	Quota      *Quota      `yaml:"quota,omitempty"`      // Quota limits the resources owned by each user of the policy
+	RateLimits []RateLimit `yaml:"rateLimits,omitempty"` // RateLimits limit the rate of the requests of the users of the policy
+	Schedule   *Schedule   `yaml:"schedule,omitempty"`   // Schedule restricts the policy to time windows
+
+	members map[string]struct{} // members are the users resolved from Users and Groups
 }
 
-// BasicAuthorizerSettings provides settings for the basic authorizer flow
-type AnubisAuthorizerSettings struct {
-	PolicyPath string // PolicyPath is the path to the policy settings
+// AnubisPolicyFile is the document form of the anubis policy file. Besides the policies, it
+// defines the named groups of users and the named body fragments that policies may refer to,
+// and the other policy files it includes. A policy file consisting of a plain list of policies
+// is also accepted.
+type AnubisPolicyFile struct {
+	Include   []string                          `yaml:"include,omitempty"`   // Include are the policy files (or glob patterns) merged before this file
+	Groups    map[string][]string               `yaml:"groups,omitempty"`    // Groups maps a group name to its users
+	Fragments map[string]map[string]interface{} `yaml:"fragments,omitempty"` // Fragments maps a fragment name to a reusable body
+	Policies  []AnubisPolicy                    `yaml:"policies"`            // Policies are the policies evaluated in order
 }
 
-type anubisAuthorizer struct {
-	settings *AnubisAuthorizerSettings
-	policies []AnubisPolicy
+// resolve expands the policy users and groups into the policy members
+func (p *AnubisPolicy) resolve(groups map[string][]string) error {
+	p.members = nil
+	if len(p.Users) == 0 && len(p.Groups) == 0 {
+		return nil
+	}
+
+	p.members = make(map[string]struct{})
+	for _, user := range p.Users {
+		p.members[user] = struct{}{}
+	}
+	for _, group := range p.Groups {
+		users, ok := groups[group]
+		if !ok {
+			return fmt.Errorf("policy '%s' refers to unknown group '%s'", p.Name, group)
+		}
+		for _, user := range users {
+			p.members[user] = struct{}{}
+		}
+	}
+	return nil
 }
 
-// NewAnubisAuthZAuthorizer creates a new anubis authorizer
-func NewAnubisAuthZAuthorizer(settings *AnubisAuthorizerSettings) core.Authorizer {
-	return &anubisAuthorizer{settings: settings}
+// appliesTo returns true if the policy applies to the given user
+func (p *AnubisPolicy) appliesTo(user string) bool {
+	if p.members == nil {
+		if len(p.Users) == 0 && len(p.Groups) == 0 {
+			return true
+		}
+		// Policy was not resolved, fallback to the explicit users
+		for _, u := range p.Users {
+			if u == user {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := p.members[user]
+	return ok
 }
 
-func (f *anubisAuthorizer) loadPolicies() error {
-	data, err := ioutil.ReadFile(path.Join(f.settings.PolicyPath))
+// activeAt returns true if the policy applies at the given time, according to its schedule
+func (p *AnubisPolicy) activeAt(now time.Time) bool {
+	return p.Schedule == nil || p.Schedule.active(now)
+}
+
+// anubisPolicySet is an immutable, validated set of anubis policies
+type anubisPolicySet struct {
+	policies []AnubisPolicy // policies are the policies evaluated in order
+	files    []string       // files are the policy files the set was loaded from
+}
 
+// size returns the number of policies in the set
+func (s *anubisPolicySet) size() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.policies)
+}
+
+// parseAnubisPolicySet parses a policy file, or a folder of policy files, into a policy set
+func parseAnubisPolicySet(path string, sources *policySources) (*anubisPolicySet, error) {
+	builder := newPolicyBuilder()
+	builder.sources = sources
+	if err := builder.addPath(path); err != nil {
+		return nil, err
+	}
+	policies, err := builder.build()
 	if err != nil {
+		return nil, err
+	}
+	return &anubisPolicySet{policies: policies, files: builder.files}, nil
+}
+
+// parseAnubisPolicies strictly parses a policy file, either a list of policies or a policy document,
+// resolves the groups of every policy and compiles the policy actions. Included files are resolved
+// relatively to the working directory.
+func parseAnubisPolicies(data []byte) ([]AnubisPolicy, error) {
+	builder := newPolicyBuilder()
+	if err := builder.addDocument("", data); err != nil {
+		return nil, err
+	}
+	return builder.build()
+}
+
+// decodeAnubisDocument strictly decodes a policy file, either a list of policies or a policy document
+func decodeAnubisDocument(data []byte) (*AnubisPolicyFile, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	var file AnubisPolicyFile
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+		if err := decodeStrict(data, &file.Policies); err != nil {
+			return nil, err
+		}
+	} else if len(node.Content) > 0 {
+		if err := decodeStrict(data, &file); err != nil {
+			return nil, err
+		}
+	}
+	return &file, nil
+}
+
+// compile resolves the policy groups, compiles the action names and validates the action constraints
+func (p *AnubisPolicy) compile(groups map[string][]string) error {
+	if err := p.resolve(groups); err != nil {
 		return err
 	}
+	if p.Quota != nil {
+		if err := p.Quota.validate(); err != nil {
+			return fmt.Errorf("policy '%s': %s", p.Name, err.Error())
+		}
+	}
+	for i := range p.RateLimits {
+		if err := p.RateLimits[i].compile(); err != nil {
+			return fmt.Errorf("policy '%s': %s", p.Name, err.Error())
+		}
+	}
+	if p.Schedule != nil {
+		if err := p.Schedule.compile(); err != nil {
+			return fmt.Errorf("policy '%s': %s", p.Name, err.Error())
+		}
+	}
 
-	var policies []AnubisPolicy
-	yaml.Unmarshal(data, &policies)
-	logrus.Infof("Loaded '%d' policies", len(policies))
+	for i := range p.Actions {
+		action := &p.Actions[i]
+		if err := action.compile(); err != nil {
+			return fmt.Errorf("policy '%s' action '%s': %s", p.Name, action.Name, err.Error())
+		}
+	}
+	return nil
+}
 
-	for _, policy := range policies {
-		logrus.Infof("Loaded %+v", policy)
+// compile compiles the action name and validates the action constraints
+func (a *Action) compile() error {
+	var err error
+	if a.nameRe, err = regexp.Compile(a.Name); err != nil {
+		return fmt.Errorf("invalid name: %s", err.Error())
+	}
+	if err := validateEffect(a.Effect); err != nil {
+		return err
+	}
+	if a.Effect == EffectDeny && a.Patch != nil {
+		return fmt.Errorf("patch is not supported by deny actions")
+	}
+	if a.Effect == EffectDeny && a.Mounts != nil {
+		return fmt.Errorf("mounts are not supported by deny actions")
 	}
+	if a.Effect == EffectDeny && a.Images != nil {
+		return fmt.Errorf("images are not supported by deny actions")
+	}
+	if a.Effect == EffectDeny && a.Response != nil {
+		return fmt.Errorf("response is not supported by deny actions")
+	}
+	if a.Effect == EffectDeny && a.Owner {
+		return fmt.Errorf("owner is not supported by deny actions")
+	}
+	if err := validateQuery(a.Query); err != nil {
+		return err
+	}
+	a.condition = nil
+	if a.If != "" {
+		if a.condition, err = compileCondition(a.If); err != nil {
+			return err
+		}
+	}
+	if err := validateBody(a.Body, ""); err != nil {
+		return err
+	}
+	if a.Mounts != nil {
+		if err := a.Mounts.validate(); err != nil {
+			return err
+		}
+	}
+	if a.Images != nil {
+		if err := a.Images.validate(); err != nil {
+			return err
+		}
+	}
+	if a.Patch != nil {
+		if err := a.Patch.validate(); err != nil {
+			return err
+		}
+	}
+	if a.Response != nil {
+		if err := a.Response.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches returns true if the action name (a regular expression) matches the docker action
+func (a *Action) matches(action string) bool {
+	if a.nameRe != nil {
+		return a.nameRe.MatchString(action)
+	}
+	match, err := regexp.MatchString(a.Name, action)
+	if err != nil {
+		logrus.Errorf("Failed to evaluate action %q against policy %q error %q", action, a.Name, err.Error())
+	}
+	return match
+}
 
-	f.policies = policies
+// AnubisAuthorizerSettings provides settings for the anubis authorizer flow
+type AnubisAuthorizerSettings struct {
+	PolicyPath   string // PolicyPath is the path to the policy settings
+	Combining    string // Combining is the algorithm combining the decisions of the policies (defaults to first-match)
+	StatePath    string // StatePath is the path to the state database (ownership tracking and quotas are disabled if empty)
+	OwnerLabel   string // OwnerLabel is the container label holding the owner (defaults to DefaultOwnerLabel)
+	DockerSocket string // DockerSocket is the docker daemon socket used to rebuild the owners on startup (skipped if empty)
+}
+
+type anubisAuthorizer struct {
+	settings *AnubisAuthorizerSettings
+	loader   *policyLoader[*anubisPolicySet]
+	watcher  *policyWatcher
+	owners   *ownership       // owners tracks the owners of containers, nil if disabled
+	limiter  *rateLimiter     // limiter holds the rate limits state
+	now      func() time.Time // now returns the current time (replaced by a fake clock in tests)
+}
+
+// NewAnubisAuthZAuthorizer creates a new anubis authorizer
+func NewAnubisAuthZAuthorizer(settings *AnubisAuthorizerSettings) core.Authorizer {
+	return &anubisAuthorizer{
+		settings: settings,
+		loader:   newPolicyLoader(settings.PolicyPath, parseAnubisPolicySet),
+		limiter:  newRateLimiter(),
+		now:      time.Now,
+	}
+}
+
+// policies returns the active policies
+func (f *anubisAuthorizer) policies() []AnubisPolicy {
+	if set := f.loader.get(); set != nil {
+		return set.policies
+	}
 	return nil
 }
 
+// sources returns the files the active policies were loaded from
+func (f *anubisAuthorizer) sources() []string {
+	if set := f.loader.get(); set != nil {
+		return set.files
+	}
+	return nil
+}
+
+// PolicyStatus returns the status of the policy loads
+func (f *anubisAuthorizer) PolicyStatus() core.PolicyStatus {
+	return f.loader.PolicyStatus()
+}
+
+// ActivePolicies returns the active policies, with their includes, fragments and groups resolved
+func (f *anubisAuthorizer) ActivePolicies() interface{} {
+	return f.policies()
+}
+
 // Init loads the anubis authz plugin configuration from disk
 func (f *anubisAuthorizer) Init() error {
-	err := f.loadPolicies()
-	if err != nil {
+	if err := ValidateCombining(f.settings.Combining); err != nil {
 		return err
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	err := f.Reload()
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Event:
-				if ev.IsModify() {
-					err := f.loadPolicies()
-					if err != nil {
-						logrus.Errorf("Error refreshing policy %q", err.Error())
-					}
-				}
-			case err := <-watcher.Error:
-				logrus.Errorf("Settings watcher error '%v'", err)
-			}
+	if f.settings.StatePath != "" {
+		store, err := openStateStore(f.settings.StatePath)
+		if err != nil {
+			return err
+		}
+		f.owners = &ownership{store: store, label: f.settings.OwnerLabel, pending: newReservations()}
+		if f.owners.label == "" {
+			f.owners.label = DefaultOwnerLabel
+		}
+		if f.settings.DockerSocket != "" {
+			f.owners.rebuildRetry(f.settings.DockerSocket)
 		}
-	}()
+	}
 
-	err = watcher.Watch(f.settings.PolicyPath)
+	f.watcher, err = watchPolicy(f.settings.PolicyPath, f.Reload, f.sources)
 	if err != nil {
 		// Silently ignore watching error
 		logrus.Errorf("Failed to start watching folder %q", err.Error())
@@ -112,175 +372,404 @@ func (f *anubisAuthorizer) Init() error {
 	return nil
 }
 
-func parseAction(authZReq *authorization.Request) (string, error) {
+// Reload reloads the policy from disk, keeping the current policy if the new one is invalid
+func (f *anubisAuthorizer) Reload() error {
+	return f.loader.load()
+}
+
+// Close stops watching the policy and closes the state store
+func (f *anubisAuthorizer) Close() error {
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	if f.owners != nil {
+		return f.owners.store.Close()
+	}
+	return nil
+}
+
+// parseAction parses the request URI into the docker route (action and path parameters)
+func parseAction(authZReq *authorization.Request) (core.Route, error) {
 	url, err := url.Parse(authZReq.RequestURI)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("invalid request URI: %s", err.Error()))
+		return core.Route{}, errors.New(fmt.Sprintf("invalid request URI: %s", err.Error()))
 	}
-	fmt.Println("query:", url.Query(), reflect.TypeOf(url.Query()))
 	return core.ParseRoute(authZReq.RequestMethod, url.Path), nil
 }
 
-func CheckBody(authzBody map[string]interface{}, policyBody map[string]interface{}, chain string) (bool, string) {
+// validateBody verifies the matchers of a body policy are well formed
+func validateBody(policyBody map[string]interface{}, chain string) error {
 	for k, policyV := range policyBody {
+		key := chain + "." + k
+		_, isMatcher, err := asMatcher(policyV)
+		if err != nil {
+			return fmt.Errorf("body key '%s': %s", key, err.Error())
+		}
+		if nested, ok := policyV.(map[string]interface{}); ok && !isMatcher {
+			if err := validateBody(nested, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckBody checks the request body against the body policy. For each key of the policy:
+//
+//	null      - the request value must be absent or empty (e.g. false, 0, "", [])
+//	matcher   - the request value must satisfy the matcher (see Matcher)
+//	mapping   - the request value is checked recursively
+//	otherwise - the request value must be absent or equal to the policy value
+//
+// Keys that are absent from the request are skipped, unless required by a matcher. Keys are matched
+// case-insensitively like docker daemon does (see decodeBody), and checked in sorted order such that
+// the reported key is deterministic.
+func CheckBody(authzBody map[string]interface{}, policyBody map[string]interface{}, chain string) (bool, string) {
+	for _, k := range sortedKeys(policyBody) {
+		policyV := policyBody[k]
 		msg := chain + "." + k
+		authzV, present := lookupKey(authzBody, k)
 
-		if authzV, ok := authzBody[k]; ok {
-			switch policyV.(type) {
-			case map[string]interface{}:
-				check, msg := CheckBody(authzV.(map[string]interface{}), policyV.(map[string]interface{}), msg)
-				if !check {
-					return false, msg
-				}
-			default:
-				if policyV == nil {
-					switch authzV {
-					case nil:
-						continue
-					case 0:
-						continue
-					case false:
-						continue
-					default:
-						rt := reflect.TypeOf(authzV)
-						switch rt.Kind() {
-						case reflect.Array, reflect.Slice:
-							l := reflect.ValueOf(authzV).Len()
-							fmt.Println("l =", l)
-							if l != 0 {
-								logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-								return false, fmt.Sprintf("%s != %v", msg, policyV)
-							}
-						default:
-							logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-							return false, fmt.Sprintf("%s != %v", msg, policyV)
-						}
-					}
-				} else {
-					if policyV != authzV {
-						logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-						return false, fmt.Sprintf("%s != %v", msg, policyV)
-					}
-				}
+		matcher, ok, err := asMatcher(policyV)
+		if err != nil {
+			logrus.Errorf("Failing on invalid matcher %s %q", msg, err.Error())
+			return false, fmt.Sprintf("%s invalid matcher", msg)
+		}
+		if ok {
+			check, reason := checkMatcher(matcher, authzV, present)
+			if !check {
+				logrus.Errorf("Failing on value not matching %s %s", msg, reason)
+				return false, fmt.Sprintf("%s %s", msg, reason)
 			}
+			continue
+		}
+
+		// Nested policies are evaluated even if absent from the request, as they may require keys
+		if nested, ok := policyV.(map[string]interface{}); ok {
+			authzMap, ok := authzV.(map[string]interface{})
+			if !ok && authzV != nil {
+				logrus.Errorf("Failing on value not matching %s %v is not an object", msg, authzV)
+				return false, fmt.Sprintf("%s is not an object", msg)
+			}
+			check, msg := CheckBody(authzMap, nested, msg)
+			if !check {
+				return false, msg
+			}
+			continue
+		}
+
+		if !present {
+			continue
+		}
+
+		if (policyV == nil && !isEmpty(authzV)) || (policyV != nil && !valuesEqual(policyV, authzV)) {
+			logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
+			return false, fmt.Sprintf("%s != %v", msg, policyV)
 		}
 	}
 	return true, ""
 }
 
-// func CheckArgs(query *url.Values, policyArgs map[string]interface{}, chain string) (bool, string) {
-
-// 	for k, policyV := range policyArgs {
-// 		msg := chain + "." + k
-
-// 		if query.Has(k) {
-// 			authV := query.Get(k)
-// 			switch policyV.(type) {
-// 			case map[string]interface{}:
-// 				check, msg := CheckBody(authzV.(map[string]interface{}), policyV.(map[string]interface{}), msg)
-// 				if !check {
-// 					return false, msg
-// 				}
-// 			default:
-// 				if policyV == nil {
-// 					switch authzV {
-// 					case nil:
-// 						continue
-// 					case 0:
-// 						continue
-// 					case false:
-// 						continue
-// 					default:
-// 						rt := reflect.TypeOf(authzV)
-// 						switch rt.Kind() {
-// 						case reflect.Array, reflect.Slice:
-// 							l := reflect.ValueOf(authzV).Len()
-// 							fmt.Println("l =", l)
-// 							if l != 0 {
-// 								logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-// 								return false, fmt.Sprintf("%s != %v", msg, policyV)
-// 							}
-// 						default:
-// 							logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-// 							return false, fmt.Sprintf("%s != %v", msg, policyV)
-// 						}
-// 					}
-// 				} else {
-// 					if policyV != authzV {
-// 						logrus.Errorf("Failing on value not matching %s %v != %v", msg, policyV, authzV)
-// 						return false, fmt.Sprintf("%s != %v", msg, policyV)
-// 					}
-// 				}
-// 			}
-// 		}
-// 	}
-// 	return true, ""
-// }
+// checkMatcher checks a body value against a matcher
+func checkMatcher(matcher *Matcher, authzV interface{}, present bool) (bool, string) {
+	if !present || authzV == nil {
+		if matcher.Required {
+			return false, "is required"
+		}
+		return true, ""
+	}
 
+	if matcher.Forbidden {
+		if !isEmpty(authzV) {
+			return false, fmt.Sprintf("%v is forbidden", authzV)
+		}
+		return true, ""
+	}
+
+	return matcher.matchValue(authzV)
+}
+
+// matchBody returns true if the request body matches the body of a deny action. Unlike CheckBody,
+// the keys absent from the request do not match, unless the policy value is null.
+func matchBody(authzBody map[string]interface{}, policyBody map[string]interface{}) bool {
+	for k, policyV := range policyBody {
+		authzV, present := lookupKey(authzBody, k)
+		if policyV == nil {
+			if !isEmpty(authzV) {
+				return false
+			}
+			continue
+		}
+		if !present || authzV == nil {
+			return false
+		}
+
+		if matcher, ok, _ := asMatcher(policyV); ok {
+			if check, _ := checkMatcher(matcher, authzV, present); !check {
+				return false
+			}
+			continue
+		}
+
+		if nested, ok := policyV.(map[string]interface{}); ok {
+			authzMap, ok := authzV.(map[string]interface{})
+			if !ok || !matchBody(authzMap, nested) {
+				return false
+			}
+			continue
+		}
+
+		if !valuesEqual(policyV, authzV) {
+			return false
+		}
+	}
+	return true
+}
+
+// policyRequest is a docker request evaluated against the anubis policies
+type policyRequest struct {
+	*authorization.Request
+	route   core.Route             // route is the parsed request route
+	action  string                 // action is the docker action (mapped to authz terminology)
+	owners  *ownership             // owners tracks the owners of containers, nil if disabled
+	now     time.Time              // now is the time the request is evaluated at
+	query   url.Values             // query are the request query parameters
+	body    map[string]interface{} // body is the decoded body of POST requests, with canonical keys (see decodeBody)
+	bodyErr error                  // bodyErr is the error decoding the body
+}
+
+// newPolicyRequest parses the query and the body of the request
+func newPolicyRequest(authZReq *authorization.Request, route core.Route) *policyRequest {
+	req := &policyRequest{Request: authZReq, route: route, action: route.Action, now: time.Now()}
+	if u, err := url.Parse(authZReq.RequestURI); err == nil {
+		req.query = u.Query()
+	}
+	if authZReq.RequestMethod == http.MethodPost && len(authZReq.RequestBody) > 0 {
+		req.body, req.bodyErr = decodeBody(route.Action, authZReq.RequestBody, false)
+	}
+	return req
+}
+
+// CheckPolicy evaluates the request against the policies applying to the user, the first policy action
+// matching the request deciding (see CheckPolicyCombining).
 func CheckPolicy(authZReq *authorization.Request, policies []AnubisPolicy, action string) (bool, string) {
-	noPolicyMsg := fmt.Sprintf("no policy applied (action: '%s')", action)
+	return CheckPolicyCombining(authZReq, policies, action, CombiningFirstMatch)
+}
+
+// CheckPolicyCombining evaluates the request against the policies applying to the user. Every policy action
+// matching the request yields a decision, combined according to the combining algorithm:
+//
+//	first-match     - the first decision applies (default)
+//	deny-overrides  - any deny decision applies, otherwise the first allow decision
+//	allow-overrides - any allow decision applies, otherwise the first deny decision
+//
+// An allow action denies the request when its constraints are not satisfied (or the policy is readonly),
+// while a deny action denies the request when its constraints are all satisfied, and is skipped otherwise.
+func CheckPolicyCombining(authZReq *authorization.Request, policies []AnubisPolicy, action string, combining string) (bool, string) {
+	result := checkPolicies(newPolicyRequest(authZReq, core.Route{Action: action}), policies, combining, nil)
+	return result.allow, result.msg
+}
+
+// checkPolicies evaluates the parsed request against the policies (see CheckPolicyCombining), recording
+// each policy and action considered to the trace if not nil
+func checkPolicies(req *policyRequest, policies []AnubisPolicy, combining string, trace *Explanation) decision {
+	authZReq, action := req.Request, req.action
+	noPolicyMsg := fmt.Sprintf("no policy applied (user: '%s' action: '%s')", authZReq.User, action)
+	decisions := &combiner{combining: combining}
 
 	// Check policies
 	for _, policy := range policies {
+		policyTrace := trace.addPolicy(&policy, req)
 
-		// Generate messages
-		notAllowedMsg := fmt.Sprintf("action '%s' not allowed for user '%s' by readonly policy '%s'", action, authZReq.User, policy.Name)
-		allowedMsg := fmt.Sprintf("action '%s' allowed for user '%s' by policy '%s'", action, authZReq.User, policy.Name)
+		// Skip policies that do not apply to the user, or not at this time
+		if !policy.appliesTo(authZReq.User) || !policy.activeAt(req.now) {
+			continue
+		}
 
 		// Check policy actions
-		for _, policyAction := range policy.Actions {
-			match, err := regexp.MatchString(policyAction.Name, action)
-			if err != nil {
-				logrus.Errorf("Failed to evaluate action %q against policy %q error %q", action, policyAction.Name, err.Error())
-			}
-
+		for i := range policy.Actions {
+			policyAction := &policy.Actions[i]
+			actionTrace := policyTrace.addAction(policyAction, action, req)
 			// If policy matches this action
-			if !match {
+			if !policyAction.matches(action) {
 				continue
 			}
 
-			if policyAction.Body != nil && authZReq.RequestMethod == http.MethodPost {
-				// Parse the body of the statement
-				var body map[string]interface{}
-				err = yaml.Unmarshal(authZReq.RequestBody, &body)
-				if err != nil {
-					logrus.Errorf("Failed to evaluate json authZReq.RequestBody %q error %q", authZReq.RequestBody, err.Error())
-				} else {
-					check, msg := CheckBody(body, policyAction.Body, "")
-					if !check {
-						deniedMsg := fmt.Sprintf("action '%s' denied for user '%s' by policy '%s' on value '%s'", action, authZReq.User, policy.Name, msg)
-						return false, deniedMsg
-					}
+			var allow bool
+			var msg string
+			if policyAction.Effect == EffectDeny {
+				var applies bool
+				applies, msg = policyAction.checkDeny(req, &policy)
+				if !applies {
+					continue
 				}
+			} else {
+				allow, msg = policyAction.checkAllow(req, &policy)
+			}
+			final := decisions.add(allow, msg, policy.Name)
+			actionTrace.decide(allow, msg, final)
+			if final {
+				return decisions.result(noPolicyMsg)
+			}
+		}
+	}
+
+	// Default to no policy deny
+	return decisions.result(noPolicyMsg)
+}
+
+// checkConstraints checks the query, body, mounts, images, condition and owner constraints of the action.
+// It returns the reason of the first unsatisfied constraint, if any.
+func (a *Action) checkConstraints(req *policyRequest) (bool, string) {
+	if a.Query != nil {
+		check, msg := CheckQuery(req.query, a.Query)
+		if !check {
+			return false, fmt.Sprintf("on query '%s'", msg)
+		}
+	}
+
+	if (a.Body != nil || a.Mounts != nil) && req.RequestMethod == http.MethodPost {
+		if req.bodyErr != nil {
+			logrus.Errorf("Failed to evaluate json authZReq.RequestBody %q error %q", req.RequestBody, req.bodyErr.Error())
+			return false, "on invalid body"
+		}
+
+		if a.Body != nil {
+			check, msg := CheckBody(req.body, a.Body, "")
+			if !check {
+				return false, fmt.Sprintf("on value '%s'", msg)
 			}
+		}
 
-			if policy.Readonly && authZReq.RequestMethod != http.MethodGet {
-				return false, notAllowedMsg
+		if a.Mounts != nil {
+			check, msg := checkMounts(req.body, a.Mounts)
+			if !check {
+				return false, fmt.Sprintf("on mount '%s'", msg)
 			}
+		}
+	}
 
-			return true, allowedMsg
+	if a.Images != nil {
+		if req.bodyErr != nil && req.action == core.ActionContainerCreate {
+			return false, "on invalid body"
+		}
+		check, msg := checkImages(req.action, req.query, req.body, a.Images)
+		if !check {
+			return false, fmt.Sprintf("on image '%s'", msg)
 		}
 	}
 
-	// Default to no policy deny
-	return false, noPolicyMsg
+	if a.condition != nil {
+		if req.bodyErr != nil {
+			return false, "on invalid body"
+		}
+		check, err := a.evalCondition(req)
+		if err != nil {
+			logrus.Errorf("Failed to evaluate condition %q error %q", a.If, err.Error())
+			return false, fmt.Sprintf("on condition '%s' (%s)", a.If, err.Error())
+		}
+		if !check {
+			return false, fmt.Sprintf("on condition '%s'", a.If)
+		}
+	}
+
+	if a.Owner {
+		check, msg := req.owners.checkOwner(req)
+		if !check {
+			return false, fmt.Sprintf("on owner '%s'", msg)
+		}
+	}
+	return true, ""
+}
+
+// checkAllow evaluates an allow action matching the request
+func (a *Action) checkAllow(req *policyRequest, policy *AnubisPolicy) (bool, string) {
+	if check, reason := a.checkConstraints(req); !check {
+		return false, fmt.Sprintf("action '%s' denied for user '%s' by policy '%s' %s", req.action, req.User, policy.Name, reason)
+	}
+
+	if policy.Readonly && req.RequestMethod != http.MethodGet {
+		return false, fmt.Sprintf("action '%s' not allowed for user '%s' by readonly policy '%s'", req.action, req.User, policy.Name)
+	}
+
+	return true, fmt.Sprintf("action '%s' allowed for user '%s' by policy '%s'", req.action, req.User, policy.Name)
+}
+
+// checkDeny evaluates a deny action matching the request, which applies if the request matches its
+// query and body (see matchQuery and matchBody) and satisfies its condition. Requests with an invalid
+// body are denied, while conditions failing to evaluate (e.g. on absent keys) do not apply.
+func (a *Action) checkDeny(req *policyRequest, policy *AnubisPolicy) (bool, string) {
+	if a.Query != nil && !matchQuery(req.query, a.Query) {
+		return false, ""
+	}
+	if a.Body != nil {
+		if req.RequestMethod != http.MethodPost {
+			return false, ""
+		}
+		if req.bodyErr != nil {
+			return true, fmt.Sprintf("action '%s' denied for user '%s' by policy '%s' on invalid body", req.action, req.User, policy.Name)
+		}
+		if !matchBody(req.body, a.Body) {
+			return false, ""
+		}
+	}
+	if a.condition != nil {
+		if req.bodyErr != nil {
+			return true, fmt.Sprintf("action '%s' denied for user '%s' by policy '%s' on invalid body", req.action, req.User, policy.Name)
+		}
+		if check, err := a.evalCondition(req); err != nil || !check {
+			return false, ""
+		}
+	}
+	return true, fmt.Sprintf("action '%s' denied for user '%s' by deny rule of policy '%s'", req.action, req.User, policy.Name)
 }
 
 func (f *anubisAuthorizer) AuthZReq(authZReq *authorization.Request) *authorization.Response {
 	logrus.Debugf("Received AuthZ request, method: '%s', url: '%s'", authZReq.RequestMethod, authZReq.RequestURI)
 
 	// Parse the request for an action
-	action, err := parseAction(authZReq)
+	route, err := parseAction(authZReq)
 	if err != nil {
+		core.RecordDecision("", authZReq.User, "", false)
 		return &authorization.Response{Allow: false, Msg: err.Error()}
 	}
 
 	// Iterate over policies
-	allowed, msg := CheckPolicy(authZReq, f.policies, action)
-	return &authorization.Response{Allow: allowed, Msg: msg}
+	policies, now := f.policies(), f.now()
+	req := newPolicyRequest(authZReq, route)
+	req.owners, req.now = f.owners, now
+	result := checkPolicies(req, policies, f.settings.Combining, nil)
+	if result.allow {
+		// Allowed requests must fit in the quota of the user
+		if check, reason := f.checkQuota(req, false); !check {
+			result.allow, result.msg = false, reason
+		}
+	}
+	if result.allow {
+		// Only the allowed requests take a token of the rate limits, such that denied requests do not exhaust them
+		if allowed, msg := f.limiter.allow(policies, authZReq.User, route.Action, now); !allowed {
+			result.allow, result.msg, result.policy = false, msg, ""
+			if f.owners != nil {
+				// The request never reaches the daemon, release the quota usage it reserved
+				f.owners.release(authZReq)
+			}
+		}
+	}
+	core.RecordDecision(route.Action, authZReq.User, result.policy, result.allow)
+	return &authorization.Response{Allow: result.allow, Msg: result.msg}
 }
 
-// AuthZRes always allow responses from server
+// AuthZRes learns the owners and the resources of the objects created by the request, and checks the responses from server
+// against the response policies of the actions matching the request
 func (f *anubisAuthorizer) AuthZRes(authZReq *authorization.Request) *authorization.Response {
-	return &authorization.Response{Allow: true}
+	if f.owners != nil {
+		if route, err := parseAction(authZReq); err == nil {
+			if err := f.owners.settle(authZReq, route); err != nil {
+				logrus.Errorf("Failed to learn owners %q", err.Error())
+			}
+		}
+	}
+
+	allowed, msg, _ := f.checkResponse(authZReq, false)
+	return &authorization.Response{Allow: allowed, Msg: msg}
 }
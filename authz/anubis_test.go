@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"testing"
 
 	"github.com/docker/docker/pkg/authorization"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestAnubis(t *testing.T) {
@@ -46,3 +48,321 @@ func TestAnubis(t *testing.T) {
 		assert.Contains(t, res.Msg, test.expectedPolicy, "Policy name must appear in the response")
 	}
 }
+
+func TestAnubisUsers(t *testing.T) {
+
+	policy := `
+groups:
+  admins: ["admin_1", "admin_2"]
+policies:
+  - name: policy_admin
+    groups: ["admins"]
+    actions: [{name: ""}]
+  - name: policy_pipeline
+    users: ["pipeline"]
+    actions: [{name: "container_create"}, {name: "container_start"}]
+  - name: policy_api
+    users: ["api"]
+    readonly: true
+    actions: [{name: "container"}]
+`
+
+	const policyFileName = "/tmp/anubis-policy-users.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method         string
+		uri            string
+		user           string // user is the user in the request
+		allow          bool   // allow is the allow/deny response from the policy plugin
+		expectedPolicy string // expectedPolicy is the expected policy name that should appear in the message
+	}{
+		{http.MethodGet, "/v1.41/version", "admin_1", true, "policy_admin"},                  // Group member can do anything
+		{http.MethodPost, "/v1.41/containers/id/kill", "admin_2", true, "policy_admin"},      // Group member can do anything
+		{http.MethodPost, "/v1.41/containers/id/start", "pipeline", true, "policy_pipeline"}, // User allowed by its own policy
+		{http.MethodGet, "/v1.41/version", "pipeline", false, "no policy"},                   // Action not in user policy
+		{http.MethodGet, "/v1.41/containers/id/json", "api", true, "policy_api"},             // Readonly policy - GET allowed
+		{http.MethodPost, "/v1.41/containers/id/start", "api", false, "policy_api"},          // Readonly policy - POST denied
+		{http.MethodGet, "/v1.41/version", "student", false, "no policy"},                    // Unknown user
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: test.user})
+		assert.Equal(t, test.allow, res.Allow, "Request must be allowed/denied based on policy")
+		assert.Contains(t, res.Msg, test.expectedPolicy, "Policy name must appear in the response")
+	}
+}
+
+func TestAnubisUnknownGroup(t *testing.T) {
+	_, err := parseAnubisPolicies([]byte(`{"policies":[{"name":"policy_1","groups":["missing"],"actions":[{"name":""}]}]}`))
+	assert.Error(t, err, "Unknown groups must be rejected")
+}
+
+func TestAnubisQuery(t *testing.T) {
+
+	policy := `[
+		{"name":"policy_1","actions":[{"name":"container_delete","query":{"force":{"forbidden":true}}}]},
+		{"name":"policy_2","actions":[{"name":"image_create","query":{"fromImage":{"required":true,"regex":"registry\\.anubis-lms\\.io/.+"},"tag":{"oneOf":["python-3.10","python-3.11"]}}}]},
+		{"name":"policy_3","actions":[{"name":"volume_remove","query":{"v":{"forbidden":true}}}]},
+		]`
+
+	const policyFileName = "/tmp/anubis-policy-query.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method      string
+		uri         string
+		allow       bool   // allow is the allow/deny response from the policy plugin
+		expectedMsg string // expectedMsg is the expected text that should appear in the message
+	}{
+		{http.MethodDelete, "/v1.41/containers/id", true, "policy_1"},
+		{http.MethodDelete, "/v1.41/containers/id?force=0", true, "policy_1"},
+		{http.MethodDelete, "/v1.41/containers/id?force=1", false, "force=1"},
+		{http.MethodDelete, "/v1.41/containers/id?force=true", false, "force=true"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=registry.anubis-lms.io/anubis/theia&tag=python-3.10", true, "policy_2"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=docker.io/library/alpine&tag=python-3.10", false, "fromImage"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=registry.anubis-lms.io/anubis/theia&tag=latest", false, "tag"},
+		{http.MethodPost, "/v1.41/images/create?fromSrc=-", false, "fromImage is required"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=docker.io/library/alpine&tag=latest", false, "fromImage"}, // First offending parameter in sorted order
+		{http.MethodDelete, "/v1.41/volumes/id?v=true", false, "v=true"},
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: "test"})
+		assert.Equal(t, test.allow, res.Allow, "Request must be allowed/denied based on policy: %s", test.uri)
+		assert.Contains(t, res.Msg, test.expectedMsg, "Message must name the policy or parameter")
+	}
+}
+
+func TestAnubisBodyMatchers(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_create
+      body:
+        Image: {required: true, regex: "registry\\.anubis-lms\\.io/.*"}
+        HostConfig:
+          Memory: {required: true, min: 64Mi, max: 2Gi}
+          NetworkMode: {oneOf: ["student", "none"]}
+          CapAdd: {subsetOf: ["CHOWN", "SETUID"]}
+          Privileged: {forbidden: true}
+          Runtime: {prefix: "runsc"}
+`
+
+	const policyFileName = "/tmp/anubis-policy-matchers.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		body        string
+		allow       bool   // allow is the allow/deny response from the policy plugin
+		expectedMsg string // expectedMsg is the expected text that should appear in the message
+	}{
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":2147483648,"NetworkMode":"student"}}`, true, "policy_1"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":67108864,"NetworkMode":"none","CapAdd":["CHOWN"],"Privileged":false,"Runtime":"runsc-kvm"}}`, true, "policy_1"},
+		{`{"Image":"alpine","HostConfig":{"Memory":2147483648}}`, false, ".Image alpine does not match"},
+		{`{"HostConfig":{"Memory":2147483648}}`, false, ".Image is required"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{}}`, false, ".HostConfig.Memory is required"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia"}`, false, ".HostConfig.Memory is required"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":4294967296}}`, false, "> max 2Gi"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":1024}}`, false, "< min 64Mi"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":2147483648,"NetworkMode":"host"}}`, false, ".HostConfig.NetworkMode host not one of"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":2147483648,"CapAdd":["SYS_ADMIN"]}}`, false, ".HostConfig.CapAdd SYS_ADMIN not in"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":2147483648,"Privileged":true}}`, false, ".HostConfig.Privileged true is forbidden"},
+		{`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Memory":2147483648,"Runtime":"runc"}}`, false, ".HostConfig.Runtime runc does not start with runsc"},
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "test", RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "Request must be allowed/denied based on policy: %s", test.body)
+		assert.Contains(t, res.Msg, test.expectedMsg, "Message must name the policy or body key")
+	}
+}
+
+func TestAnubisInvalidMatcher(t *testing.T) {
+	_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_create","body":{"Image":{"regex":"("}}}]}]`))
+	assert.Error(t, err, "Invalid regex must be rejected")
+
+	_, err = parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_create","body":{"HostConfig":{"Memory":{"max":"2Zi"}}}}]}]`))
+	assert.Error(t, err, "Invalid bound must be rejected")
+}
+
+func TestAnubisMounts(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_create
+      mounts:
+        types: [bind, volume, tmpfs]
+        hostPaths:
+          - prefix: /srv/anubis/shared
+            readOnly: true
+          - prefix: /srv/anubis/scratch
+        volumes: ["ide-[a-z0-9-]+"]
+`
+
+	const policyFileName = "/tmp/anubis-policy-mounts.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		body        string
+		allow       bool   // allow is the allow/deny response from the policy plugin
+		expectedMsg string // expectedMsg is the expected text that should appear in the message
+	}{
+		{`{"HostConfig":{}}`, true, "policy_1"},
+		{`{"HostConfig":{"Binds":["ide-home:/home/anubis","/srv/anubis/shared/cs101:/shared:ro","/srv/anubis/scratch:/scratch","/data"]}}`, true, "policy_1"},
+		{`{"HostConfig":{"Mounts":[{"Type":"volume","Source":"ide-home","Target":"/home/anubis"},{"Type":"tmpfs","Target":"/tmp"}]}}`, true, "policy_1"},
+		{`{"HostConfig":{"Binds":["/:/host"]}}`, false, "bind mount of / not allowed"},
+		{`{"HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock"]}}`, false, "bind mount of /var/run/docker.sock not allowed"},
+		{`{"HostConfig":{"Binds":["/srv/anubis/shared/../../../etc:/etc"]}}`, false, "bind mount of /etc not allowed"},
+		{`{"HostConfig":{"Binds":["/srv/anubis/shared-other:/shared:ro"]}}`, false, "not allowed"},
+		{`{"HostConfig":{"Binds":["/srv/anubis/shared:/shared"]}}`, false, "must be read-only"},
+		{`{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/var/run/docker.sock","Target":"/var/run/docker.sock"}]}}`, false, "bind mount of /var/run/docker.sock not allowed"},
+		{`{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/srv/anubis/shared","Target":"/shared","ReadOnly":true}]}}`, true, "policy_1"},
+		{`{"HostConfig":{"Binds":["other-volume:/data"]}}`, false, "volume other-volume not allowed"},
+		{`{"HostConfig":{"Mounts":[{"Type":"volume","Source":"ide-home","Target":"/home","VolumeOptions":{"DriverConfig":{"Name":"local","Options":{"type":"none","o":"bind","device":"/"}}}}]}}`, false, "driver options"},
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "test", RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "Request must be allowed/denied based on policy: %s", test.body)
+		assert.Contains(t, res.Msg, test.expectedMsg, "Message must name the policy or mount")
+	}
+}
+
+func TestAnubisShippedPolicy(t *testing.T) {
+	data, err := ioutil.ReadFile("policy-anubis.yaml")
+	assert.NoError(t, err)
+
+	policies, err := parseAnubisPolicies(data)
+	assert.NoError(t, err, "Shipped policy must be valid")
+	assert.NotEmpty(t, policies)
+
+	// Compiled policies are served back as YAML by the admin endpoint
+	dump, err := yaml.Marshal(policies)
+	assert.NoError(t, err)
+	reparsed, err := parseAnubisPolicies(dump)
+	assert.NoError(t, err, "Dumped policies must be valid")
+	assert.Len(t, reparsed, len(policies))
+}
+
+func TestAnubisCombining(t *testing.T) {
+
+	policy := `
+policies:
+  - name: policy_global
+    actions:
+      - name: container_export
+        effect: deny
+      - name: container_create
+        effect: deny
+        body:
+          HostConfig:
+            Privileged: true
+      - name: container_delete
+        effect: deny
+        query:
+          force: {oneOf: ["1", "true"]}
+  - name: policy_user
+    users: ["user_1"]
+    actions:
+      - name: container_.*
+  - name: policy_hardened
+    actions:
+      - name: container_create
+        body:
+          HostConfig:
+            Memory: {max: 1Gi}
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	const (
+		exportURI = "/v1.41/containers/id/export"
+		createURI = "/v1.41/containers/create"
+		startURI  = "/v1.41/containers/id/start"
+	)
+	tests := []struct {
+		combining      string
+		method         string
+		uri            string
+		user           string
+		body           string
+		allow          bool
+		expectedPolicy string // expectedPolicy is the expected policy name that should appear in the message
+	}{
+		// Deny rules apply when matching, in every combining mode
+		{CombiningFirstMatch, http.MethodGet, exportURI, "user_1", "", false, "deny rule of policy 'policy_global'"},
+		{CombiningDenyOverrides, http.MethodGet, exportURI, "user_1", "", false, "deny rule of policy 'policy_global'"},
+		{CombiningFirstMatch, http.MethodPost, createURI, "user_1", `{"HostConfig":{"Privileged":true}}`, false, "deny rule of policy 'policy_global'"},
+		// Deny rules whose constraints are not satisfied are skipped
+		{CombiningFirstMatch, http.MethodPost, createURI, "user_1", `{"HostConfig":{"Privileged":false,"Memory":4294967296}}`, true, "policy_user"},
+		{CombiningFirstMatch, http.MethodPost, startURI, "user_1", "", true, "policy_user"},
+		{CombiningFirstMatch, http.MethodDelete, "/v1.41/containers/id?force=1", "user_1", "", false, "deny rule of policy 'policy_global'"},
+		{CombiningFirstMatch, http.MethodDelete, "/v1.41/containers/id", "user_1", "", true, "policy_user"},
+		// Deny overrides: the failed constraint of policy_hardened overrides policy_user
+		{CombiningDenyOverrides, http.MethodPost, createURI, "user_1", `{"HostConfig":{"Memory":4294967296}}`, false, "policy_hardened"},
+		{CombiningDenyOverrides, http.MethodPost, createURI, "user_1", `{"HostConfig":{"Memory":1073741824}}`, true, "policy_user"},
+		{CombiningDenyOverrides, http.MethodPost, startURI, "user_1", "", true, "policy_user"},
+		// Allow overrides: any allow decision applies
+		{CombiningAllowOverrides, http.MethodGet, exportURI, "user_1", "", true, "policy_user"},
+		{CombiningAllowOverrides, http.MethodPost, createURI, "user_2", `{"HostConfig":{"Memory":4294967296}}`, false, "policy_hardened"},
+		{CombiningAllowOverrides, http.MethodPost, createURI, "user_2", `{"HostConfig":{"Memory":1073741824}}`, true, "policy_hardened"},
+		// No policy matching
+		{CombiningDenyOverrides, http.MethodPost, startURI, "user_2", "", false, "no policy applied"},
+	}
+
+	for _, test := range tests {
+		authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName, Combining: test.combining})
+		assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+		authorizer.(*anubisAuthorizer).watcher.Close()
+
+		req := &authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: test.user, RequestBody: []byte(test.body)}
+		res := authorizer.AuthZReq(req)
+		assert.Equal(t, test.allow, res.Allow, "%s %s %s (%s): %s", test.combining, test.method, test.uri, test.user, res.Msg)
+		assert.Contains(t, res.Msg, test.expectedPolicy)
+
+		// The deciding policy labels the decision metrics
+		route, _ := parseAction(req)
+		result := checkPolicies(newPolicyRequest(req, route), authorizer.(*anubisAuthorizer).policies(), test.combining, nil)
+		assert.Contains(t, test.expectedPolicy, result.policy)
+
+		// The library functions reach the same decisions, CheckPolicy applying the first match
+		allow, msg := CheckPolicyCombining(req, authorizer.(*anubisAuthorizer).policies(), route.Action, test.combining)
+		assert.Equal(t, res.Allow, allow)
+		assert.Equal(t, res.Msg, msg)
+		if test.combining == CombiningFirstMatch {
+			allow, msg = CheckPolicy(req, authorizer.(*anubisAuthorizer).policies(), route.Action)
+			assert.Equal(t, res.Allow, allow)
+			assert.Equal(t, res.Msg, msg)
+		}
+	}
+
+	// Invalid effects and combining algorithms are refused
+	_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_create","effect":"maybe"}]}]`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid effect 'maybe'")
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName, Combining: "random"})
+	assert.Error(t, authorizer.Init())
+}
@@ -2,21 +2,19 @@ package authz
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log/syslog"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"sync"
 
 	"github.com/AnubisLMS/authz/core"
 
 	"github.com/docker/docker/pkg/authorization"
-	"github.com/howeyc/fsnotify"
 	"github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
-	"gopkg.in/yaml.v3"
 )
 
 // BasicPolicy represent a single policy object that is evaluated in the authorization flow.
@@ -26,62 +24,104 @@ import (
 //
 //	For each policy object check
 //	   If the user belongs to the policy
-//	      If action in request in policy allow otherwise deny
+//	      If action in request in policy allow (or deny for a deny policy) otherwise deny
 //	If no appropriate policy found, return deny
 //
 // Remark: In basic flow, each user must have a unique policy.
-// If a user is used by more than one policy, the results may be inconsistent
+// If a user is used by more than one policy, the results may be inconsistent, unless
+// a combining algorithm other than first-match is used: the policies of the user not
+// matching the action are then skipped, and the decisions of the others are combined.
 type BasicPolicy struct {
-	Actions  []string `yaml:"actions"`  // Actions are the docker actions (mapped to authz terminology) that are allowed according to this policy
-	Users    []string `yaml:"users"`    // Users are the users for which this policy apply to
-	Name     string   `yaml:"name"`     // Name is the policy name
-	Readonly bool     `yaml:"readonly"` // Readonly indicates this policy only allow get commands
+	Actions  []string `yaml:"actions"`          // Actions are the docker actions (mapped to authz terminology) that are allowed according to this policy
+	Users    []string `yaml:"users"`            // Users are the users for which this policy apply to
+	Name     string   `yaml:"name"`             // Name is the policy name
+	Readonly bool     `yaml:"readonly"`         // Readonly indicates this policy only allow get commands
+	Effect   string   `yaml:"effect,omitempty"` // Effect is the effect of the policy, either allow (default) or deny
+
+	actionRes []*regexp.Regexp // actionRes are the compiled actions
+}
+
+// basicPolicySet is an immutable, validated set of basic policies
+type basicPolicySet struct {
+	policies []BasicPolicy // policies are the policies evaluated in order
+}
+
+// size returns the number of policies in the set
+func (s *basicPolicySet) size() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.policies)
+}
+
+// parseBasicPolicySet strictly parses a policy file and compiles the policy actions
+func parseBasicPolicySet(data []byte) (*basicPolicySet, error) {
+	var policies []BasicPolicy
+	if err := decodeStrict(data, &policies); err != nil {
+		return nil, err
+	}
+
+	lines := sequenceLines(data, "")
+	for i := range policies {
+		if err := validateEffect(policies[i].Effect); err != nil {
+			return nil, lineError(lines, i, fmt.Errorf("policy '%s': %s", policies[i].Name, err.Error()))
+		}
+		for _, pattern := range policies[i].Actions {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, lineError(lines, i, fmt.Errorf("policy '%s' action '%s': invalid name: %s", policies[i].Name, pattern, err.Error()))
+			}
+			policies[i].actionRes = append(policies[i].actionRes, re)
+		}
+	}
+	return &basicPolicySet{policies: policies}, nil
 }
 
 type basicAuthorizer struct {
 	settings *BasicAuthorizerSettings
-	policies []BasicPolicy
+	loader   *policyLoader[*basicPolicySet]
+	watcher  *policyWatcher
 }
 
 // BasicAuthorizerSettings provides settings for the basic authorizer flow
 type BasicAuthorizerSettings struct {
 	PolicyPath string // PolicyPath is the path to the policy settings
+	Combining  string // Combining is the algorithm combining the decisions of the policies (defaults to first-match)
 }
 
 // NewBasicAuthZAuthorizer creates a new basic authorizer
 func NewBasicAuthZAuthorizer(settings *BasicAuthorizerSettings) core.Authorizer {
-	return &basicAuthorizer{settings: settings}
+	return &basicAuthorizer{
+		settings: settings,
+		loader:   newPolicyLoader(settings.PolicyPath, parseFile(parseBasicPolicySet)),
+	}
+}
+
+// PolicyStatus returns the status of the policy loads
+func (f *basicAuthorizer) PolicyStatus() core.PolicyStatus {
+	return f.loader.PolicyStatus()
+}
+
+// ActivePolicies returns the active policies
+func (f *basicAuthorizer) ActivePolicies() interface{} {
+	if set := f.loader.get(); set != nil {
+		return set.policies
+	}
+	return []BasicPolicy{}
 }
 
 // Init loads the basic authz plugin configuration from disk
 func (f *basicAuthorizer) Init() error {
-	err := f.loadPolicies()
-	if err != nil {
+	if err := ValidateCombining(f.settings.Combining); err != nil {
 		return err
 	}
 
-	watcher, err := fsnotify.NewWatcher()
+	err := f.Reload()
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case ev := <-watcher.Event:
-				if ev.IsModify() {
-					err := f.loadPolicies()
-					if err != nil {
-						logrus.Errorf("Error refreshing policy %q", err.Error())
-					}
-				}
-			case err := <-watcher.Error:
-				logrus.Errorf("Settings watcher error '%v'", err)
-			}
-		}
-	}()
-
-	err = watcher.Watch(f.settings.PolicyPath)
+	f.watcher, err = watchPolicy(f.settings.PolicyPath, f.Reload, nil)
 	if err != nil {
 		// Silently ignore watching error
 		logrus.Errorf("Failed to start watching folder %q", err.Error())
@@ -90,22 +130,16 @@ func (f *basicAuthorizer) Init() error {
 	return nil
 }
 
-func (f *basicAuthorizer) loadPolicies() error {
-	data, err := ioutil.ReadFile(path.Join(f.settings.PolicyPath))
-
-	if err != nil {
-		return err
-	}
-
-	var policies []BasicPolicy
-	yaml.Unmarshal(data, &policies)
-	logrus.Infof("Loaded '%d' policies", len(policies))
+// Reload reloads the policy from disk, keeping the current policy if the new one is invalid
+func (f *basicAuthorizer) Reload() error {
+	return f.loader.load()
+}
 
-	for _, policy := range policies {
-		logrus.Infof("Loaded %+v", policy)
+// Close stops watching the policy
+func (f *basicAuthorizer) Close() error {
+	if f.watcher != nil {
+		return f.watcher.Close()
 	}
-
-	f.policies = policies
 	return nil
 }
 
@@ -119,42 +153,64 @@ func (f *basicAuthorizer) AuthZReq(authZReq *authorization.Request) *authorizati
 			Msg:   fmt.Sprintf("invalid request URI: %s", err.Error()),
 		}
 	}
-	action := core.ParseRoute(authZReq.RequestMethod, url.Path)
-	for _, policy := range f.policies {
-		for _, user := range policy.Users {
-			if user == authZReq.User {
-				for _, policyActionPattern := range policy.Actions {
-					match, err := regexp.MatchString(policyActionPattern, action)
-					if err != nil {
-						logrus.Errorf("Failed to evaluate action %q against policy %q error %q", action, policyActionPattern, err.Error())
-					}
-
-					if match {
-						if policy.Readonly && authZReq.RequestMethod != http.MethodGet {
-							return &authorization.Response{
-								Allow: false,
-								Msg:   fmt.Sprintf("action '%s' not allowed for user '%s' by readonly policy '%s'", action, authZReq.User, policy.Name),
-							}
-						}
-
-						return &authorization.Response{
-							Allow: true,
-							Msg:   fmt.Sprintf("action '%s' allowed for user '%s' by policy '%s'", action, authZReq.User, policy.Name),
-						}
-					}
-				}
-				return &authorization.Response{
-					Allow: false,
-					Msg:   fmt.Sprintf("action '%s' denied for user '%s' by policy '%s'", action, authZReq.User, policy.Name),
-				}
+	action := core.ParseRoute(authZReq.RequestMethod, url.Path).Action
+	var policies []BasicPolicy
+	if set := f.loader.get(); set != nil {
+		policies = set.policies
+	}
+
+	decisions := &combiner{combining: f.settings.Combining}
+	firstMatch := f.settings.Combining == "" || f.settings.Combining == CombiningFirstMatch
+	for _, policy := range policies {
+		if !policy.appliesTo(authZReq.User) {
+			continue
+		}
+
+		var allow bool
+		var msg string
+		switch {
+		case !policy.matches(action):
+			// Legacy flow: the first policy of the user denies the actions it does not allow
+			if !firstMatch || policy.Effect == EffectDeny {
+				continue
 			}
+			msg = fmt.Sprintf("action '%s' denied for user '%s' by policy '%s'", action, authZReq.User, policy.Name)
+		case policy.Effect == EffectDeny:
+			msg = fmt.Sprintf("action '%s' denied for user '%s' by deny policy '%s'", action, authZReq.User, policy.Name)
+		case policy.Readonly && authZReq.RequestMethod != http.MethodGet:
+			msg = fmt.Sprintf("action '%s' not allowed for user '%s' by readonly policy '%s'", action, authZReq.User, policy.Name)
+		default:
+			allow = true
+			msg = fmt.Sprintf("action '%s' allowed for user '%s' by policy '%s'", action, authZReq.User, policy.Name)
+		}
+		if decisions.add(allow, msg, policy.Name) {
+			break
+		}
+	}
+
+	result := decisions.result(fmt.Sprintf("no policy applied (user: '%s' action: '%s')", authZReq.User, action))
+	core.RecordDecision(action, authZReq.User, result.policy, result.allow)
+	return &authorization.Response{Allow: result.allow, Msg: result.msg}
+}
+
+// appliesTo returns true if the user belongs to the policy
+func (p *BasicPolicy) appliesTo(user string) bool {
+	for _, u := range p.Users {
+		if u == user {
+			return true
 		}
 	}
+	return false
+}
 
-	return &authorization.Response{
-		Allow: false,
-		Msg:   fmt.Sprintf("no policy applied (user: '%s' action: '%s')", authZReq.User, action),
+// matches returns true if one of the policy actions matches the docker action
+func (p *BasicPolicy) matches(action string) bool {
+	for _, re := range p.actionRes {
+		if re.MatchString(action) {
+			return true
+		}
 	}
+	return false
 }
 
 // AuthZRes always allow responses from server
@@ -164,7 +220,9 @@ func (f *basicAuthorizer) AuthZRes(authZReq *authorization.Request) *authorizati
 
 // basicAuditor audit request/response directly to standard output
 type basicAuditor struct {
+	lock     sync.Mutex
 	logger   *logrus.Logger
+	file     *os.File // file is the audit log file (file hook only)
 	settings *BasicAuditorSettings
 }
 
@@ -190,7 +248,7 @@ func (b *basicAuditor) AuditRequest(req *authorization.Request, pluginRes *autho
 		return fmt.Errorf("Authorization response is nil")
 	}
 
-	err := b.init()
+	logger, err := b.init()
 	if err != nil {
 		return err
 	}
@@ -207,37 +265,116 @@ func (b *basicAuditor) AuditRequest(req *authorization.Request, pluginRes *autho
 		fields["err"] = pluginRes.Err
 	}
 
-	b.logger.WithFields(fields).Info("Request")
+	logger.WithFields(fields).Info("Request")
 	return nil
 }
 
 func (b *basicAuditor) AuditResponse(req *authorization.Request, pluginRes *authorization.Response) error {
-	// Only log requests
+
+	if req == nil {
+		return fmt.Errorf("Authorization request is nil")
+	}
+
+	if pluginRes == nil {
+		return fmt.Errorf("Authorization response is nil")
+	}
+
+	// Only log denied responses, allowed responses are audited by their request
+	if pluginRes.Allow && pluginRes.Err == "" {
+		return nil
+	}
+
+	logger, err := b.init()
+	if err != nil {
+		return err
+	}
+
+	fields := logrus.Fields{
+		"method": req.RequestMethod,
+		"uri":    req.RequestURI,
+		"user":   req.User,
+		"status": req.ResponseStatusCode,
+		"allow":  pluginRes.Allow,
+		"msg":    pluginRes.Msg,
+		"err":    pluginRes.Err,
+	}
+
+	logger.WithFields(fields).Info("Response")
 	return nil
 }
 
-// init inits the auditor logger
-func (b *basicAuditor) init() error {
+// init inits the auditor logger on first use
+func (b *basicAuditor) init() (*logrus.Logger, error) {
 
-	if b.settings == nil {
-		return fmt.Errorf("Settings is not defined")
-	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
 	if b.logger != nil {
+		return b.logger, nil
+	}
+
+	var err error
+	b.logger, b.file, err = b.open()
+	return b.logger, err
+}
+
+// Reload reopens the audit log (e.g. after the log file was rotated)
+func (b *basicAuditor) Reload() error {
+
+	logger, file, err := b.open()
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	previous := b.file
+	b.logger, b.file = logger, file
+	b.lock.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Ready initializes the auditor logger, reporting whether the audit log can be written
+func (b *basicAuditor) Ready() error {
+	_, err := b.init()
+	return err
+}
+
+// Close closes the audit log file
+func (b *basicAuditor) Close() error {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.file == nil {
 		return nil
 	}
+	err := b.file.Close()
+	b.logger, b.file = nil, nil
+	return err
+}
+
+// open creates the auditor logger, and opens the audit log file for the file hook
+func (b *basicAuditor) open() (*logrus.Logger, *os.File, error) {
+
+	if b.settings == nil {
+		return nil, nil, fmt.Errorf("Settings is not defined")
+	}
 
-	b.logger = logrus.New()
-	b.logger.Formatter = &logrus.JSONFormatter{}
+	logger := logrus.New()
+	logger.Formatter = &logrus.JSONFormatter{}
 
 	switch b.settings.LogHook {
 	case AuditHookSyslog:
 		{
 			hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_ERR, "authz")
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			b.logger.Hooks.Add(hook)
+			logger.Hooks.Add(hook)
 		}
 	case AuditHookFile:
 		{
@@ -250,17 +387,18 @@ func (b *basicAuditor) init() error {
 			os.MkdirAll(path.Dir(logPath), 0700)
 			f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0750)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			b.logger.Out = f
+			logger.Out = f
+			return logger, f, nil
 		}
 	case AuditHookStdout:
 		{
 			// Default - stdout
 		}
 	default:
-		return fmt.Errorf("Wrong log hook value '%s'", b.settings.LogHook)
+		return nil, nil, fmt.Errorf("Wrong log hook value '%s'", b.settings.LogHook)
 	}
 
-	return nil
+	return logger, nil, nil
 }
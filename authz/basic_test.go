@@ -3,8 +3,12 @@ package authz
 import (
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/AnubisLMS/authz/core"
+
 	"github.com/docker/docker/pkg/authorization"
 	"github.com/stretchr/testify/assert"
 )
@@ -69,3 +73,58 @@ func TestAuditRequestFile(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, string(log), "allow", "Log doesn't container authorization data")
 }
+
+func TestAuditReload(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "authz.log")
+	auditor := NewBasicAuditor(&BasicAuditorSettings{LogHook: AuditHookFile, LogPath: logPath})
+	assert.NoError(t, auditor.AuditRequest(&authorization.Request{User: "user_1"}, &authorization.Response{Allow: true}))
+
+	// The log file is reopened after being rotated
+	assert.NoError(t, os.Rename(logPath, logPath+".1"))
+	assert.NoError(t, auditor.(core.Reloader).Reload())
+	assert.NoError(t, auditor.AuditRequest(&authorization.Request{User: "user_2"}, &authorization.Response{Allow: true}))
+	log, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(log), "user_2")
+	assert.NotContains(t, string(log), "user_1")
+
+	assert.NoError(t, auditor.(core.Closer).Close())
+}
+
+func TestPolicyCombining(t *testing.T) {
+
+	policy := `[
+		{"name":"policy_deny","users":["user_1"],"actions":["container_export"],"effect":"deny"},
+		{"name":"policy_containers","users":["user_1","user_2"],"actions":["container"]},
+		{"name":"policy_version","users":["user_1"],"actions":["docker_version"]}
+		]`
+
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	tests := []struct {
+		combining      string
+		uri            string
+		user           string
+		allow          bool
+		expectedPolicy string // expectedPolicy is the expected policy name that should appear in the message
+	}{
+		{CombiningFirstMatch, "/v1.41/containers/id/export", "user_1", false, "policy_deny"},
+		{CombiningFirstMatch, "/v1.41/containers/id/json", "user_1", true, "policy_containers"},
+		{CombiningFirstMatch, "/v1.41/version", "user_1", false, "policy_containers"}, // Legacy flow: first policy of the user
+		{CombiningDenyOverrides, "/v1.41/containers/id/export", "user_1", false, "policy_deny"},
+		{CombiningDenyOverrides, "/v1.41/version", "user_1", true, "policy_version"},
+		{CombiningDenyOverrides, "/v1.41/version", "user_2", false, "no policy applied"},
+		{CombiningAllowOverrides, "/v1.41/containers/id/export", "user_1", true, "policy_containers"},
+	}
+
+	for _, test := range tests {
+		authorizer := NewBasicAuthZAuthorizer(&BasicAuthorizerSettings{PolicyPath: policyFileName, Combining: test.combining})
+		assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+		authorizer.(*basicAuthorizer).watcher.Close()
+
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodGet, RequestURI: test.uri, User: test.user})
+		assert.Equal(t, test.allow, res.Allow, "%s %s (%s): %s", test.combining, test.uri, test.user, res.Msg)
+		assert.Contains(t, res.Msg, test.expectedPolicy)
+	}
+}
@@ -0,0 +1,295 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// containerCreateBody is the body of container_create requests, as decoded by docker daemon
+type containerCreateBody struct {
+	*container.Config
+	HostConfig       *container.HostConfig     `json:"HostConfig,omitempty"`
+	NetworkingConfig *network.NetworkingConfig `json:"NetworkingConfig,omitempty"`
+}
+
+// bodyTypes are the types docker daemon decodes the request bodies into, by action
+var bodyTypes = map[string]reflect.Type{
+	core.ActionContainerCreate:     reflect.TypeOf(containerCreateBody{}),
+	core.ActionContainerUpdate:     reflect.TypeOf(container.UpdateConfig{}),
+	core.ActionContainerCommit:     reflect.TypeOf(container.Config{}),
+	core.ActionContainerExecCreate: reflect.TypeOf(types.ExecConfig{}),
+	core.ActionContainerExecStart:  reflect.TypeOf(types.ExecStartCheck{}),
+	core.ActionNetworkCreate:       reflect.TypeOf(types.NetworkCreateRequest{}),
+	core.ActionNetworkConnect:      reflect.TypeOf(types.NetworkConnect{}),
+	core.ActionNetworkDisconnect:   reflect.TypeOf(types.NetworkDisconnect{}),
+	core.ActionVolumeCreate:        reflect.TypeOf(volume.CreateOptions{}),
+	core.ActionServiceCreate:       reflect.TypeOf(swarm.ServiceSpec{}),
+	core.ActionServiceUpdate:       reflect.TypeOf(swarm.ServiceSpec{}),
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// decodeBody decodes the JSON body of a request, and canonicalizes its keys (see canonicalize). Docker daemon
+// matches the JSON keys case-insensitively and merges the keys decoded into the same field, hence bodies with
+// duplicate keys are refused as their effective value cannot be evaluated.
+func decodeBody(action string, data []byte, useNumber bool) (map[string]interface{}, error) {
+	if err := checkDuplicateKeys(data); err != nil {
+		return nil, err
+	}
+
+	var body map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if useNumber {
+		decoder.UseNumber()
+	}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	return canonicalize(action, body)
+}
+
+// canonicalize renames the keys of the body of the action to the docker field names they are decoded into,
+// e.g. hostconfig.privileged to HostConfig.Privileged. The keys of mappings (e.g. Labels) and unknown keys
+// are left unchanged. The keys of the bodies of actions with an unknown type are not renamed, but those
+// differing only by case are refused.
+func canonicalize(action string, body map[string]interface{}) (map[string]interface{}, error) {
+	if body == nil {
+		return nil, nil
+	}
+	v, err := canonicalValue(body, bodyTypes[action], "")
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// canonicalValue canonicalizes the keys of the value decoded into the type (nil if unknown)
+func canonicalValue(v interface{}, t reflect.Type, chain string) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return v, nil
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if t != nil && t.Kind() == reflect.Struct {
+			return canonicalStruct(v, t, chain)
+		}
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Map {
+			elem = t.Elem()
+		}
+		out := make(map[string]interface{}, len(v))
+		folded := make(map[string]string, len(v))
+		for k, e := range v {
+			if t == nil {
+				if other, ok := folded[strings.ToLower(k)]; ok {
+					return nil, fmt.Errorf("duplicate key '%s.%s' (as '%s')", chain, k, other)
+				}
+				folded[strings.ToLower(k)] = k
+			}
+			c, err := canonicalValue(e, elem, chain+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = c
+		}
+		return out, nil
+
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			c, err := canonicalValue(e, elem, chain)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// canonicalStruct renames the keys of a mapping to the names of the struct fields they are decoded into
+func canonicalStruct(v map[string]interface{}, t reflect.Type, chain string) (map[string]interface{}, error) {
+	fields := jsonFields(t)
+	out := make(map[string]interface{}, len(v))
+	for k, e := range v {
+		name, ft, ok := structField(fields, k)
+		if !ok {
+			name = k
+		}
+		if _, ok := out[name]; ok {
+			return nil, fmt.Errorf("duplicate key '%s.%s' (as '%s')", chain, k, name)
+		}
+		c, err := canonicalValue(e, ft, chain+"."+name)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = c
+	}
+	return out, nil
+}
+
+// structField returns the name and type of the struct field the key is decoded into, matched
+// case-insensitively if absent with the exact case
+func structField(fields map[string]reflect.Type, key string) (string, reflect.Type, bool) {
+	if f, ok := fields[key]; ok {
+		return key, f, true
+	}
+	for name, f := range fields {
+		if strings.EqualFold(name, key) {
+			return name, f, true
+		}
+	}
+	return "", nil, false
+}
+
+// canonicalKey returns the key of the canonical body holding the value of a key, given the type of the body
+// (nil if unknown): the name of the struct field the key is decoded into, the key itself for the keys of
+// mappings (e.g. Labels), or else the body key matching it case-insensitively (see lookupKey). It also returns
+// the type of the value (nil if unknown).
+func canonicalKey(body map[string]interface{}, key string, t reflect.Type) (string, reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil && !reflect.PtrTo(t).Implements(unmarshalerType) {
+		switch t.Kind() {
+		case reflect.Struct:
+			if name, ft, ok := structField(jsonFields(t), key); ok {
+				return name, ft
+			}
+		case reflect.Map:
+			return key, t.Elem()
+		}
+	}
+
+	if _, ok := body[key]; ok {
+		return key, nil
+	}
+	for k := range body {
+		if strings.EqualFold(k, key) {
+			return k, nil
+		}
+	}
+	return key, nil
+}
+
+// jsonFields returns the JSON names and types of the fields of a struct, including those of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for embeddedName, embeddedType := range jsonFields(ft) {
+					if _, ok := fields[embeddedName]; !ok {
+						fields[embeddedName] = embeddedType
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// checkDuplicateKeys returns an error if an object of the JSON document holds the same key several times
+func checkDuplicateKeys(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var walk func(chain string) error
+	walk = func(chain string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			keys := make(map[string]bool)
+			for decoder.More() {
+				token, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := token.(string)
+				if keys[key] {
+					return fmt.Errorf("duplicate key '%s.%s'", chain, key)
+				}
+				keys[key] = true
+				if err := walk(chain + "." + key); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+			return err
+		case json.Delim('['):
+			for decoder.More() {
+				if err := walk(chain); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+			return err
+		}
+		return nil
+	}
+	return walk("")
+}
+
+// lookupKey returns the value of the body key, matched case-insensitively like docker daemon does
+// if the key is absent with the exact case
+func lookupKey(body map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := body[key]; ok {
+		return v, true
+	}
+	for k, v := range body {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// sortedKeys returns the keys of the mapping in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,91 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeBody(t *testing.T) {
+
+	tests := []struct {
+		action   string
+		body     string
+		expected map[string]interface{} // expected is the canonical body
+		err      string                 // err is the expected error, if any
+	}{
+		{core.ActionContainerCreate, `{"image":"alpine","hostconfig":{"privileged":true,"BINDS":["/:/host"]}}`,
+			map[string]interface{}{"Image": "alpine", "HostConfig": map[string]interface{}{"Privileged": true, "Binds": []interface{}{"/:/host"}}}, ""},
+		{core.ActionContainerCreate, `{"labels":{"anubis.io/owner":"user_1","Anubis.io/Owner":"user_2"},"Unknown":1}`,
+			map[string]interface{}{"Labels": map[string]interface{}{"anubis.io/owner": "user_1", "Anubis.io/Owner": "user_2"}, "Unknown": float64(1)}, ""},
+		{core.ActionContainerCreate, `{"HostConfig":{"mounts":[{"type":"bind","source":"/"}]}}`,
+			map[string]interface{}{"HostConfig": map[string]interface{}{"Mounts": []interface{}{map[string]interface{}{"Type": "bind", "Source": "/"}}}}, ""},
+		{core.ActionContainerCreate, `{"HostConfig":{"Memory":1},"hostconfig":{"Memory":68719476736}}`, nil, "duplicate key"},
+		{core.ActionContainerCreate, `{"HostConfig":{"Privileged":true},"HostConfig":{"Memory":1}}`, nil, "duplicate key '.HostConfig'"},
+		{core.ActionContainerCreate, `{"HostConfig":{"Memory":1,"memory":2}}`, nil, "duplicate key"},
+		{core.ActionContainerUpdate, `{"memory":1}`, map[string]interface{}{"Memory": float64(1)}, ""},
+		{core.ActionSecretCreate, `{"Name":"secret","name":"other"}`, nil, "duplicate key"},
+		{core.ActionSecretCreate, `{"name":"secret"}`, map[string]interface{}{"name": "secret"}, ""},
+	}
+
+	for _, test := range tests {
+		body, err := decodeBody(test.action, []byte(test.body), false)
+		if test.err != "" {
+			assert.Error(t, err, test.body)
+			assert.Contains(t, err.Error(), test.err)
+			continue
+		}
+		assert.NoError(t, err, test.body)
+		assert.Equal(t, test.expected, body, test.body)
+	}
+}
+
+func TestAnubisBodyCase(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_create
+      effect: deny
+      body:
+        HostConfig:
+          Privileged: true
+    - name: container_create
+      body:
+        HostConfig:
+          CapAdd: null
+`
+
+	const policyFileName = "/tmp/anubis-policy-case.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		body        string
+		allow       bool
+		expectedMsg string
+	}{
+		{`{"Image":"alpine"}`, true, "allowed"},
+		{`{"hostconfig":{"privileged":true}}`, false, "deny rule of policy 'policy_1'"},
+		{`{"HOSTCONFIG":{"capadd":["SYS_ADMIN"]}}`, false, ".HostConfig.CapAdd"},
+		{`{"HostConfig":{},"hostconfig":{"CapAdd":["SYS_ADMIN"]}}`, false, "on invalid body"},
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "test", RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "Request must be allowed/denied regardless of the case of the keys: %s", test.body)
+		assert.Contains(t, res.Msg, test.expectedMsg)
+	}
+
+	// Keys are matched case-insensitively by the library functions too
+	check, _ := CheckBody(map[string]interface{}{"hostconfig": map[string]interface{}{"capadd": []interface{}{"SYS_ADMIN"}}}, map[string]interface{}{"HostConfig": map[string]interface{}{"CapAdd": nil}}, "")
+	assert.False(t, check)
+}
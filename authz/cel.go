@@ -0,0 +1,87 @@
+package authz
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+var (
+	celEnvOnce sync.Once
+	celEnvErr  error
+	celEnvInst *cel.Env
+)
+
+// celEnv returns the environment of the action conditions, declaring the request variables:
+//
+//	user   string                    - the user (TLS common name)
+//	action string                    - the docker action (mapped to authz terminology)
+//	method string                    - the HTTP method
+//	params map(string, string)       - the path parameters (e.g. container)
+//	query  map(string, list(string)) - the query parameters
+//	body   dyn                       - the decoded JSON body of POST requests (empty map otherwise)
+func celEnv() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		celEnvInst, celEnvErr = cel.NewEnv(
+			cel.Variable("user", cel.StringType),
+			cel.Variable("action", cel.StringType),
+			cel.Variable("method", cel.StringType),
+			cel.Variable("params", cel.MapType(cel.StringType, cel.StringType)),
+			cel.Variable("query", cel.MapType(cel.StringType, cel.ListType(cel.StringType))),
+			cel.Variable("body", cel.DynType),
+			// JSON numbers are doubles, compared to integer literals
+			cel.CrossTypeNumericComparisons(true),
+		)
+	})
+	return celEnvInst, celEnvErr
+}
+
+// compileCondition parses and type checks a condition, which must evaluate to a bool
+func compileCondition(expr string) (cel.Program, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid condition: %s", issues.Err().Error())
+	}
+	if out := ast.OutputType(); out.String() != cel.BoolType.String() && out.String() != cel.DynType.String() {
+		return nil, fmt.Errorf("invalid condition: evaluates to %s instead of bool", out)
+	}
+	return env.Program(ast)
+}
+
+// evalCondition evaluates the condition of the action against the request
+func (a *Action) evalCondition(req *policyRequest) (bool, error) {
+	params := req.route.Params
+	if params == nil {
+		params = map[string]string{}
+	}
+	query := map[string][]string(req.query)
+	if query == nil {
+		query = map[string][]string{}
+	}
+	var body interface{} = map[string]interface{}{}
+	if req.body != nil {
+		body = req.body
+	}
+
+	out, _, err := a.condition.Eval(map[string]interface{}{
+		"user":   req.User,
+		"action": req.action,
+		"method": req.RequestMethod,
+		"params": params,
+		"query":  query,
+		"body":   body,
+	})
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("condition evaluates to %v instead of bool", out.Value())
+	}
+	return result, nil
+}
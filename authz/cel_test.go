@@ -0,0 +1,61 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnubisConditions(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_create
+      effect: deny
+      if: has(body.Labels) && "admin" in body.Labels
+    - name: container_create
+      if: body.HostConfig.Memory <= 2147483648 && !body.HostConfig.Privileged
+    - name: container_logs
+      if: params.container.startsWith(user + "-") && !("follow" in query)
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName, Combining: CombiningDenyOverrides}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+
+	tests := []struct {
+		method string
+		uri    string
+		body   string
+		allow  bool
+		msg    string
+	}{
+		{http.MethodPost, "/v1.41/containers/create", `{"HostConfig":{"Memory":1073741824,"Privileged":false}}`, true, "policy_1"},
+		{http.MethodPost, "/v1.41/containers/create", `{"HostConfig":{"Memory":4294967296,"Privileged":false}}`, false, "on condition 'body.HostConfig.Memory <= 2147483648"},
+		{http.MethodPost, "/v1.41/containers/create", `{"HostConfig":{"Memory":1073741824,"Privileged":true}}`, false, "on condition"},
+		{http.MethodPost, "/v1.41/containers/create", `{"HostConfig":{"Memory":1073741824}}`, false, "no such key: Privileged"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Labels":{"admin":""},"HostConfig":{"Memory":1,"Privileged":false}}`, false, "by deny rule of policy 'policy_1'"},
+		{http.MethodPost, "/v1.41/containers/create", `{`, false, "on invalid body"},
+		{http.MethodGet, "/v1.41/containers/user_1-ide/logs", "", true, "policy_1"},
+		{http.MethodGet, "/v1.41/containers/user_2-ide/logs", "", false, "on condition"},
+		{http.MethodGet, "/v1.41/containers/user_1-ide/logs?follow=1", "", false, "on condition"},
+	}
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: "user_1", RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s: %s", test.uri, test.body, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// Syntax and type errors are reported when loading the policy
+	for _, condition := range []string{`body.Image ==`, `user + 1 == 2`, `user`, `unknown == 1`} {
+		_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_create","if":"` + condition + `"}]}]`))
+		assert.Error(t, err, condition)
+		assert.Contains(t, err.Error(), "invalid condition")
+	}
+}
@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+)
+
+// chainAuthorizer evaluates several authorizers in sequence, e.g. the anubis policies followed by the webhook
+type chainAuthorizer struct {
+	stages []core.Authorizer
+}
+
+// NewChainAuthorizer creates a new authorizer allowing requests only if all the stages allow them.
+// Stages are evaluated in order and the first denial is returned, so later stages are not queried for denied requests.
+func NewChainAuthorizer(stages ...core.Authorizer) core.Authorizer {
+	return &chainAuthorizer{stages: stages}
+}
+
+// Init initializes all the stages
+func (f *chainAuthorizer) Init() error {
+	for _, stage := range f.stages {
+		if err := stage.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthZReq returns the first denial of the stages, or the decision of the last stage
+func (f *chainAuthorizer) AuthZReq(authZReq *authorization.Request) *authorization.Response {
+	return f.evaluate(authZReq, core.Authorizer.AuthZReq)
+}
+
+// AuthZRes returns the first denial of the stages, or the decision of the last stage
+func (f *chainAuthorizer) AuthZRes(authZReq *authorization.Request) *authorization.Response {
+	return f.evaluate(authZReq, core.Authorizer.AuthZRes)
+}
+
+func (f *chainAuthorizer) evaluate(authZReq *authorization.Request, decide func(core.Authorizer, *authorization.Request) *authorization.Response) *authorization.Response {
+	res := &authorization.Response{Allow: true}
+	for _, stage := range f.stages {
+		res = decide(stage, authZReq)
+		if !res.Allow {
+			return res
+		}
+	}
+	return res
+}
+
+// Reload reloads the stages supporting runtime reloads, returning the first error
+func (f *chainAuthorizer) Reload() error {
+	var first error
+	for _, stage := range f.stages {
+		if reloader, ok := stage.(core.Reloader); ok {
+			if err := reloader.Reload(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Close closes the stages holding resources, returning the first error
+func (f *chainAuthorizer) Close() error {
+	var first error
+	for _, stage := range f.stages {
+		if closer, ok := stage.(core.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// PolicyStatus returns the status of the first stage loading policies
+func (f *chainAuthorizer) PolicyStatus() core.PolicyStatus {
+	for _, stage := range f.stages {
+		if reporter, ok := stage.(core.PolicyReporter); ok {
+			return reporter.PolicyStatus()
+		}
+	}
+	return core.PolicyStatus{}
+}
+
+// ActivePolicies returns the active policies of the first stage loading policies
+func (f *chainAuthorizer) ActivePolicies() interface{} {
+	for _, stage := range f.stages {
+		if provider, ok := stage.(core.PolicyProvider); ok {
+			return provider.ActivePolicies()
+		}
+	}
+	return nil
+}
+
+// Explain returns the explanation of the first stage explaining its decisions
+func (f *chainAuthorizer) Explain(authZReq *authorization.Request) interface{} {
+	for _, stage := range f.stages {
+		if explainer, ok := stage.(core.Explainer); ok {
+			return explainer.Explain(authZReq)
+		}
+	}
+	return nil
+}
+
+// MutateReq applies the request mutators of the stages in order, each one seeing the body rewritten by the previous ones
+func (f *chainAuthorizer) MutateReq(authZReq *authorization.Request) ([]byte, error) {
+	req := *authZReq
+	for _, stage := range f.stages {
+		if mutator, ok := stage.(core.Mutator); ok {
+			body, err := mutator.MutateReq(&req)
+			if err != nil {
+				return nil, err
+			}
+			req.RequestBody = body
+		}
+	}
+	return req.RequestBody, nil
+}
+
+// MutateRes applies the response mutators of the stages in order, each one seeing the body rewritten by the previous ones
+func (f *chainAuthorizer) MutateRes(authZReq *authorization.Request) ([]byte, error) {
+	req := *authZReq
+	for _, stage := range f.stages {
+		if mutator, ok := stage.(core.ResponseMutator); ok {
+			body, err := mutator.MutateRes(&req)
+			if err != nil {
+				return nil, err
+			}
+			req.ResponseBody = body
+		}
+	}
+	return req.ResponseBody, nil
+}
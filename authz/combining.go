@@ -0,0 +1,85 @@
+package authz
+
+import "fmt"
+
+// Effects of policy rules
+const (
+	EffectAllow = "allow" // EffectAllow allows the requests matching the rule (default)
+	EffectDeny  = "deny"  // EffectDeny denies the requests matching the rule
+)
+
+// Combining algorithms, deciding between the rules of several policies matching a request
+const (
+	CombiningFirstMatch     = "first-match"     // CombiningFirstMatch applies the first matching rule (default)
+	CombiningDenyOverrides  = "deny-overrides"  // CombiningDenyOverrides denies if any matching rule denies
+	CombiningAllowOverrides = "allow-overrides" // CombiningAllowOverrides allows if any matching rule allows
+)
+
+// validateEffect validates a rule effect
+func validateEffect(effect string) error {
+	switch effect {
+	case "", EffectAllow, EffectDeny:
+		return nil
+	}
+	return fmt.Errorf("invalid effect '%s' (expected %s or %s)", effect, EffectAllow, EffectDeny)
+}
+
+// ValidateCombining validates a combining algorithm
+func ValidateCombining(combining string) error {
+	switch combining {
+	case "", CombiningFirstMatch, CombiningDenyOverrides, CombiningAllowOverrides:
+		return nil
+	}
+	return fmt.Errorf("invalid combining algorithm '%s' (expected %s, %s or %s)", combining,
+		CombiningFirstMatch, CombiningDenyOverrides, CombiningAllowOverrides)
+}
+
+// decision is the outcome of a rule matching a request
+type decision struct {
+	allow  bool   // allow indicates the rule allows the request
+	msg    string // msg explains the outcome
+	policy string // policy is the name of the policy holding the rule
+}
+
+// combiner combines the decisions of the rules matching a request according to a combining algorithm
+type combiner struct {
+	combining string    // combining is the combining algorithm
+	allowed   *decision // allowed is the first allow decision
+	denied    *decision // denied is the first deny decision
+}
+
+// add records the decision of a matching rule, and returns true once the combined decision is final
+func (c *combiner) add(allow bool, msg, policy string) bool {
+	d := &decision{allow: allow, msg: msg, policy: policy}
+	if allow && c.allowed == nil {
+		c.allowed = d
+	}
+	if !allow && c.denied == nil {
+		c.denied = d
+	}
+
+	switch c.combining {
+	case CombiningDenyOverrides:
+		return !allow
+	case CombiningAllowOverrides:
+		return allow
+	default:
+		return true
+	}
+}
+
+// result returns the combined decision, or a deny with the given message if no rule matched
+func (c *combiner) result(noPolicyMsg string) decision {
+	switch {
+	case c.allowed != nil && c.denied != nil:
+		if c.combining == CombiningAllowOverrides {
+			return *c.allowed
+		}
+		return *c.denied
+	case c.allowed != nil:
+		return *c.allowed
+	case c.denied != nil:
+		return *c.denied
+	}
+	return decision{allow: false, msg: noPolicyMsg}
+}
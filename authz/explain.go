@@ -0,0 +1,211 @@
+package authz
+
+import (
+	"net/http"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+)
+
+// Outcomes of the actions traced by an explanation
+const (
+	TraceAllow   = "allow"   // TraceAllow indicates the action allowed the request
+	TraceDeny    = "deny"    // TraceDeny indicates the action denied the request
+	TraceSkipped = "skipped" // TraceSkipped indicates the deny action matched the request name but not its constraints
+)
+
+// Explanation is the trace of the evaluation of a request against the anubis policies: the parsed
+// action, each policy and action considered, the body keys compared and the final decision
+type Explanation struct {
+	Method    string            `yaml:"method"`              // Method is the request method
+	URI       string            `yaml:"uri"`                 // URI is the request URI
+	User      string            `yaml:"user"`                // User is the request user
+	Action    string            `yaml:"action"`              // Action is the docker action parsed from the request
+	Pattern   string            `yaml:"pattern,omitempty"`   // Pattern is the path template of the matched route
+	Params    map[string]string `yaml:"params,omitempty"`    // Params are the path parameters of the matched route
+	Combining string            `yaml:"combining,omitempty"` // Combining is the combining algorithm of the decisions
+	Policies  []PolicyTrace     `yaml:"policies,omitempty"`  // Policies are the policies considered, in order
+	Quota     string            `yaml:"quota,omitempty"`     // Quota is the reason the quota of the user denied the request
+	Allow     bool              `yaml:"allow"`               // Allow is the final decision
+	Msg       string            `yaml:"msg"`                 // Msg explains the final decision
+	Policy    string            `yaml:"policy,omitempty"`    // Policy is the name of the deciding policy
+}
+
+// PolicyTrace is the trace of a policy considered for a request
+type PolicyTrace struct {
+	Name    string        `yaml:"name"`              // Name is the policy name
+	Applies bool          `yaml:"applies"`           // Applies indicates the policy applies to the user
+	Active  bool          `yaml:"active"`            // Active indicates the policy is active at the time of the request
+	Actions []ActionTrace `yaml:"actions,omitempty"` // Actions are the actions of the policy tried, if the policy applies and is active
+}
+
+// ActionTrace is the trace of a policy action tried against a request
+type ActionTrace struct {
+	Name    string      `yaml:"name"`              // Name is the action name (regular expression)
+	Effect  string      `yaml:"effect"`            // Effect is the effect of the action
+	Matches bool        `yaml:"matches"`           // Matches indicates the action name matches the request action
+	Outcome string      `yaml:"outcome,omitempty"` // Outcome is the outcome of the action matching the request (allow, deny or skipped)
+	Msg     string      `yaml:"msg,omitempty"`     // Msg explains the outcome
+	Body    []BodyTrace `yaml:"body,omitempty"`    // Body are the body keys compared
+	Final   bool        `yaml:"final,omitempty"`   // Final indicates the outcome is the combined decision
+}
+
+// BodyTrace is the comparison of a request body key against the body of a policy action
+type BodyTrace struct {
+	Key      string      `yaml:"key"`              // Key is the path of the body key (e.g. .HostConfig.Privileged)
+	Expected interface{} `yaml:"expected"`         // Expected is the policy value
+	Actual   interface{} `yaml:"actual"`           // Actual is the request value
+	Present  bool        `yaml:"present"`          // Present indicates the key is present in the request
+	Match    bool        `yaml:"match"`            // Match indicates the request value satisfies the policy value
+	Reason   string      `yaml:"reason,omitempty"` // Reason explains a mismatch
+}
+
+// ExplainPolicy evaluates the request against the policies like CheckPolicy, and returns the trace of the evaluation.
+// Quotas, rate limits and ownership are not evaluated.
+func ExplainPolicy(authZReq *authorization.Request, policies []AnubisPolicy, combining string) *Explanation {
+	route, err := parseAction(authZReq)
+	if err != nil {
+		return newExplanation(authZReq, route, combining).deny(err.Error())
+	}
+	explanation := newExplanation(authZReq, route, combining)
+	return explanation.decide(checkPolicies(newPolicyRequest(authZReq, route), policies, combining, explanation))
+}
+
+// Explain evaluates the request like AuthZReq, and returns the trace of the evaluation. The evaluation is a dry-run:
+// the rate limits are not consumed, the quota usage is not reserved, and the decision is neither recorded in the
+// metrics nor audited.
+func (f *anubisAuthorizer) Explain(authZReq *authorization.Request) interface{} {
+	route, err := parseAction(authZReq)
+	if err != nil {
+		return newExplanation(authZReq, route, f.settings.Combining).deny(err.Error())
+	}
+
+	explanation := newExplanation(authZReq, route, f.settings.Combining)
+	req := newPolicyRequest(authZReq, route)
+	req.owners, req.now = f.owners, f.now()
+	result := checkPolicies(req, f.policies(), f.settings.Combining, explanation)
+	if result.allow {
+		if check, reason := f.checkQuota(req, true); !check {
+			explanation.Quota = reason
+			result.allow, result.msg = false, reason
+		}
+	}
+	return explanation.decide(result)
+}
+
+// newExplanation creates the explanation of the request
+func newExplanation(authZReq *authorization.Request, route core.Route, combining string) *Explanation {
+	if combining == "" {
+		combining = CombiningFirstMatch
+	}
+	return &Explanation{
+		Method:    authZReq.RequestMethod,
+		URI:       authZReq.RequestURI,
+		User:      authZReq.User,
+		Action:    route.Action,
+		Pattern:   route.Pattern,
+		Params:    route.Params,
+		Combining: combining,
+	}
+}
+
+// deny sets the final decision to a deny with the given message
+func (e *Explanation) deny(msg string) *Explanation {
+	e.Allow, e.Msg = false, msg
+	return e
+}
+
+// decide sets the final decision
+func (e *Explanation) decide(result decision) *Explanation {
+	e.Allow, e.Msg, e.Policy = result.allow, result.msg, result.policy
+	return e
+}
+
+// addPolicy records a policy considered for the request, it returns nil if the explanation is nil
+func (e *Explanation) addPolicy(policy *AnubisPolicy, req *policyRequest) *PolicyTrace {
+	if e == nil {
+		return nil
+	}
+	e.Policies = append(e.Policies, PolicyTrace{
+		Name:    policy.Name,
+		Applies: policy.appliesTo(req.User),
+		Active:  policy.activeAt(req.now),
+	})
+	return &e.Policies[len(e.Policies)-1]
+}
+
+// addAction records an action tried against the request, it returns nil if the policy trace is nil
+func (p *PolicyTrace) addAction(a *Action, action string, req *policyRequest) *ActionTrace {
+	if p == nil {
+		return nil
+	}
+	effect := a.Effect
+	if effect == "" {
+		effect = EffectAllow
+	}
+	trace := ActionTrace{Name: a.Name, Effect: effect, Matches: a.matches(action)}
+	if trace.Matches {
+		trace.Outcome = TraceSkipped
+		if a.Body != nil && req.RequestMethod == http.MethodPost && req.bodyErr == nil {
+			trace.Body = traceBody(req.body, a.Body, "", effect == EffectDeny)
+		}
+	}
+	p.Actions = append(p.Actions, trace)
+	return &p.Actions[len(p.Actions)-1]
+}
+
+// decide records the decision of an action matching the request
+func (a *ActionTrace) decide(allow bool, msg string, final bool) {
+	if a == nil {
+		return
+	}
+	a.Outcome, a.Msg, a.Final = TraceDeny, msg, final
+	if allow {
+		a.Outcome = TraceAllow
+	}
+}
+
+// traceBody compares the request body against the body of an action, key by key in sorted order.
+// The keys of allow actions are compared like CheckBody, while those of deny actions are compared like matchBody.
+func traceBody(authzBody map[string]interface{}, policyBody map[string]interface{}, chain string, deny bool) []BodyTrace {
+	var traces []BodyTrace
+	for _, k := range sortedKeys(policyBody) {
+		key, policyV := chain+"."+k, policyBody[k]
+		authzV, present := lookupKey(authzBody, k)
+
+		matcher, isMatcher, err := asMatcher(policyV)
+		if nested, ok := policyV.(map[string]interface{}); ok && !isMatcher {
+			authzMap, ok := authzV.(map[string]interface{})
+			if ok || (authzV == nil && !deny) {
+				traces = append(traces, traceBody(authzMap, nested, key, deny)...)
+				continue
+			}
+		}
+
+		trace := BodyTrace{Key: key, Expected: policyV, Actual: authzV, Present: present}
+		switch {
+		case err != nil:
+			trace.Reason = "invalid matcher"
+		case policyV == nil:
+			trace.Match = isEmpty(authzV)
+			if !trace.Match {
+				trace.Reason = "must be empty"
+			}
+		case deny && (!present || authzV == nil):
+			trace.Reason = "is absent"
+		case isMatcher:
+			trace.Match, trace.Reason = checkMatcher(matcher, authzV, present)
+		case !present:
+			trace.Match = true
+		default:
+			if _, ok := policyV.(map[string]interface{}); ok {
+				trace.Reason = "is not an object"
+			} else if trace.Match = valuesEqual(policyV, authzV); !trace.Match {
+				trace.Reason = "is not equal"
+			}
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
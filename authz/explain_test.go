@@ -0,0 +1,107 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExplain(t *testing.T) {
+
+	policy := `
+- name: admins
+  users: [admin]
+  actions:
+    - name: .*
+- name: no_privileged
+  actions:
+    - name: container_create
+      effect: deny
+      body:
+        HostConfig:
+          Privileged: true
+- name: students
+  actions:
+    - name: container_(start|create)
+      body:
+        Image: {required: true, regex: "registry\\.anubis-lms\\.io/.*"}
+        HostConfig:
+          CapAdd: null
+`
+
+	const policyFileName = "/tmp/anubis-policy-explain.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	explain := func(body string) *Explanation {
+		req := &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create?name=theia", User: "student", RequestBody: []byte(body)}
+		explanation := authorizer.(core.Explainer).Explain(req).(*Explanation)
+
+		// The explanation reaches the same decision as the authorizer
+		res := authorizer.AuthZReq(req)
+		assert.Equal(t, res.Allow, explanation.Allow)
+		assert.Equal(t, res.Msg, explanation.Msg)
+		return explanation
+	}
+
+	// Privileged containers are denied by the deny rule
+	explanation := explain(`{"Image":"registry.anubis-lms.io/anubis/theia","HostConfig":{"Privileged":true}}`)
+	assert.Equal(t, core.ActionContainerCreate, explanation.Action)
+	assert.Equal(t, "/containers/create", explanation.Pattern)
+	assert.Equal(t, CombiningFirstMatch, explanation.Combining)
+	assert.False(t, explanation.Allow)
+	assert.Equal(t, "no_privileged", explanation.Policy)
+	assert.Len(t, explanation.Policies, 2, "Evaluation stops at the first match")
+	assert.Equal(t, PolicyTrace{Name: "admins", Applies: false, Active: true}, explanation.Policies[0])
+	assert.Equal(t, ActionTrace{
+		Name: "container_create", Effect: EffectDeny, Matches: true, Outcome: TraceDeny, Final: true,
+		Msg:  "action 'container_create' denied for user 'student' by deny rule of policy 'no_privileged'",
+		Body: []BodyTrace{{Key: ".HostConfig.Privileged", Expected: true, Actual: true, Present: true, Match: true}},
+	}, explanation.Policies[1].Actions[0])
+
+	// Unprivileged containers skip the deny rule, and are checked against the body of the students policy
+	explanation = explain(`{"Image":"alpine","HostConfig":{"CapAdd":["SYS_ADMIN"]}}`)
+	assert.False(t, explanation.Allow)
+	assert.Equal(t, "students", explanation.Policy)
+	assert.Equal(t, TraceSkipped, explanation.Policies[1].Actions[0].Outcome)
+	assert.Equal(t, []BodyTrace{{Key: ".HostConfig.Privileged", Expected: true, Present: false, Reason: "is absent"}}, explanation.Policies[1].Actions[0].Body)
+	assert.Equal(t, []BodyTrace{
+		{Key: ".HostConfig.CapAdd", Expected: nil, Actual: []interface{}{"SYS_ADMIN"}, Present: true, Reason: "must be empty"},
+		{Key: ".Image", Expected: map[string]interface{}{"required": true, "regex": "registry\\.anubis-lms\\.io/.*"}, Actual: "alpine", Present: true, Reason: "alpine does not match registry\\.anubis-lms\\.io/.*"},
+	}, explanation.Policies[2].Actions[0].Body)
+
+	explanation = explain(`{"Image":"registry.anubis-lms.io/anubis/theia"}`)
+	assert.True(t, explanation.Allow)
+	assert.Equal(t, "students", explanation.Policy)
+	assert.True(t, explanation.Policies[2].Actions[0].Final)
+
+	// The explanation serializes to YAML
+	data, err := yaml.Marshal(explanation)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "key: .Image")
+
+	// Invalid requests are denied before evaluating the policies
+	explanation = authorizer.(core.Explainer).Explain(&authorization.Request{RequestMethod: http.MethodGet, RequestURI: "%zz", User: "student"}).(*Explanation)
+	assert.False(t, explanation.Allow)
+	assert.Contains(t, explanation.Msg, "invalid request URI")
+	assert.Empty(t, explanation.Policies)
+
+	// The library function and the chain explain the same decisions
+	req := &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/containers/create", User: "admin", RequestBody: []byte(`{"Image":"registry.anubis-lms.io/anubis/theia"}`)}
+	explanation = ExplainPolicy(req, authorizer.(*anubisAuthorizer).policies(), CombiningDenyOverrides)
+	assert.True(t, explanation.Allow)
+	assert.Equal(t, "admins", explanation.Policy)
+	assert.Len(t, explanation.Policies, 3, "Deny overrides evaluates every policy allowing the request")
+
+	chain := NewChainAuthorizer(NewBasicAuthZAuthorizer(&BasicAuthorizerSettings{}), authorizer)
+	assert.Equal(t, "admins", chain.(core.Explainer).Explain(req).(*Explanation).Policy)
+}
@@ -0,0 +1,220 @@
+package authz
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRegistry is the registry of the image references without registry (Docker Hub)
+const DefaultRegistry = "docker.io"
+
+// ImagePolicy restricts the images referred to by image_create (fromImage and tag query parameters),
+// image_build (t query parameters) and container_create (Image body field) requests.
+//
+//	images:
+//	  registries: [docker.io, ghcr.io]
+//	  repositories: ["library/*", "anubislms/*"]
+//	  deny: ["library/docker"]
+//	  requireDigest: false
+//	  denyLatest: true
+//	  allowIds: false
+//
+// Repositories are glob patterns (see path.Match) matched against the repository path of the
+// reference, without the registry. Official Docker Hub images belong to the library namespace.
+// References without tag nor digest refer to the latest tag. The digest requirement does not
+// apply to the tags of the built images, and builds must be tagged.
+//
+// Image IDs (sha256:<hex> or a bare hexadecimal prefix) do not name a repository, and are denied
+// unless allowed explicitly. Repositories named by hexadecimal characters only must then be referred
+// to with a tag or a registry.
+type ImagePolicy struct {
+	Registries    []string `yaml:"registries,omitempty"`    // Registries are the allowed registries (all registries are allowed if empty)
+	Repositories  []string `yaml:"repositories,omitempty"`  // Repositories are glob patterns of the allowed repositories (all repositories are allowed if empty)
+	Deny          []string `yaml:"deny,omitempty"`          // Deny are glob patterns of the denied repositories
+	RequireDigest bool     `yaml:"requireDigest,omitempty"` // RequireDigest indicates the images must be referred to by digest
+	DenyLatest    bool     `yaml:"denyLatest,omitempty"`    // DenyLatest indicates the latest tag (explicit or implicit) is denied
+	AllowIDs      bool     `yaml:"allowIds,omitempty"`      // AllowIDs indicates the images may be referred to by ID
+}
+
+// imageReference is a parsed image reference (registry/repository:tag@digest)
+type imageReference struct {
+	Registry   string // Registry is the registry host (DefaultRegistry if not specified)
+	Repository string // Repository is the repository path
+	Tag        string // Tag is the image tag (empty if not specified)
+	Digest     string // Digest is the image digest (empty if not specified)
+}
+
+var (
+	// repositoryRe matches the path components of a repository
+	repositoryRe = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	// tagRe matches a tag
+	tagRe = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	// digestRe matches a digest
+	digestRe = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	// imageIDRe matches an image ID, or a prefix of an image ID, as resolved by docker daemon
+	imageIDRe = regexp.MustCompile(`^(?:sha256:)?[a-fA-F0-9]+$`)
+)
+
+// parseImageReference parses an image reference, following the docker normalization rules
+func parseImageReference(ref string) (imageReference, error) {
+	var image imageReference
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, image.Digest = name[:i], name[i+1:]
+		if !digestRe.MatchString(image.Digest) {
+			return image, fmt.Errorf("invalid digest in image reference %s", ref)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		name, image.Tag = name[:i], name[i+1:]
+		if !tagRe.MatchString(image.Tag) {
+			return image, fmt.Errorf("invalid tag in image reference %s", ref)
+		}
+	}
+
+	// The first component is a registry if it looks like a host name
+	image.Registry = DefaultRegistry
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			image.Registry, name = host, name[i+1:]
+		}
+	}
+	if image.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryRe.MatchString(name) {
+		return image, fmt.Errorf("invalid image reference %s", ref)
+	}
+	image.Repository = name
+	return image, nil
+}
+
+// String returns the normalized image reference
+func (i imageReference) String() string {
+	s := i.Registry + "/" + i.Repository
+	if i.Tag != "" {
+		s += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		s += "@" + i.Digest
+	}
+	return s
+}
+
+// validate verifies the image policy is well formed
+func (p *ImagePolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Repositories...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern '%s': %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckImages checks the images referred to by the request against the image policy. The body keys are
+// matched case-insensitively like docker daemon does.
+func CheckImages(action string, query url.Values, body map[string]interface{}, policy *ImagePolicy) (bool, string) {
+	body, err := canonicalize(action, body)
+	if err != nil {
+		logrus.Errorf("Failing on invalid body %q", err.Error())
+		return false, err.Error()
+	}
+	return checkImages(action, query, body, policy)
+}
+
+// checkImages checks the images referred to by the request, with a canonical body, against the image policy
+func checkImages(action string, query url.Values, body map[string]interface{}, policy *ImagePolicy) (bool, string) {
+	var refs []string
+	build := false
+	switch action {
+	case core.ActionImageCreate:
+		ref, tag := query.Get("fromImage"), query.Get("tag")
+		if ref == "" {
+			// Images imported from a source are named by the repo parameter
+			ref = query.Get("repo")
+		}
+		if ref == "" {
+			return false, "missing image reference"
+		}
+		if tag != "" {
+			if strings.Contains(tag, ":") {
+				ref += "@" + tag
+			} else {
+				ref += ":" + tag
+			}
+		}
+		refs = append(refs, ref)
+
+	case core.ActionImageBuild:
+		refs, build = query["t"], true
+		if len(refs) == 0 {
+			// Untagged images are only referred to by ID
+			return false, "missing image tag"
+		}
+
+	case core.ActionContainerCreate:
+		ref, _ := body["Image"].(string)
+		if ref == "" {
+			return false, "missing image reference"
+		}
+		refs = append(refs, ref)
+	}
+
+	for _, ref := range refs {
+		if !build && imageIDRe.MatchString(ref) {
+			if !policy.AllowIDs {
+				logrus.Errorf("Failing on image ID %q", ref)
+				return false, fmt.Sprintf("%s image ID denied", ref)
+			}
+			continue
+		}
+		image, err := parseImageReference(ref)
+		if err != nil {
+			logrus.Errorf("Failing on invalid image %q", err.Error())
+			return false, err.Error()
+		}
+		if check, msg := policy.checkImage(image, build); !check {
+			logrus.Errorf("Failing on image not matching %s", msg)
+			return false, fmt.Sprintf("%s %s", ref, msg)
+		}
+	}
+	return true, ""
+}
+
+// checkImage checks a single image reference against the image policy
+func (p *ImagePolicy) checkImage(image imageReference, build bool) (bool, string) {
+	if len(p.Registries) > 0 && !containsString(p.Registries, image.Registry) {
+		return false, fmt.Sprintf("registry %s not allowed (allowed registries %v)", image.Registry, p.Registries)
+	}
+	if len(p.Repositories) > 0 && !matchAnyGlob(p.Repositories, image.Repository) {
+		return false, fmt.Sprintf("repository %s not allowed", image.Repository)
+	}
+	if matchAnyGlob(p.Deny, image.Repository) {
+		return false, fmt.Sprintf("repository %s denied", image.Repository)
+	}
+	if p.RequireDigest && !build && image.Digest == "" {
+		return false, "must be referred to by digest"
+	}
+	if p.DenyLatest && image.Digest == "" && (image.Tag == "" || image.Tag == "latest") {
+		return false, "latest tag denied"
+	}
+	return true, ""
+}
+
+// matchAnyGlob returns true if the value matches any of the glob patterns
+func matchAnyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, value); match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageReference(t *testing.T) {
+
+	const digest = "sha256:4b1f2a8d5fbe4f8c3b1a7e1f0f7c1d2e3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d"
+	tests := []struct {
+		ref      string
+		expected imageReference
+	}{
+		{"alpine", imageReference{Registry: "docker.io", Repository: "library/alpine"}},
+		{"alpine:3.18", imageReference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+		{"anubislms/theia:latest", imageReference{Registry: "docker.io", Repository: "anubislms/theia", Tag: "latest"}},
+		{"ghcr.io/anubislms/theia@" + digest, imageReference{Registry: "ghcr.io", Repository: "anubislms/theia", Digest: digest}},
+		{"localhost:5000/app:v1@" + digest, imageReference{Registry: "localhost:5000", Repository: "app", Tag: "v1", Digest: digest}},
+		{"localhost/app", imageReference{Registry: "localhost", Repository: "app"}},
+	}
+	for _, test := range tests {
+		image, err := parseImageReference(test.ref)
+		assert.NoError(t, err, test.ref)
+		assert.Equal(t, test.expected, image, test.ref)
+	}
+
+	for _, ref := range []string{"", "Alpine", "alpine:", "alpine@sha256:short", "alpine:tag!", "docker.io/"} {
+		_, err := parseImageReference(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestAnubisImages(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: image_create
+      images:
+        registries: [docker.io, ghcr.io]
+        repositories: ["library/*", "anubislms/*"]
+        deny: ["library/docker"]
+        requireDigest: true
+    - name: (image_build|container_create)
+      images:
+        repositories: ["library/*", "anubislms/*"]
+        denyLatest: true
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	const digest = "sha256:4b1f2a8d5fbe4f8c3b1a7e1f0f7c1d2e3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d"
+	tests := []struct {
+		method string
+		uri    string
+		body   string
+		allow  bool
+		msg    string
+	}{
+		{http.MethodPost, "/v1.41/images/create?fromImage=alpine&tag=" + digest, "", true, "policy_1"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=ghcr.io/anubislms/theia@" + digest, "", true, "policy_1"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=alpine&tag=3.18", "", false, "on image 'alpine:3.18 must be referred to by digest'"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=quay.io/evil/app&tag=" + digest, "", false, "registry quay.io not allowed"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=evil/app&tag=" + digest, "", false, "repository evil/app not allowed"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=docker&tag=" + digest, "", false, "repository library/docker denied"},
+		{http.MethodPost, "/v1.41/images/create?fromSrc=-", "", false, "missing image reference"},
+		{http.MethodPost, "/v1.41/build?t=anubislms/ide:v1&t=anubislms/ide:v2", "", true, "policy_1"},
+		{http.MethodPost, "/v1.41/build?t=anubislms/ide:v1&t=anubislms/ide", "", false, "anubislms/ide latest tag denied"},
+		{http.MethodPost, "/v1.41/build", "", false, "missing image tag"}, // Untagged build
+		{http.MethodPost, "/v1.41/build?t=cafe", "", false, "cafe latest tag denied"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"python:3.11"}`, true, "policy_1"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"python:latest"}`, false, "latest tag denied"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"python@` + digest + `"}`, true, "policy_1"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"evil/miner:1"}`, false, "repository evil/miner not allowed"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"Evil"}`, false, "invalid image reference Evil"},
+		{http.MethodPost, "/v1.41/containers/create", `{}`, false, "missing image reference"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"` + digest + `"}`, false, digest + " image ID denied"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"3f2a9c1b"}`, false, "3f2a9c1b image ID denied"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"3f2a9c1b:1"}`, true, "policy_1"},
+		{http.MethodPost, "/v1.41/images/create?fromImage=sha256:3f2a9c1b", "", false, "sha256:3f2a9c1b image ID denied"},
+		{http.MethodPost, "/v1.41/containers/create", `{"image":"evil/img"}`, false, "repository evil/img not allowed"},
+		{http.MethodPost, "/v1.41/containers/create", `{"Image":"python:3.11","image":"evil/img"}`, false, "on invalid body"},
+	}
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: "test", RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s: %s", test.uri, test.body, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// Keys are matched case-insensitively by the library functions too
+	check, _ := CheckImages(core.ActionContainerCreate, nil, map[string]interface{}{"image": "evil/img"}, &ImagePolicy{Repositories: []string{"library/*"}})
+	assert.False(t, check)
+
+	// Image IDs are allowed explicitly
+	idPolicy := &ImagePolicy{Repositories: []string{"library/*"}, AllowIDs: true}
+	for _, id := range []string{digest, "3f2a9c1b"} {
+		check, msg := CheckImages(core.ActionContainerCreate, nil, map[string]interface{}{"Image": id}, idPolicy)
+		assert.True(t, check, msg)
+	}
+
+	// Invalid repository patterns are refused
+	_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"image_create","images":{"repositories":["[a-"]}}]}]`))
+	assert.Error(t, err)
+}
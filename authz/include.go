@@ -0,0 +1,250 @@
+package authz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// policyBuilder merges anubis policy files into a single list of policies. Files are merged in a
+// deterministic order: the files of a folder are loaded by name, and the files included by a file
+// are loaded (in order) before the file itself. Each file is loaded once.
+//
+// Groups defined by several files are merged, while fragments must be defined once.
+type policyBuilder struct {
+	groups    map[string][]string               // groups are the merged groups of users
+	fragments map[string]map[string]interface{} // fragments are the named body fragments
+	defined   map[string]string                 // defined maps a fragment name to the file defining it
+	policies  []AnubisPolicy                    // policies are the merged policies
+	origins   []policyOrigin                    // origins are the locations of the merged policies
+	files     []string                          // files are the loaded files, in order
+	loaded    map[string]bool                   // loaded are the loaded files
+	including []string                          // including are the files being loaded, used to detect include cycles
+	sources   *policySources                    // sources records the content of the loaded files, if not nil
+}
+
+// policyOrigin locates a policy, used to report validation errors
+type policyOrigin struct {
+	file string // file is the policy file (empty if unknown)
+	line int    // line is the line of the policy in the file (0 if unknown)
+}
+
+// wrap prefixes the error with the policy location
+func (o policyOrigin) wrap(err error) error {
+	if o.line > 0 {
+		err = fmt.Errorf("line %d: %s", o.line, err.Error())
+	}
+	if o.file != "" {
+		err = fmt.Errorf("%s: %s", o.file, err.Error())
+	}
+	return err
+}
+
+// newPolicyBuilder creates a new policy builder
+func newPolicyBuilder() *policyBuilder {
+	return &policyBuilder{
+		groups:    make(map[string][]string),
+		fragments: make(map[string]map[string]interface{}),
+		defined:   make(map[string]string),
+		loaded:    make(map[string]bool),
+	}
+}
+
+// addPath loads a policy file, or the policy files (*.yaml, *.yml) of a folder
+func (b *policyBuilder) addPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return b.addFile(path)
+	}
+
+	files, err := policyFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := b.addFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyFiles returns the policy files of the folder sorted by name. Hidden files are skipped,
+// which includes the revisions of a mounted ConfigMap.
+func policyFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !isPolicyFile(entry.Name()) {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		// Follow symbolic links (e.g. ConfigMap keys)
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// isPolicyFile returns true if the file name has a yaml extension
+func isPolicyFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// addFile loads a policy file
+func (b *policyBuilder) addFile(file string) error {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	for _, including := range b.including {
+		if including == file {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(b.including, " -> "), file)
+		}
+	}
+	if b.loaded[file] {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	b.loaded[file] = true
+	b.files = append(b.files, file)
+	if b.sources != nil {
+		b.sources.add(file, data)
+	}
+	b.including = append(b.including, file)
+	defer func() { b.including = b.including[:len(b.including)-1] }()
+	return b.addDocument(file, data)
+}
+
+// addDocument loads the content of a policy file. Includes are resolved relatively to the file folder.
+func (b *policyBuilder) addDocument(file string, data []byte) error {
+	doc, err := decodeAnubisDocument(data)
+	if err != nil {
+		return policyOrigin{file: file}.wrap(err)
+	}
+
+	for _, include := range doc.Include {
+		matches, err := b.resolveInclude(file, include)
+		if err != nil {
+			return policyOrigin{file: file}.wrap(err)
+		}
+		for _, match := range matches {
+			if err := b.addPath(match); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, users := range doc.Groups {
+		b.groups[name] = append(b.groups[name], users...)
+	}
+	for name, fragment := range doc.Fragments {
+		if other, ok := b.defined[name]; ok {
+			return policyOrigin{file: file}.wrap(fmt.Errorf("fragment '%s' already defined in '%s'", name, other))
+		}
+		b.fragments[name] = fragment
+		b.defined[name] = file
+	}
+
+	lines := sequenceLines(data, "policies")
+	for i, policy := range doc.Policies {
+		origin := policyOrigin{file: file}
+		if i < len(lines) {
+			origin.line = lines[i]
+		}
+		b.policies = append(b.policies, policy)
+		b.origins = append(b.origins, origin)
+	}
+	return nil
+}
+
+// resolveInclude returns the paths matching the include (a path or a glob pattern)
+func (b *policyBuilder) resolveInclude(file, include string) ([]string, error) {
+	pattern := include
+	if !filepath.IsAbs(pattern) && file != "" {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include '%s': %s", include, err.Error())
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("include '%s' matches no file", include)
+	}
+	return matches, nil
+}
+
+// build expands the fragments used by the merged policies, resolves their groups and compiles their actions
+func (b *policyBuilder) build() ([]AnubisPolicy, error) {
+	for i := range b.policies {
+		policy := &b.policies[i]
+		if err := b.expand(policy); err != nil {
+			return nil, b.origins[i].wrap(err)
+		}
+		if err := policy.compile(b.groups); err != nil {
+			return nil, b.origins[i].wrap(err)
+		}
+	}
+	return b.policies, nil
+}
+
+// expand merges the fragments used by the policy actions into the action bodies.
+// Fragments are merged in order, and the action body takes precedence over the fragments. The fragment
+// names are cleared once merged, such that the compiled policies are self-contained.
+func (b *policyBuilder) expand(policy *AnubisPolicy) error {
+	for i := range policy.Actions {
+		action := &policy.Actions[i]
+		if len(action.Use) == 0 {
+			continue
+		}
+
+		body := map[string]interface{}{}
+		for _, name := range action.Use {
+			fragment, ok := b.fragments[name]
+			if !ok {
+				return fmt.Errorf("policy '%s' action '%s': unknown fragment '%s'", policy.Name, action.Name, name)
+			}
+			body = mergeBody(body, fragment)
+		}
+		action.Body = mergeBody(body, action.Body)
+		action.Use = nil
+	}
+	return nil
+}
+
+// mergeBody deep merges the src body into a copy of the dst body, src values taking precedence
+func mergeBody(dst, src map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(dst)+len(src))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		srcMap, srcOk := v.(map[string]interface{})
+		dstMap, dstOk := merged[k].(map[string]interface{})
+		if srcOk && dstOk {
+			merged[k] = mergeBody(dstMap, srcMap)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
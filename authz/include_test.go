@@ -0,0 +1,192 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// writePolicies writes the policy files (name to content) into the folder
+func writePolicies(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+func TestPolicyFolder(t *testing.T) {
+
+	dir := t.TempDir()
+	writePolicies(t, dir, map[string]string{
+		"10-groups.yaml": `
+groups:
+  staff: ["admin"]
+policies:
+  - name: staff
+    groups: ["staff"]
+    actions:
+      - name: .*
+`,
+		"20-course.yml": `
+groups:
+  staff: ["ta"]
+policies:
+  - name: students
+    users: ["student"]
+    actions:
+      - name: docker_version
+`,
+		".hidden.yaml": "- name: hidden\n  actions:\n    - name: .*\n",
+		"README.md":    "not a policy",
+	})
+
+	set, err := parseAnubisPolicySet(dir, newPolicySources())
+	assert.NoError(t, err)
+	assert.Len(t, set.policies, 2)
+	assert.Equal(t, "staff", set.policies[0].Name, "Files must be merged by name")
+	assert.Equal(t, "students", set.policies[1].Name)
+	assert.True(t, set.policies[0].appliesTo("ta"), "Groups must be merged across files")
+	assert.True(t, set.policies[0].appliesTo("admin"))
+	assert.Len(t, set.files, 2)
+
+	// Errors report the file
+	writePolicies(t, dir, map[string]string{"30-invalid.yaml": "- name: invalid\n  actions:\n    - name: \"(\"\n"})
+	_, err = parseAnubisPolicySet(dir, newPolicySources())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "30-invalid.yaml: line 1")
+}
+
+func TestPolicyInclude(t *testing.T) {
+
+	dir := t.TempDir()
+	writePolicies(t, dir, map[string]string{
+		"policy.yaml": `
+include: ["shared/baseline.yaml", "courses/*.yaml"]
+policies:
+  - name: fallback
+    actions:
+      - name: docker_version
+`,
+		"shared/baseline.yaml": "- name: baseline\n  actions:\n    - name: docker_info\n",
+		"courses/b.yaml":       "include: [\"../shared/baseline.yaml\"]\npolicies:\n  - name: course_b\n    actions:\n      - name: image_list\n",
+		"courses/a.yaml":       "- name: course_a\n  actions:\n    - name: image_list\n",
+	})
+
+	set, err := parseAnubisPolicySet(filepath.Join(dir, "policy.yaml"), newPolicySources())
+	assert.NoError(t, err)
+	var names []string
+	for _, policy := range set.policies {
+		names = append(names, policy.Name)
+	}
+	assert.Equal(t, []string{"baseline", "course_a", "course_b", "fallback"}, names, "Includes must be merged first, once, in order")
+	assert.Len(t, set.files, 4)
+
+	// Include cycles are refused
+	writePolicies(t, dir, map[string]string{"shared/baseline.yaml": "include: [\"../policy.yaml\"]\n"})
+	_, err = parseAnubisPolicySet(filepath.Join(dir, "policy.yaml"), newPolicySources())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "include cycle")
+
+	// Missing includes are refused
+	writePolicies(t, dir, map[string]string{"shared/baseline.yaml": "include: [\"missing.yaml\"]\n"})
+	_, err = parseAnubisPolicySet(filepath.Join(dir, "policy.yaml"), newPolicySources())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "include 'missing.yaml' matches no file")
+}
+
+func TestPolicyFragments(t *testing.T) {
+
+	dir := t.TempDir()
+	writePolicies(t, dir, map[string]string{
+		"00-baseline.yaml": `
+fragments:
+  hardened:
+    HostConfig:
+      Privileged: null
+      Memory: {max: 2Gi}
+  labeled:
+    Labels: {required: true}
+policies: []
+`,
+		"10-course.yaml": `
+policies:
+  - name: course
+    actions:
+      - name: container_create
+        use: ["hardened", "labeled"]
+        body:
+          HostConfig:
+            Memory: {max: 1Gi}
+`,
+	})
+
+	set, err := parseAnubisPolicySet(dir, newPolicySources())
+	assert.NoError(t, err)
+	body := set.policies[0].Actions[0].Body
+	assert.Contains(t, body, "Labels")
+	hostConfig := body["HostConfig"].(map[string]interface{})
+	assert.Contains(t, hostConfig, "Privileged", "Fragments must be deep merged")
+	assert.Equal(t, map[string]interface{}{"max": "1Gi"}, hostConfig["Memory"], "Action body must take precedence")
+	assert.Nil(t, set.policies[0].Actions[0].Use, "Fragment names must be cleared once merged")
+
+	// The compiled policies can be loaded back without the fragments
+	dump, err := yaml.Marshal(set.policies)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(dump), "use:")
+	reparsed, err := parseAnubisPolicies(dump)
+	assert.NoError(t, err)
+	assert.Equal(t, body, reparsed[0].Actions[0].Body)
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: dir}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+	req := &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "test",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"}}
+	req.RequestBody = []byte(`{"Labels":{"course":"os"},"HostConfig":{"Memory":1073741824}}`)
+	assert.True(t, authorizer.AuthZReq(req).Allow)
+	req.RequestBody = []byte(`{"Labels":{"course":"os"},"HostConfig":{"Privileged":true}}`)
+	assert.False(t, authorizer.AuthZReq(req).Allow)
+	req.RequestBody = []byte(`{"HostConfig":{}}`)
+	assert.False(t, authorizer.AuthZReq(req).Allow)
+
+	// Unknown and duplicate fragments are refused
+	writePolicies(t, dir, map[string]string{"10-course.yaml": "- name: course\n  actions:\n    - name: container_create\n      use: [\"missing\"]\n"})
+	_, err = parseAnubisPolicySet(dir, newPolicySources())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown fragment 'missing'")
+
+	writePolicies(t, dir, map[string]string{"10-course.yaml": "fragments:\n  hardened: {}\npolicies: []\n"})
+	_, err = parseAnubisPolicySet(dir, newPolicySources())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fragment 'hardened' already defined")
+}
+
+func TestWatchPolicyFolder(t *testing.T) {
+
+	dir := t.TempDir()
+	writePolicies(t, dir, map[string]string{
+		"policy.yaml":         "include: [\"../shared/info.yaml\"]\npolicies:\n  - name: version\n    actions:\n      - name: docker_version\n",
+		"../shared/info.yaml": "[]\n",
+	})
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: dir}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	defer authorizer.watcher.Close()
+
+	info := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/info", User: "test"}
+	images := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/images/json", User: "test"}
+	assert.False(t, authorizer.AuthZReq(info).Allow)
+
+	// Included files outside of the folder are watched
+	writePolicies(t, dir, map[string]string{"../shared/info.yaml": "- name: info\n  actions:\n    - name: docker_info\n"})
+	allowsEventually(t, authorizer, info, true, "Changed include must be reloaded")
+
+	// Files added to the folder are loaded
+	writePolicies(t, dir, map[string]string{"images.yaml": "- name: images\n  actions:\n    - name: image_list\n"})
+	allowsEventually(t, authorizer, images, true, "Added file must be loaded")
+}
@@ -0,0 +1,182 @@
+package authz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// policySet is an immutable, validated set of policies
+type policySet interface {
+	size() int // size returns the number of policies in the set
+}
+
+// policySources records the files parsed into a policy set, and hashes their content as parsed.
+// Hashing the parsed content (rather than reading the files again) guarantees the hash identifies
+// the active policies, even if the files change while being loaded.
+type policySources struct {
+	files []string  // files are the parsed files, in order
+	hash  hash.Hash // hash is the sha256 of the paths and content of the parsed files
+}
+
+// newPolicySources creates a new recorder of policy sources
+func newPolicySources() *policySources {
+	return &policySources{hash: sha256.New()}
+}
+
+// add records the content of a parsed file
+func (s *policySources) add(file string, data []byte) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	s.files = append(s.files, file)
+	fmt.Fprintf(s.hash, "%s\x00%d\x00", file, len(data))
+	s.hash.Write(data)
+}
+
+// digest returns the sha256 of the parsed files
+func (s *policySources) digest() string {
+	return "sha256:" + hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// policyLoader loads policy paths into policy sets. A new set is only swapped in (atomically) if the
+// policy is valid, otherwise the last known good set is kept, such that requests are never evaluated
+// against a partially loaded or empty set of policies.
+type policyLoader[T policySet] struct {
+	path  string                                               // path is the policy path
+	parse func(path string, sources *policySources) (T, error) // parse reads, parses and validates the policy path, recording the files read
+
+	current atomic.Value      // current holds the active policy set
+	mu      sync.Mutex        // mu serializes loads and protects the status
+	status  core.PolicyStatus // status is the load status
+}
+
+// newPolicyLoader creates a new policy loader
+func newPolicyLoader[T policySet](path string, parse func(path string, sources *policySources) (T, error)) *policyLoader[T] {
+	return &policyLoader[T]{path: path, parse: parse}
+}
+
+// get returns the active policy set
+func (l *policyLoader[T]) get() T {
+	set, _ := l.current.Load().(T)
+	return set
+}
+
+// load loads the policy path, and swaps the active policy set if the policy is valid
+func (l *policyLoader[T]) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sources := newPolicySources()
+	set, err := l.read(sources)
+	if err != nil {
+		core.RecordPolicyLoad(0, err)
+		l.status.Failures++
+		l.status.LastError = err.Error()
+		logrus.Errorf("Refusing policy %q, keeping %d active policies (failures: %d): %s", l.path, l.status.Policies, l.status.Failures, err.Error())
+		return err
+	}
+
+	l.current.Store(set)
+	l.status.Reloads++
+	l.status.Policies = set.size()
+	l.status.LastError = ""
+	l.status.LastLoad = time.Now()
+	l.status.Sources, l.status.Hash = sources.files, sources.digest()
+	core.RecordPolicyLoad(set.size(), nil)
+	logrus.Infof("Loaded '%d' policies from %q (reloads: %d)", set.size(), l.path, l.status.Reloads)
+	return nil
+}
+
+// read reads and parses the policy path
+func (l *policyLoader[T]) read(sources *policySources) (T, error) {
+	set, err := l.parse(l.path, sources)
+	if err != nil {
+		return set, err
+	}
+	if set.size() == 0 {
+		return set, fmt.Errorf("policy file defines no policies")
+	}
+	return set, nil
+}
+
+// parseFile adapts a parser of policy file content into a parser of policy file paths
+func parseFile[T policySet](parse func(data []byte) (T, error)) func(path string, sources *policySources) (T, error) {
+	return func(path string, sources *policySources) (T, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			var set T
+			return set, err
+		}
+		sources.add(path, data)
+		return parse(data)
+	}
+}
+
+// PolicyStatus returns the status of the policy loads
+func (l *policyLoader[T]) PolicyStatus() core.PolicyStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// decodeStrict decodes the yaml data into out, rejecting unknown fields. Errors report line numbers.
+func decodeStrict(data []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// sequenceLines returns the line of each item of the yaml sequence found at the given mapping key
+// of the document (or of the document itself if it is a sequence), used to report validation errors
+func sequenceLines(data []byte, key string) []int {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil || len(node.Content) == 0 {
+		return nil
+	}
+
+	seq := node.Content[0]
+	if seq.Kind == yaml.MappingNode {
+		var found *yaml.Node
+		for i := 0; i+1 < len(seq.Content); i += 2 {
+			if seq.Content[i].Value == key {
+				found = seq.Content[i+1]
+			}
+		}
+		seq = found
+	}
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	lines := make([]int, len(seq.Content))
+	for i, item := range seq.Content {
+		lines[i] = item.Line
+	}
+	return lines
+}
+
+// lineError prefixes the error with the line of the i-th item, if known
+func lineError(lines []int, i int, err error) error {
+	if i < len(lines) {
+		return fmt.Errorf("line %d: %s", lines[i], err.Error())
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyReload(t *testing.T) {
+
+	valid := `
+- name: policy_1
+  actions:
+    - name: docker_version
+`
+	invalid := `
+- name: policy_1
+  actions:
+    - name: docker_version
+      bodyy: {}
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(valid), 0755))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	req := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/version", User: "test"}
+	assert.True(t, authorizer.AuthZReq(req).Allow)
+
+	// Invalid policies are refused with a line numbered error, the last known good policies are kept
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(invalid), 0755))
+	err := authorizer.loader.load()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 5")
+	assert.True(t, authorizer.AuthZReq(req).Allow, "Previous policies must be kept")
+
+	status := authorizer.PolicyStatus()
+	assert.Equal(t, uint64(1), status.Reloads)
+	assert.GreaterOrEqual(t, status.Failures, uint64(1))
+	assert.Contains(t, status.LastError, "bodyy")
+	assert.Equal(t, 1, status.Policies)
+
+	// Empty policy files are refused
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(""), 0755))
+	assert.Error(t, authorizer.loader.load())
+	assert.True(t, authorizer.AuthZReq(req).Allow, "Previous policies must be kept")
+
+	// Valid policies are swapped while requests are evaluated
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(valid), 0755))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, authorizer.loader.load())
+		}()
+		go func() {
+			defer wg.Done()
+			assert.True(t, authorizer.AuthZReq(req).Allow)
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, authorizer.PolicyStatus().LastError)
+}
+
+func TestPolicyValidationLines(t *testing.T) {
+
+	_, err := parseAnubisPolicies([]byte(`
+groups:
+  admins: ["admin"]
+policies:
+  - name: policy_1
+    actions:
+      - name: docker_version
+  - name: policy_2
+    actions:
+      - name: "container_(create"
+`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 8")
+	assert.Contains(t, err.Error(), "policy_2")
+
+	_, err = parseBasicPolicySet([]byte(`[{"name":"policy_1","users":["user_1"],"actions":["container_(create"]}]`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1")
+}
+
+func TestPolicyHash(t *testing.T) {
+
+	dir := t.TempDir()
+	shared := filepath.Join(t.TempDir(), "shared.yaml")
+	assert.NoError(t, ioutil.WriteFile(shared, []byte("groups:\n  admins: [admin]\npolicies: []\n"), 0644))
+	policyFileName := filepath.Join(dir, "policy.yaml")
+	policy := "include: [" + shared + "]\npolicies:\n  - name: policy_1\n    groups: [admins]\n    actions:\n      - name: docker_version\n"
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+	status := authorizer.PolicyStatus()
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", status.Hash)
+	assert.Equal(t, []string{policyFileName, shared}, status.Sources, "Included files are sources")
+	assert.Len(t, authorizer.ActivePolicies(), 1)
+
+	// The hash is stable, and changes with any source
+	assert.NoError(t, authorizer.Reload())
+	assert.Equal(t, status.Hash, authorizer.PolicyStatus().Hash)
+	assert.NoError(t, ioutil.WriteFile(shared, []byte("groups:\n  admins: [admin, root]\npolicies: []\n"), 0644))
+	assert.NoError(t, authorizer.Reload())
+	assert.NotEqual(t, status.Hash, authorizer.PolicyStatus().Hash)
+
+	// The hash identifies the parsed content, even if the files change after being parsed
+	loader := newPolicyLoader(policyFileName, func(path string, sources *policySources) (*anubisPolicySet, error) {
+		set, err := parseAnubisPolicySet(path, sources)
+		assert.NoError(t, ioutil.WriteFile(shared, []byte("groups:\n  admins: []\npolicies: []\n"), 0644))
+		return set, err
+	})
+	assert.NoError(t, loader.load())
+	assert.Equal(t, authorizer.PolicyStatus().Hash, loader.PolicyStatus().Hash)
+}
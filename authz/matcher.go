@@ -0,0 +1,243 @@
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Matcher is a typed constraint on a single value of a request, either a body key or a query parameter.
+// In body policies, a mapping whose keys are all matcher keywords is evaluated as a matcher, for example:
+//
+//	HostConfig:
+//	  Memory: {required: true, min: 64Mi, max: 2Gi}
+//	  NetworkMode: {oneOf: ["student", "none"]}
+//	  CapAdd: {subsetOf: ["CHOWN", "SETUID", "SETGID"]}
+//	Image: {regex: "registry\\.anubis-lms\\.io/.*"}
+type Matcher struct {
+	Required  bool          `yaml:"required,omitempty"`  // Required indicates the value must be present
+	Forbidden bool          `yaml:"forbidden,omitempty"` // Forbidden indicates the value must be absent or empty (e.g. false, 0, "")
+	OneOf     []interface{} `yaml:"oneOf,omitempty"`     // OneOf are the allowed values
+	Regex     string        `yaml:"regex,omitempty"`     // Regex is the regular expression the entire value must match
+	Prefix    string        `yaml:"prefix,omitempty"`    // Prefix is the required prefix of the value
+	Min       interface{}   `yaml:"min,omitempty"`       // Min is the minimal value (a number or a quantity such as 64Mi)
+	Max       interface{}   `yaml:"max,omitempty"`       // Max is the maximal value (a number or a quantity such as 2Gi)
+	SubsetOf  []interface{} `yaml:"subsetOf,omitempty"`  // SubsetOf are the allowed elements of a list value
+}
+
+// matcherKeys are the keywords identifying a matcher in a body policy
+var matcherKeys = map[string]bool{
+	"required": true, "forbidden": true, "oneOf": true, "regex": true,
+	"prefix": true, "min": true, "max": true, "subsetOf": true,
+}
+
+// regexCache caches compiled matcher expressions
+var regexCache sync.Map
+
+// compileRegex compiles an anchored regular expression, using the cache when possible
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(anchor(expr))
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(expr, re)
+	return re, nil
+}
+
+// anchor anchors a regular expression such that it must match the entire value
+func anchor(expr string) string {
+	return "^(?:" + expr + ")$"
+}
+
+// asMatcher converts a body policy value to a matcher, if all the keys of the value are matcher keywords
+func asMatcher(policyV interface{}) (*Matcher, bool, error) {
+	m, ok := policyV.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, false, nil
+	}
+	for k := range m {
+		if !matcherKeys[k] {
+			return nil, false, nil
+		}
+	}
+
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, true, err
+	}
+	var matcher Matcher
+	if err := yaml.Unmarshal(data, &matcher); err != nil {
+		return nil, true, err
+	}
+	return &matcher, true, matcher.validate()
+}
+
+// validate verifies the matcher is well formed
+func (m *Matcher) validate() error {
+	if m.Required && m.Forbidden {
+		return fmt.Errorf("cannot be both required and forbidden")
+	}
+	if m.Regex != "" {
+		if _, err := compileRegex(m.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %s", err.Error())
+		}
+	}
+	for _, bound := range []interface{}{m.Min, m.Max} {
+		if bound == nil {
+			continue
+		}
+		if _, err := toNumber(bound); err != nil {
+			return fmt.Errorf("invalid bound: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// matchValue checks a present value against the value constraints of the matcher
+// (oneOf, regex, prefix, min, max and subsetOf) and returns the reason of a failure
+func (m *Matcher) matchValue(v interface{}) (bool, string) {
+	if len(m.OneOf) > 0 && !containsValue(m.OneOf, v) {
+		return false, fmt.Sprintf("%v not one of %v", v, m.OneOf)
+	}
+
+	if m.Regex != "" || m.Prefix != "" {
+		s, ok := v.(string)
+		if !ok {
+			return false, fmt.Sprintf("%v is not a string", v)
+		}
+		if m.Prefix != "" && !strings.HasPrefix(s, m.Prefix) {
+			return false, fmt.Sprintf("%s does not start with %s", s, m.Prefix)
+		}
+		if m.Regex != "" {
+			re, err := compileRegex(m.Regex)
+			if err != nil || !re.MatchString(s) {
+				return false, fmt.Sprintf("%s does not match %s", s, m.Regex)
+			}
+		}
+	}
+
+	if m.Min != nil || m.Max != nil {
+		n, err := toNumber(v)
+		if err != nil {
+			return false, fmt.Sprintf("%v is not a number", v)
+		}
+		if min, _ := toNumber(m.Min); m.Min != nil && n < min {
+			return false, fmt.Sprintf("%v < min %v", v, m.Min)
+		}
+		if max, _ := toNumber(m.Max); m.Max != nil && n > max {
+			return false, fmt.Sprintf("%v > max %v", v, m.Max)
+		}
+	}
+
+	if m.SubsetOf != nil {
+		elements, ok := v.([]interface{})
+		if !ok {
+			elements = []interface{}{v}
+		}
+		for _, e := range elements {
+			if !containsValue(m.SubsetOf, e) {
+				return false, fmt.Sprintf("%v not in %v", e, m.SubsetOf)
+			}
+		}
+	}
+	return true, ""
+}
+
+// containsValue returns true if the list contains a value equal to v
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, e := range list {
+		if valuesEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesEqual compares policy and request values, numbers are compared regardless of their type
+func valuesEqual(a, b interface{}) bool {
+	if an, ok := numberValue(a); ok {
+		bn, ok := numberValue(b)
+		return ok && an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// isEmpty returns true if the value is considered unset (nil, false, 0, "" or an empty list or map)
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if n, ok := numberValue(v); ok {
+		return n == 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+// numberValue converts numeric values to float64
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// quantitySuffixes are the multipliers of quantity suffixes, binary (Ki, Mi, ...) or decimal (K, M, ...)
+var quantitySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// toNumber converts a number or a quantity string (e.g. 64Mi, 2Gi, 1.5G) to float64
+func toNumber(v interface{}) (float64, error) {
+	if n, ok := numberValue(v); ok {
+		return n, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+
+	s = strings.TrimSpace(s)
+	multiplier := 1.0
+	for _, q := range quantitySuffixes {
+		if strings.HasSuffix(s, q.suffix) {
+			s, multiplier = strings.TrimSuffix(s, q.suffix), q.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(n) {
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	return n * multiplier, nil
+}
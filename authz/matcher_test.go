@@ -0,0 +1,48 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToNumber(t *testing.T) {
+
+	tests := []struct {
+		value    interface{}
+		expected float64
+	}{
+		{64, 64},
+		{2.5, 2.5},
+		{"1024", 1024},
+		{"64Mi", 64 << 20},
+		{"2Gi", 2 << 30},
+		{"1.5G", 1.5e9},
+		{"500k", 500e3},
+	}
+
+	for _, test := range tests {
+		n, err := toNumber(test.value)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, n, "%v", test.value)
+	}
+
+	_, err := toNumber("lots")
+	assert.Error(t, err)
+	_, err = toNumber(true)
+	assert.Error(t, err)
+}
+
+func TestAsMatcher(t *testing.T) {
+
+	matcher, ok, err := asMatcher(map[string]interface{}{"oneOf": []interface{}{"student", "none"}})
+	assert.NoError(t, err)
+	assert.True(t, ok, "Mapping of matcher keywords is a matcher")
+	assert.Equal(t, []interface{}{"student", "none"}, matcher.OneOf)
+
+	_, ok, _ = asMatcher(map[string]interface{}{"Memory": 0, "min": 1})
+	assert.False(t, ok, "Mapping with body keys is not a matcher")
+
+	_, ok, _ = asMatcher(nil)
+	assert.False(t, ok, "Null is not a matcher")
+}
@@ -0,0 +1,242 @@
+package authz
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mount types supported by docker
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// MountPolicy restricts the mounts of container_create requests. The policy is evaluated against the
+// legacy HostConfig.Binds strings, the structured HostConfig.Mounts array, the HostConfig.Tmpfs map and
+// the HostConfig.VolumesFrom containers.
+//
+//	mounts:
+//	  types: [bind, volume, tmpfs]
+//	  hostPaths:
+//	    - prefix: /srv/anubis/shared
+//	      readOnly: true
+//	  volumes: ["ide-[a-z0-9-]+"]
+//
+// Bind mounts are only allowed under the host path prefixes. Named volumes must match one of the
+// volumes expressions, when specified. Volumes with inline driver options are always denied,
+// as the local driver can bind arbitrary host paths. The containers whose volumes are inherited
+// (VolumesFrom) must match one of the volumes expressions, as their mounts (including bind mounts)
+// cannot be verified from the request.
+type MountPolicy struct {
+	Types     []string       `yaml:"types,omitempty"`     // Types are the allowed mount types (all types are allowed if empty)
+	HostPaths []HostPathRule `yaml:"hostPaths,omitempty"` // HostPaths are the host path prefixes allowed for bind mounts
+	Volumes   []string       `yaml:"volumes,omitempty"`   // Volumes are regular expressions of the allowed named volumes
+}
+
+// HostPathRule allows bind mounts of host paths under the given prefix
+type HostPathRule struct {
+	Prefix   string `yaml:"prefix"`             // Prefix is the allowed host path prefix
+	ReadOnly bool   `yaml:"readOnly,omitempty"` // ReadOnly indicates mounts under the prefix must be read-only
+}
+
+// mount is a single mount of a container create request
+type mount struct {
+	Type     string // Type is the mount type (bind, volume, tmpfs)
+	Source   string // Source is the host path or volume name (empty for anonymous volumes and tmpfs)
+	Target   string // Target is the path in the container
+	ReadOnly bool   // ReadOnly indicates the mount is read-only
+	Options  bool   // Options indicates the volume has inline driver options
+	From     bool   // From indicates the mounts of the source container are inherited (VolumesFrom)
+}
+
+// validate verifies the mount policy is well formed
+func (p *MountPolicy) validate() error {
+	for _, t := range p.Types {
+		if t != MountTypeBind && t != MountTypeVolume && t != MountTypeTmpfs && t != "npipe" && t != "cluster" {
+			return fmt.Errorf("unknown mount type '%s'", t)
+		}
+	}
+	for _, rule := range p.HostPaths {
+		if !path.IsAbs(rule.Prefix) {
+			return fmt.Errorf("host path prefix '%s' must be absolute", rule.Prefix)
+		}
+	}
+	for _, expr := range p.Volumes {
+		if _, err := compileRegex(expr); err != nil {
+			return fmt.Errorf("invalid volume regex '%s': %s", expr, err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckMounts checks the mounts of a container create request body against the mount policy.
+// The body keys are matched case-insensitively like docker daemon does (see decodeBody).
+func CheckMounts(body map[string]interface{}, policy *MountPolicy) (bool, string) {
+	body, err := canonicalize(core.ActionContainerCreate, body)
+	if err != nil {
+		logrus.Errorf("Failing on invalid body %q", err.Error())
+		return false, err.Error()
+	}
+	return checkMounts(body, policy)
+}
+
+// checkMounts checks the mounts of a container create request body, with canonical keys, against the mount policy
+func checkMounts(body map[string]interface{}, policy *MountPolicy) (bool, string) {
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	mounts, err := parseMounts(hostConfig)
+	if err != nil {
+		logrus.Errorf("Failing on invalid mounts %q", err.Error())
+		return false, err.Error()
+	}
+
+	for _, m := range mounts {
+		check, msg := policy.checkMount(m)
+		if !check {
+			logrus.Errorf("Failing on mount not matching %s", msg)
+			return false, msg
+		}
+	}
+	return true, ""
+}
+
+// checkMount checks a single mount against the mount policy
+func (p *MountPolicy) checkMount(m mount) (bool, string) {
+	if len(p.Types) > 0 && !containsString(p.Types, m.Type) {
+		return false, fmt.Sprintf("%s mount on %s not allowed (allowed types %v)", m.Type, m.Target, p.Types)
+	}
+
+	switch m.Type {
+	case MountTypeBind:
+		source := path.Clean(m.Source)
+		if !path.IsAbs(source) {
+			return false, fmt.Sprintf("bind mount source %s must be absolute", m.Source)
+		}
+		for _, rule := range p.HostPaths {
+			if !underPrefix(source, rule.Prefix) {
+				continue
+			}
+			if rule.ReadOnly && !m.ReadOnly {
+				return false, fmt.Sprintf("bind mount of %s must be read-only", source)
+			}
+			return true, ""
+		}
+		return false, fmt.Sprintf("bind mount of %s not allowed", source)
+
+	case MountTypeVolume:
+		if m.From {
+			for _, expr := range p.Volumes {
+				if re, err := compileRegex(expr); err == nil && re.MatchString(m.Source) {
+					return true, ""
+				}
+			}
+			return false, fmt.Sprintf("volumes from container %s not allowed", m.Source)
+		}
+		if m.Options {
+			return false, fmt.Sprintf("volume mount on %s with driver options not allowed", m.Target)
+		}
+		if m.Source == "" || len(p.Volumes) == 0 {
+			return true, ""
+		}
+		for _, expr := range p.Volumes {
+			if re, err := compileRegex(expr); err == nil && re.MatchString(m.Source) {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("volume %s not allowed", m.Source)
+	}
+	return true, ""
+}
+
+// parseMounts collects the mounts of a container create request from Binds, Mounts, Tmpfs and VolumesFrom
+func parseMounts(hostConfig map[string]interface{}) ([]mount, error) {
+	var mounts []mount
+
+	binds, _ := hostConfig["Binds"].([]interface{})
+	for _, b := range binds {
+		bind, ok := b.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid bind %v", b)
+		}
+		mounts = append(mounts, parseBind(bind))
+	}
+
+	structured, _ := hostConfig["Mounts"].([]interface{})
+	for _, s := range structured {
+		fields, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid mount %v", s)
+		}
+		m := mount{}
+		m.Type, _ = fields["Type"].(string)
+		m.Source, _ = fields["Source"].(string)
+		m.Target, _ = fields["Target"].(string)
+		m.ReadOnly, _ = fields["ReadOnly"].(bool)
+		if m.Type == "" {
+			m.Type = MountTypeVolume
+		}
+		if options, ok := fields["VolumeOptions"].(map[string]interface{}); ok {
+			m.Options = !isEmpty(options["DriverConfig"])
+		}
+		mounts = append(mounts, m)
+	}
+
+	tmpfs, _ := hostConfig["Tmpfs"].(map[string]interface{})
+	for target := range tmpfs {
+		mounts = append(mounts, mount{Type: MountTypeTmpfs, Target: target})
+	}
+
+	volumesFrom, _ := hostConfig["VolumesFrom"].([]interface{})
+	for _, v := range volumesFrom {
+		from, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid volumes from %v", v)
+		}
+		name, mode, _ := strings.Cut(from, ":")
+		mounts = append(mounts, mount{Type: MountTypeVolume, Source: name, ReadOnly: mode == "ro", From: true})
+	}
+
+	return mounts, nil
+}
+
+// parseBind parses a legacy bind string (source:target[:options] or target for anonymous volumes)
+func parseBind(bind string) mount {
+	parts := strings.Split(bind, ":")
+	if len(parts) == 1 {
+		return mount{Type: MountTypeVolume, Target: parts[0]}
+	}
+
+	m := mount{Source: parts[0], Target: parts[1], Type: MountTypeVolume}
+	if strings.HasPrefix(m.Source, "/") || strings.HasPrefix(m.Source, ".") {
+		m.Type = MountTypeBind
+	}
+	if len(parts) > 2 {
+		for _, option := range strings.Split(parts[2], ",") {
+			if option == "ro" {
+				m.ReadOnly = true
+			}
+		}
+	}
+	return m
+}
+
+// underPrefix returns true if the cleaned path is the prefix or is located under it
+func underPrefix(p, prefix string) bool {
+	prefix = path.Clean(prefix)
+	return p == prefix || prefix == "/" || strings.HasPrefix(p, prefix+"/")
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
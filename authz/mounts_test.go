@@ -0,0 +1,68 @@
+package authz
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBind(t *testing.T) {
+
+	tests := []struct {
+		bind     string
+		expected mount
+	}{
+		{"/data", mount{Type: MountTypeVolume, Target: "/data"}},
+		{"ide-home:/home/anubis", mount{Type: MountTypeVolume, Source: "ide-home", Target: "/home/anubis"}},
+		{"/srv/shared:/shared", mount{Type: MountTypeBind, Source: "/srv/shared", Target: "/shared"}},
+		{"/srv/shared:/shared:ro,z", mount{Type: MountTypeBind, Source: "/srv/shared", Target: "/shared", ReadOnly: true}},
+		{"/srv/shared:/shared:rw", mount{Type: MountTypeBind, Source: "/srv/shared", Target: "/shared"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseBind(test.bind), test.bind)
+	}
+}
+
+func TestUnderPrefix(t *testing.T) {
+	assert.True(t, underPrefix("/srv/anubis", "/srv/anubis"))
+	assert.True(t, underPrefix("/srv/anubis/cs101", "/srv/anubis/"))
+	assert.True(t, underPrefix("/etc", "/"))
+	assert.False(t, underPrefix("/srv/anubis-other", "/srv/anubis"))
+	assert.False(t, underPrefix("/srv", "/srv/anubis"))
+}
+
+func TestCheckMounts(t *testing.T) {
+
+	policy := &MountPolicy{
+		HostPaths: []HostPathRule{{Prefix: "/srv/anubis/shared", ReadOnly: true}},
+		Volumes:   []string{"ide-[a-z0-9-]+"},
+	}
+
+	tests := []struct {
+		body        string
+		allow       bool
+		expectedMsg string
+	}{
+		{`{"HostConfig":{"Binds":["/srv/anubis/shared:/shared:ro","ide-home:/home/anubis"]}}`, true, ""},
+		{`{"HostConfig":{"Binds":["/:/host"]}}`, false, "bind mount of / not allowed"},
+		{`{"hostconfig":{"binds":["/:/host"]}}`, false, "bind mount of / not allowed"},
+		{`{"HOSTCONFIG":{"mounts":[{"type":"bind","source":"/etc","target":"/etc"}]}}`, false, "bind mount of /etc not allowed"},
+		{`{"HostConfig":{"Binds":[]},"hostconfig":{"Binds":["/:/host"]}}`, false, "duplicate key"},
+		{`{"HostConfig":{"VolumesFrom":["ide-home-1:ro"]}}`, true, ""},
+		{`{"HostConfig":{"volumesfrom":["db"]}}`, false, "volumes from container db not allowed"},
+	}
+
+	for _, test := range tests {
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(test.body), &body))
+		check, msg := CheckMounts(body, policy)
+		assert.Equal(t, test.allow, check, test.body)
+		assert.Contains(t, msg, test.expectedMsg, test.body)
+	}
+
+	// Volumes from other containers are denied without volumes expressions
+	check, _ := CheckMounts(map[string]interface{}{"HostConfig": map[string]interface{}{"VolumesFrom": []interface{}{"ide-home-1"}}}, &MountPolicy{})
+	assert.False(t, check)
+}
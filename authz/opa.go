@@ -0,0 +1,265 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/sirupsen/logrus"
+)
+
+// OPAQuery is the rego document evaluated for every request. It must define a boolean allow rule,
+// and may define a deny rule, the set of messages denying the request.
+const OPAQuery = "data.docker.authz"
+
+// OPAAuthorizerSettings provides settings for the OPA authorizer flow
+type OPAAuthorizerSettings struct {
+	PolicyPath string // PolicyPath is the path to the rego policy file, folder or bundle (.tar.gz)
+}
+
+// opaPolicySet is an immutable, compiled set of rego modules
+type opaPolicySet struct {
+	query   rego.PreparedEvalQuery // query is the compiled OPAQuery
+	modules int                    // modules is the number of rego modules
+	files   []string               // files are the files the modules were loaded from
+}
+
+// size returns the number of rego modules in the set
+func (s *opaPolicySet) size() int {
+	if s == nil {
+		return 0
+	}
+	return s.modules
+}
+
+// isRegoFile returns true if the file is a rego module or a data document of a rego policy folder
+func isRegoFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".rego" || ext == ".json"
+}
+
+// parseOPAPolicySet loads and compiles a rego policy file, a folder of rego modules and data
+// documents, or a bundle tarball
+func parseOPAPolicySet(path string, sources *policySources) (*opaPolicySet, error) {
+	set := &opaPolicySet{}
+	options := []func(*rego.Rego){rego.Query(OPAQuery)}
+
+	if strings.HasSuffix(path, ".tar.gz") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sources.add(path, data)
+		bundle, err := loader.NewFileLoader().WithReader(bytes.NewReader(data)).AsBundle(path)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, rego.ParsedBundle(path, bundle))
+		set.modules = len(bundle.Modules)
+	} else {
+		// Load through a file system recording the files read, such that the sources are the files parsed
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		fsys := &recordingFS{FS: os.DirFS("/"), sources: sources}
+		result, err := loader.NewFileLoader().WithFS(fsys).All([]string{strings.TrimPrefix(filepath.ToSlash(abs), "/")})
+		if err != nil {
+			return nil, err
+		}
+		for _, module := range result.Modules {
+			options = append(options, rego.ParsedModule(module.Parsed))
+		}
+		options = append(options, rego.Store(inmem.NewFromObject(result.Documents)))
+		set.modules = len(result.Modules)
+	}
+	set.files = sources.files
+
+	var err error
+	if set.query, err = rego.New(options...).PrepareForEval(context.Background()); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// recordingFS is a file system recording the content of the files read
+type recordingFS struct {
+	fs.FS
+	sources *policySources // sources records the files read
+}
+
+// ReadFile reads and records the file
+func (r *recordingFS) ReadFile(name string) ([]byte, error) {
+	data, err := fs.ReadFile(r.FS, name)
+	if err == nil {
+		r.sources.add("/"+name, data)
+	}
+	return data, err
+}
+
+type opaAuthorizer struct {
+	settings *OPAAuthorizerSettings
+	loader   *policyLoader[*opaPolicySet]
+	watcher  *policyWatcher
+}
+
+// NewOPAAuthZAuthorizer creates a new authorizer evaluating rego policies with the embedded OPA engine
+func NewOPAAuthZAuthorizer(settings *OPAAuthorizerSettings) core.Authorizer {
+	return &opaAuthorizer{
+		settings: settings,
+		loader:   newPolicyLoader(settings.PolicyPath, parseOPAPolicySet),
+	}
+}
+
+// sources returns the files the active policies were loaded from
+func (f *opaAuthorizer) sources() []string {
+	if set := f.loader.get(); set != nil {
+		return set.files
+	}
+	return nil
+}
+
+// PolicyStatus returns the status of the policy loads
+func (f *opaAuthorizer) PolicyStatus() core.PolicyStatus {
+	return f.loader.PolicyStatus()
+}
+
+// ActivePolicies returns the query evaluated against the active rego modules (listed in the policy status sources)
+func (f *opaAuthorizer) ActivePolicies() interface{} {
+	return map[string]interface{}{"query": OPAQuery, "modules": f.loader.get().size()}
+}
+
+// Init loads and compiles the rego policy from disk
+func (f *opaAuthorizer) Init() error {
+	err := f.Reload()
+	if err != nil {
+		return err
+	}
+
+	f.watcher, err = watchPolicy(f.settings.PolicyPath, f.Reload, f.sources)
+	if err != nil {
+		// Silently ignore watching error
+		logrus.Errorf("Failed to start watching folder %q", err.Error())
+	}
+
+	return nil
+}
+
+// Reload reloads the policy from disk, keeping the current policy if the new one is invalid
+func (f *opaAuthorizer) Reload() error {
+	return f.loader.load()
+}
+
+// Close stops watching the policy
+func (f *opaAuthorizer) Close() error {
+	if f.watcher != nil {
+		return f.watcher.Close()
+	}
+	return nil
+}
+
+// opaInput builds the input document of the request:
+//
+//	{"user": "user_1", "method": "POST", "path": "/v1.41/containers/create", "action": "container_create",
+//	 "apiVersion": "1.41", "params": {}, "query": {"name": ["web"]}, "body": {"Image": "alpine"}}
+func opaInput(authZReq *authorization.Request, route core.Route) (map[string]interface{}, error) {
+	u, err := url.Parse(authZReq.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	params := route.Params
+	if params == nil {
+		params = map[string]string{}
+	}
+	input := map[string]interface{}{
+		"user":            authZReq.User,
+		"userAuthNMethod": authZReq.UserAuthNMethod,
+		"method":          authZReq.RequestMethod,
+		"uri":             authZReq.RequestURI,
+		"path":            u.Path,
+		"action":          route.Action,
+		"apiVersion":      route.APIVersion,
+		"params":          params,
+		"query":           map[string][]string(u.Query()),
+		"body":            nil,
+	}
+	if authZReq.RequestMethod == http.MethodPost && len(authZReq.RequestBody) > 0 {
+		body, err := decodeBody(route.Action, authZReq.RequestBody, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body")
+		}
+		input["body"] = body
+	}
+	return input, nil
+}
+
+// AuthZReq evaluates the request against the rego policy. The request is allowed if the allow rule is
+// true and the deny rule holds no message.
+func (f *opaAuthorizer) AuthZReq(authZReq *authorization.Request) *authorization.Response {
+	res := f.evaluate(authZReq)
+	route, _ := parseAction(authZReq)
+	core.RecordDecision(route.Action, authZReq.User, OPAQuery, res.Allow)
+	return res
+}
+
+// evaluate evaluates the request against the rego policy
+func (f *opaAuthorizer) evaluate(authZReq *authorization.Request) *authorization.Response {
+	logrus.Debugf("Received AuthZ request, method: '%s', url: '%s'", authZReq.RequestMethod, authZReq.RequestURI)
+
+	route, err := parseAction(authZReq)
+	if err != nil {
+		return &authorization.Response{Allow: false, Msg: err.Error()}
+	}
+	input, err := opaInput(authZReq, route)
+	if err != nil {
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' denied for user '%s' on %s", route.Action, authZReq.User, err.Error())}
+	}
+
+	set := f.loader.get()
+	if set == nil {
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("no policy applied (user: '%s' action: '%s')", authZReq.User, route.Action)}
+	}
+	results, err := set.query.Eval(context.Background(), rego.EvalInput(input))
+	if err != nil {
+		logrus.Errorf("Failed to evaluate rego policy for action %q error %q", route.Action, err.Error())
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' denied for user '%s' on policy evaluation error", route.Action, authZReq.User)}
+	}
+
+	var decision map[string]interface{}
+	if len(results) > 0 && len(results[0].Expressions) > 0 {
+		decision, _ = results[0].Expressions[0].Value.(map[string]interface{})
+	}
+
+	var reasons []string
+	denied, _ := decision["deny"].([]interface{})
+	for _, reason := range denied {
+		reasons = append(reasons, fmt.Sprint(reason))
+	}
+	if len(reasons) > 0 {
+		sort.Strings(reasons)
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' denied for user '%s' by opa policy: %s", route.Action, authZReq.User, strings.Join(reasons, ", "))}
+	}
+	if allow, _ := decision["allow"].(bool); !allow {
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' not allowed for user '%s' by opa policy", route.Action, authZReq.User)}
+	}
+	return &authorization.Response{Allow: true, Msg: fmt.Sprintf("action '%s' allowed for user '%s' by opa policy", route.Action, authZReq.User)}
+}
+
+// AuthZRes always allow responses from server
+func (f *opaAuthorizer) AuthZRes(authZReq *authorization.Request) *authorization.Response {
+	return &authorization.Response{Allow: true}
+}
@@ -0,0 +1,117 @@
+package authz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+const opaPolicy = `
+package docker.authz
+
+import future.keywords.contains
+import future.keywords.if
+import future.keywords.in
+
+default allow := false
+
+allow if input.user in data.staff
+
+allow if {
+	input.action in {"container_create", "container_start"}
+	input.query.name[0] != "forbidden"
+}
+
+allow if {
+	input.action == "container_logs"
+	input.params.container == "web"
+}
+
+deny contains msg if {
+	input.action == "container_create"
+	input.body.HostConfig.Privileged
+	msg := "privileged containers are not allowed"
+}
+`
+
+func TestOPA(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "policy.rego"), []byte(opaPolicy), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"staff":["admin"]}`), 0644))
+
+	authorizer := NewOPAAuthZAuthorizer(&OPAAuthorizerSettings{PolicyPath: dir}).(*opaAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	authorizer.watcher.Close()
+	assert.Equal(t, 1, authorizer.PolicyStatus().Policies)
+	assert.Equal(t, []string{filepath.Join(dir, "data.json"), filepath.Join(dir, "policy.rego")}, authorizer.PolicyStatus().Sources, "Modules and data documents are sources")
+
+	tests := []struct {
+		method string
+		uri    string
+		user   string
+		body   string
+		allow  bool
+		msg    string
+	}{
+		{http.MethodPost, "/v1.41/containers/create?name=web", "user_1", `{"Image":"alpine"}`, true, "allowed for user 'user_1' by opa policy"},
+		{http.MethodPost, "/v1.41/containers/create?name=forbidden", "user_1", `{"Image":"alpine"}`, false, "not allowed for user 'user_1' by opa policy"},
+		{http.MethodPost, "/v1.41/containers/create?name=web", "user_1", `{"HostConfig":{"Privileged":true}}`, false, "by opa policy: privileged containers are not allowed"},
+		{http.MethodPost, "/v1.41/containers/create?name=web", "admin", `{"HostConfig":{"Privileged":true}}`, false, "privileged containers are not allowed"}, // Deny overrides
+		{http.MethodPost, "/v1.41/containers/create?name=web", "user_1", `{`, false, "on invalid body"},
+		{http.MethodGet, "/v1.41/containers/web/logs", "user_1", "", true, ""},
+		{http.MethodGet, "/v1.41/containers/db/logs", "user_1", "", false, "not allowed"},
+		{http.MethodDelete, "/v1.41/containers/db", "admin", "", true, ""}, // Data documents are loaded
+	}
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: test.user, RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s (%s): %s", test.method, test.uri, test.user, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// Invalid policies are refused, keeping the active policy
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "policy.rego"), []byte("package docker.authz\nallow {"), 0644))
+	assert.Error(t, authorizer.Reload())
+	assert.True(t, authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodDelete, RequestURI: "/v1.41/containers/db", User: "admin"}).Allow)
+}
+
+func TestOPABundle(t *testing.T) {
+
+	// Bundle tarball holding the policy and its data
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	file, err := os.Create(bundlePath)
+	assert.NoError(t, err)
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+	for name, content := range map[string]string{"/policy.rego": opaPolicy, "/data.json": `{"staff":["admin"]}`} {
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err = archive.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, compressed.Close())
+	assert.NoError(t, file.Close())
+
+	authorizer := NewOPAAuthZAuthorizer(&OPAAuthorizerSettings{PolicyPath: bundlePath}).(*opaAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+	assert.True(t, authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodDelete, RequestURI: "/v1.41/containers/db", User: "admin"}).Allow)
+	assert.False(t, authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodDelete, RequestURI: "/v1.41/containers/db", User: "user_1"}).Allow)
+}
+
+func TestOPAShippedPolicy(t *testing.T) {
+	authorizer := NewOPAAuthZAuthorizer(&OPAAuthorizerSettings{PolicyPath: "policy-opa.rego"}).(*opaAuthorizer)
+	assert.NoError(t, authorizer.Reload(), "Shipped policy must be valid")
+
+	create := &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "user_1",
+		RequestBody: []byte(`{"Image":"alpine","HostConfig":{"Privileged":true}}`)}
+	assert.False(t, authorizer.AuthZReq(create).Allow)
+	create.User = "admin"
+	assert.True(t, authorizer.AuthZReq(create).Allow)
+}
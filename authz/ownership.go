@@ -0,0 +1,370 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultOwnerLabel is the container label holding the owner of a container
+const DefaultOwnerLabel = "anubis.io/owner"
+
+// ownership tracks the owners of containers, execs, volumes and networks, and the resources of the
+// containers accounted in the quotas. Owners are learned from the daemon responses to the requests
+// creating them, and rebuilt from the owner label of the objects on startup. The containers without
+// owner are recorded untracked, such that the references to them are resolved but never owned.
+type ownership struct {
+	store   *stateStore   // store persists the owners
+	label   string        // label is the container label holding the owner
+	pending *reservations // pending holds the quota usage reserved by the requests in flight
+}
+
+// settle learns the response of the request and releases the quota usage it reserved, now accounted in the store
+func (o *ownership) settle(authZReq *authorization.Request, route core.Route) error {
+	o.pending.lock.Lock()
+	defer o.pending.lock.Unlock()
+	defer o.pending.release(requestKey(authZReq))
+	return o.learn(authZReq, route)
+}
+
+// release releases the quota usage reserved by the request
+func (o *ownership) release(authZReq *authorization.Request) {
+	o.pending.lock.Lock()
+	defer o.pending.lock.Unlock()
+	o.pending.release(requestKey(authZReq))
+}
+
+// learn records the containers, execs, volumes and networks created, updated, renamed or removed by the request
+func (o *ownership) learn(authZReq *authorization.Request, route core.Route) error {
+	var query url.Values
+	if u, err := url.Parse(authZReq.RequestURI); err == nil {
+		query = u.Query()
+	}
+	var body map[string]interface{}
+	if authZReq.RequestMethod == http.MethodPost && len(authZReq.RequestBody) > 0 {
+		// Learn the resources from the canonical body, like they are checked by the quotas
+		body, _ = decodeBody(route.Action, authZReq.RequestBody, false)
+	}
+	status := authZReq.ResponseStatusCode
+
+	var created struct {
+		ID   string `json:"Id"`
+		Name string `json:"Name"`
+	}
+	switch {
+	case route.Action == core.ActionContainerCreate && status == http.StatusCreated:
+		if err := json.Unmarshal(authZReq.ResponseBody, &created); err != nil || created.ID == "" {
+			return fmt.Errorf("failed to learn the owner of container created by '%s': invalid response", authZReq.User)
+		}
+		logrus.Debugf("Learned container '%s' owned by '%s'", created.ID, authZReq.User)
+		record := containerRecord{ID: created.ID, Name: query.Get("name"), Owner: authZReq.User}
+		hostConfig, _ := body["HostConfig"].(map[string]interface{})
+		record.Memory, _ = resourceValue(hostConfig, "Memory")
+		record.NanoCpus, _ = resourceValue(hostConfig, "NanoCpus")
+		return o.store.putContainer(record)
+
+	case route.Action == core.ActionContainerUpdate && status == http.StatusOK:
+		return o.store.updateContainer(route.Params[core.ParamContainer], func(record *containerRecord) {
+			if memory, ok := resourceValue(body, "Memory"); ok {
+				record.Memory = memory
+			}
+			if nanoCpus, ok := resourceValue(body, "NanoCpus"); ok {
+				record.NanoCpus = nanoCpus
+			}
+		})
+
+	case (route.Action == core.ActionContainerStart || route.Action == core.ActionContainerRestart) &&
+		(status == http.StatusNoContent || status == http.StatusNotModified):
+		return o.store.updateContainer(route.Params[core.ParamContainer], func(record *containerRecord) {
+			record.Running = true
+		})
+
+	case (route.Action == core.ActionContainerStop || route.Action == core.ActionContainerKill) &&
+		(status == http.StatusNoContent || status == http.StatusNotModified),
+		route.Action == core.ActionContainerWait && status == http.StatusOK:
+		return o.store.updateContainer(route.Params[core.ParamContainer], func(record *containerRecord) {
+			record.Running = false
+		})
+
+	case route.Action == core.ActionContainerExecCreate && authZReq.ResponseStatusCode == http.StatusCreated:
+		if err := json.Unmarshal(authZReq.ResponseBody, &created); err != nil || created.ID == "" {
+			return fmt.Errorf("failed to learn the owner of exec created by '%s': invalid response", authZReq.User)
+		}
+		record := execRecord{ID: created.ID, Container: route.Params[core.ParamContainer], Owner: authZReq.User}
+		if container, err := o.store.container(record.Container); err == nil && container != nil {
+			record.Container = container.ID
+		}
+		return o.store.putExec(record)
+
+	case route.Action == core.ActionContainerRename && status == http.StatusNoContent:
+		return o.store.renameContainer(route.Params[core.ParamContainer], query.Get("name"))
+
+	case route.Action == core.ActionContainerDelete && status == http.StatusNoContent:
+		return o.store.removeContainer(route.Params[core.ParamContainer])
+
+	case route.Action == core.ActionVolumeCreate && status == http.StatusCreated:
+		if err := json.Unmarshal(authZReq.ResponseBody, &created); err != nil || created.Name == "" {
+			return fmt.Errorf("failed to learn the owner of volume created by '%s': invalid response", authZReq.User)
+		}
+		return o.store.putObject(bucketVolumes, objectRecord{ID: created.Name, Name: created.Name, Owner: authZReq.User})
+
+	case route.Action == core.ActionVolumeRemove && status == http.StatusNoContent:
+		return o.store.removeObject(bucketVolumes, route.Params[core.ParamVolume])
+
+	case route.Action == core.ActionNetworkCreate && status == http.StatusCreated:
+		if err := json.Unmarshal(authZReq.ResponseBody, &created); err != nil || created.ID == "" {
+			return fmt.Errorf("failed to learn the owner of network created by '%s': invalid response", authZReq.User)
+		}
+		name, _ := body["Name"].(string)
+		return o.store.putObject(bucketNetworks, objectRecord{ID: created.ID, Name: name, Owner: authZReq.User})
+
+	case route.Action == core.ActionNetworkRemove && status == http.StatusNoContent:
+		return o.store.removeObject(bucketNetworks, route.Params[core.ParamNetwork])
+	}
+	return nil
+}
+
+// checkOwner checks the user owns the containers, execs, volumes and networks targeted by the request.
+// Containers must be created with the owner label set to the user, while the volumes and networks created
+// are owned by their creator. Requests targeting no owned object (e.g. container_list) are denied.
+func (o *ownership) checkOwner(req *policyRequest) (bool, string) {
+	if o == nil {
+		return false, "ownership tracking is disabled"
+	}
+
+	switch req.route.Action {
+	case core.ActionContainerCreate:
+		if req.bodyErr != nil {
+			return false, "invalid body"
+		}
+		labels, _ := req.body["Labels"].(map[string]interface{})
+		if owner, _ := labels[o.label].(string); owner != req.User {
+			return false, fmt.Sprintf("label %s must be '%s'", o.label, req.User)
+		}
+		return true, ""
+
+	case core.ActionVolumeCreate:
+		// Docker daemon returns the existing volume of the same name, which must not be taken over
+		if req.bodyErr != nil {
+			return false, "invalid body"
+		}
+		name, _ := req.body["Name"].(string)
+		record, err := o.store.object(bucketVolumes, name)
+		if err != nil {
+			logrus.Errorf("Failed to lookup volume %q error %q", name, err.Error())
+			return false, fmt.Sprintf("volume %s lookup failed", name)
+		}
+		if record != nil && (record.Owner == "" || record.Owner != req.User) {
+			return false, fmt.Sprintf("volume %s is not owned by user", name)
+		}
+		return true, ""
+
+	case core.ActionNetworkCreate:
+		return true, ""
+	}
+
+	targeted := false
+	if ref, ok := req.route.Params[core.ParamContainer]; ok {
+		if check, msg := o.checkContainer(ref, req.User); !check {
+			return false, msg
+		}
+		targeted = true
+	}
+	if id, ok := req.route.Params[core.ParamExec]; ok {
+		if check, msg := o.checkExec(id, req.User); !check {
+			return false, msg
+		}
+		targeted = true
+	}
+	if ref, ok := req.route.Params[core.ParamVolume]; ok {
+		if check, msg := o.checkObject(bucketVolumes, "volume", ref, req.User); !check {
+			return false, msg
+		}
+		targeted = true
+	}
+	if ref, ok := req.route.Params[core.ParamNetwork]; ok {
+		if check, msg := o.checkObject(bucketNetworks, "network", ref, req.User); !check {
+			return false, msg
+		}
+		targeted = true
+	}
+
+	if req.route.Action == core.ActionNetworkConnect || req.route.Action == core.ActionNetworkDisconnect {
+		// The container (dis)connected is named by the body
+		if req.bodyErr != nil {
+			return false, "invalid body"
+		}
+		ref, _ := req.body["Container"].(string)
+		if ref == "" {
+			return false, "missing container"
+		}
+		if check, msg := o.checkContainer(ref, req.User); !check {
+			return false, msg
+		}
+	}
+
+	if !targeted {
+		return false, fmt.Sprintf("action %s does not target an owned object", req.route.Action)
+	}
+	return true, ""
+}
+
+// checkContainer checks the user owns the container referred to by its ID, name or unique ID prefix
+func (o *ownership) checkContainer(ref, user string) (bool, string) {
+	record, err := o.store.container(ref)
+	if err != nil {
+		logrus.Errorf("Failed to lookup container %q error %q", ref, err.Error())
+		return false, fmt.Sprintf("container %s lookup failed", ref)
+	}
+	if record == nil {
+		return false, fmt.Sprintf("container %s is unknown", ref)
+	}
+	if record.Owner == "" || record.Owner != user {
+		return false, fmt.Sprintf("container %s is not owned by user", ref)
+	}
+	return true, ""
+}
+
+// checkExec checks the user owns the exec instance
+func (o *ownership) checkExec(id, user string) (bool, string) {
+	record, err := o.store.exec(id)
+	if err != nil {
+		logrus.Errorf("Failed to lookup exec %q error %q", id, err.Error())
+		return false, fmt.Sprintf("exec %s lookup failed", id)
+	}
+	if record == nil {
+		return false, fmt.Sprintf("exec %s is unknown", id)
+	}
+	if record.Owner != user {
+		return false, fmt.Sprintf("exec %s is not owned by user", id)
+	}
+	return true, ""
+}
+
+// checkObject checks the user owns the volume or network of the bucket referred to by the request
+func (o *ownership) checkObject(bucket []byte, kind, ref, user string) (bool, string) {
+	record, err := o.store.object(bucket, ref)
+	if err != nil {
+		logrus.Errorf("Failed to lookup %s %q error %q", kind, ref, err.Error())
+		return false, fmt.Sprintf("%s %s lookup failed", kind, ref)
+	}
+	if record == nil {
+		return false, fmt.Sprintf("%s %s is unknown", kind, ref)
+	}
+	if record.Owner == "" || record.Owner != user {
+		return false, fmt.Sprintf("%s %s is not owned by user", kind, ref)
+	}
+	return true, ""
+}
+
+// rebuild reconciles the known owners with the containers, volumes and networks of the docker daemon,
+// using the owner label
+func (o *ownership) rebuild(dockerSocket string) error {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+
+	var containers []struct {
+		ID     string            `json:"Id"`
+		Names  []string          `json:"Names"`
+		Labels map[string]string `json:"Labels"`
+		State  string            `json:"State"`
+	}
+	if err := list(client, "/containers/json?all=1", &containers); err != nil {
+		return err
+	}
+	records := make([]containerRecord, 0, len(containers))
+	for _, container := range containers {
+		record := containerRecord{ID: container.ID, Owner: container.Labels[o.label], Running: container.State == "running"}
+		if len(container.Names) > 0 {
+			record.Name = container.Names[0]
+		}
+		records = append(records, record)
+	}
+	if err := o.store.syncContainers(records); err != nil {
+		return err
+	}
+
+	var volumes struct {
+		Volumes []struct {
+			Name   string            `json:"Name"`
+			Labels map[string]string `json:"Labels"`
+		} `json:"Volumes"`
+	}
+	if err := list(client, "/volumes", &volumes); err != nil {
+		return err
+	}
+	objects := make([]objectRecord, 0, len(volumes.Volumes))
+	for _, volume := range volumes.Volumes {
+		objects = append(objects, objectRecord{ID: volume.Name, Name: volume.Name, Owner: volume.Labels[o.label]})
+	}
+	if err := o.store.syncObjects(bucketVolumes, objects); err != nil {
+		return err
+	}
+
+	var networks []struct {
+		ID     string            `json:"Id"`
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	}
+	if err := list(client, "/networks", &networks); err != nil {
+		return err
+	}
+	objects = make([]objectRecord, 0, len(networks))
+	for _, network := range networks {
+		objects = append(objects, objectRecord{ID: network.ID, Name: network.Name, Owner: network.Labels[o.label]})
+	}
+	if err := o.store.syncObjects(bucketNetworks, objects); err != nil {
+		return err
+	}
+
+	logrus.Infof("Rebuilt the owners of '%d' containers, '%d' volumes and '%d' networks", len(records), len(volumes.Volumes), len(networks))
+	return nil
+}
+
+// list decodes the docker daemon objects listed by the path
+func list(client *http.Client, path string, v interface{}) error {
+	res, err := client.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list %s: %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// rebuildRetry rebuilds the owners in the background, retrying until the docker daemon is reachable.
+// The docker daemon may be waiting for the authorization plugin to start.
+func (o *ownership) rebuildRetry(dockerSocket string) {
+	go func() {
+		for delay := time.Second; ; delay *= 2 {
+			err := o.rebuild(dockerSocket)
+			if err == nil {
+				return
+			}
+			if delay > time.Minute {
+				logrus.Errorf("Failed to rebuild the container owners %q", err.Error())
+				return
+			}
+			logrus.Warnf("Failed to rebuild the container owners (retrying in %s) %q", delay, err.Error())
+			time.Sleep(delay)
+		}
+	}()
+}
@@ -0,0 +1,232 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+const ownershipPolicy = `
+- name: students
+  actions:
+    - name: container_(create|start|delete|rename|logs)
+      owner: true
+    - name: container_exec_(create|start)
+      owner: true
+    - name: container_list
+    - name: container_prune
+      owner: true
+    - name: volume_(create|remove)
+      owner: true
+    - name: network_(create|connect|disconnect|remove)
+      owner: true
+`
+
+func TestOwnership(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFileName := filepath.Join(dir, "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(ownershipPolicy), 0644))
+	settings := &AnubisAuthorizerSettings{PolicyPath: policyFileName, StatePath: filepath.Join(dir, "state", "state.db")}
+	authorizer := NewAnubisAuthZAuthorizer(settings).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	authorizer.watcher.Close()
+
+	request := func(method, uri, user, body string) *authorization.Request {
+		return &authorization.Request{RequestMethod: method, RequestURI: uri, User: user, RequestBody: []byte(body)}
+	}
+	respond := func(req *authorization.Request, status int, body string) {
+		req.ResponseStatusCode = status
+		req.ResponseBody = []byte(body)
+		assert.True(t, authorizer.AuthZRes(req).Allow)
+	}
+
+	// Containers must be created with the owner label
+	create := request(http.MethodPost, "/v1.41/containers/create?name=web", "user_1", `{"Image":"alpine"}`)
+	res := authorizer.AuthZReq(create)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "label anubis.io/owner must be 'user_1'")
+	create.RequestBody = []byte(`{"Image":"alpine","Labels":{"anubis.io/owner":"user_2"}}`)
+	assert.False(t, authorizer.AuthZReq(create).Allow)
+	create.RequestBody = []byte(`{"Image":"alpine","Labels":{"anubis.io/owner":"user_1"}}`)
+	assert.True(t, authorizer.AuthZReq(create).Allow)
+	respond(create, http.StatusCreated, `{"Id":"4fa6e0f0c678","Warnings":[]}`)
+
+	tests := []struct {
+		method string
+		uri    string
+		user   string
+		allow  bool
+		msg    string
+	}{
+		{http.MethodPost, "/v1.41/containers/4fa6e0f0c678/start", "user_1", true, ""},
+		{http.MethodPost, "/v1.41/containers/web/start", "user_1", true, ""},         // By name
+		{http.MethodPost, "/v1.41/containers/4fa6/start", "user_1", true, ""},        // By ID prefix
+		{http.MethodGet, "/v1.41/containers/web/logs", "user_2", false, "not owned"}, // Other user
+		{http.MethodPost, "/v1.41/containers/other/start", "user_1", false, "container other is unknown"},
+		{http.MethodGet, "/v1.41/containers/json", "user_2", true, ""}, // No container targeted
+	}
+	for _, test := range tests {
+		res := authorizer.AuthZReq(request(test.method, test.uri, test.user, ""))
+		assert.Equal(t, test.allow, res.Allow, "%s %s (%s): %s", test.method, test.uri, test.user, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// Names are resolved before ID prefixes, including those of untracked containers
+	assert.NoError(t, authorizer.owners.store.putContainer(containerRecord{ID: "9b2c7e1d", Name: "4fa6"}))
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/4fa6/start", "user_1", ""))
+	assert.False(t, res.Allow, "The name of an untracked container must not resolve to an owned container ID prefix")
+	assert.Contains(t, res.Msg, "container 4fa6 is not owned by user")
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/4fa6e/start", "user_1", "")).Allow)
+
+	// The owner label is matched whatever the case of the body keys
+	create.RequestBody = []byte(`{"image":"alpine","labels":{"anubis.io/owner":"user_1"}}`)
+	assert.True(t, authorizer.AuthZReq(create).Allow)
+	create.RequestBody = []byte(`{"Image":"alpine","Labels":{"anubis.io/owner":"user_1"},"labels":{"anubis.io/owner":"user_2"}}`)
+	assert.False(t, authorizer.AuthZReq(create).Allow)
+
+	// Execs are owned by their creator
+	execCreate := request(http.MethodPost, "/v1.41/containers/web/exec", "user_1", `{"Cmd":["sh"]}`)
+	assert.True(t, authorizer.AuthZReq(execCreate).Allow)
+	respond(execCreate, http.StatusCreated, `{"Id":"e1"}`)
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/exec/e1/start", "user_1", `{}`)).Allow)
+	assert.False(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/exec/e1/start", "user_2", `{}`)).Allow)
+	assert.False(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/exec/e2/start", "user_1", `{}`)).Allow)
+
+	// Volumes are owned by their creator, and cannot be taken over by creating them again
+	volume := request(http.MethodPost, "/v1.41/volumes/create", "user_1", `{"Name":"data"}`)
+	assert.True(t, authorizer.AuthZReq(volume).Allow)
+	respond(volume, http.StatusCreated, `{"Name":"data"}`)
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/volumes/create", "user_2", `{"name":"data"}`))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "volume data is not owned by user")
+	assert.False(t, authorizer.AuthZReq(request(http.MethodDelete, "/v1.41/volumes/data", "user_2", "")).Allow)
+	res = authorizer.AuthZReq(request(http.MethodDelete, "/v1.41/volumes/other", "user_1", ""))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "volume other is unknown")
+	assert.True(t, authorizer.AuthZReq(request(http.MethodDelete, "/v1.41/volumes/data", "user_1", "")).Allow)
+
+	// Networks are owned by their creator, and only owned containers are (dis)connected
+	network := request(http.MethodPost, "/v1.41/networks/create", "user_1", `{"Name":"net"}`)
+	assert.True(t, authorizer.AuthZReq(network).Allow)
+	respond(network, http.StatusCreated, `{"Id":"8d3a51c7f0e2"}`)
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/networks/net/connect", "user_1", `{"container":"web"}`)).Allow)
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/networks/net/disconnect", "user_1", `{"Container":"other"}`))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "container other is unknown")
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/networks/net/connect", "user_2", `{"Container":"web"}`))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "network net is not owned by user")
+	assert.False(t, authorizer.AuthZReq(request(http.MethodDelete, "/v1.41/networks/8d3a", "user_2", "")).Allow)
+	assert.True(t, authorizer.AuthZReq(request(http.MethodDelete, "/v1.41/networks/8d3a", "user_1", "")).Allow, "By ID prefix")
+
+	// Actions targeting no owned object are denied
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/prune", "user_1", ""))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "action container_prune does not target an owned object")
+
+	// Renamed containers are tracked
+	rename := request(http.MethodPost, "/v1.41/containers/web/rename?name=api", "user_1", "")
+	assert.True(t, authorizer.AuthZReq(rename).Allow)
+	respond(rename, http.StatusNoContent, "")
+	assert.False(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/web/start", "user_1", "")).Allow)
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/api/start", "user_1", "")).Allow)
+
+	// Owners persist across restarts
+	assert.NoError(t, authorizer.owners.store.Close())
+	authorizer = NewAnubisAuthZAuthorizer(settings).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	authorizer.watcher.Close()
+	defer authorizer.owners.store.Close()
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/api/start", "user_1", "")).Allow)
+
+	// Removed containers and their execs are forgotten
+	remove := request(http.MethodDelete, "/v1.41/containers/api", "user_1", "")
+	assert.True(t, authorizer.AuthZReq(remove).Allow)
+	respond(remove, http.StatusNoContent, "")
+	assert.False(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/containers/4fa6e0f0c678/start", "user_1", "")).Allow)
+	assert.False(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/exec/e1/start", "user_1", `{}`)).Allow)
+
+	// Ownership checks are denied when tracking is disabled
+	disabled := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, disabled.Reload())
+	res = disabled.AuthZReq(request(http.MethodPost, "/v1.41/containers/web/start", "user_1", ""))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "ownership tracking is disabled")
+}
+
+func TestOwnershipRebuild(t *testing.T) {
+
+	dir := t.TempDir()
+	store, err := openStateStore(filepath.Join(dir, "state.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.putContainer(containerRecord{ID: "stale", Name: "stale", Owner: "user_1"}))
+	assert.NoError(t, store.putContainer(containerRecord{ID: "learned", Name: "old", Owner: "user_2"}))
+	assert.NoError(t, store.putObject(bucketVolumes, objectRecord{ID: "cache", Name: "cache", Owner: "user_2"}))
+	assert.NoError(t, store.putObject(bucketVolumes, objectRecord{ID: "stale", Name: "stale", Owner: "user_2"}))
+
+	// Fake docker daemon listing containers
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	docker := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			assert.Equal(t, "1", r.URL.Query().Get("all"))
+			w.Write([]byte(`[
+				{"Id":"labelled","Names":["/web"],"Labels":{"anubis.io/owner":"user_1"},"State":"running"},
+				{"Id":"learned","Names":["/new"],"Labels":{}},
+				{"Id":"unknown","Names":["/db"],"Labels":{}}
+			]`))
+		case "/volumes":
+			w.Write([]byte(`{"Volumes":[{"Name":"data","Labels":{"anubis.io/owner":"user_1"}},{"Name":"cache","Labels":null}]}`))
+		case "/networks":
+			w.Write([]byte(`[{"Id":"n1","Name":"bridge","Labels":{}}]`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	})}
+	go docker.Serve(listener)
+	defer docker.Close()
+
+	owners := &ownership{store: store, label: DefaultOwnerLabel, pending: newReservations()}
+	assert.NoError(t, owners.rebuild(socket))
+
+	// Untracked containers are never owned, even by users without name
+	check, msg := owners.checkOwner(&policyRequest{Request: &authorization.Request{}, route: core.Route{Params: map[string]string{core.ParamContainer: "db"}}})
+	assert.False(t, check)
+	assert.Contains(t, msg, "not owned")
+
+	record, err := store.container("web")
+	assert.NoError(t, err)
+	assert.Equal(t, &containerRecord{ID: "labelled", Name: "web", Owner: "user_1", Running: true}, record, "Labelled containers must be learned")
+	record, err = store.container("new")
+	assert.NoError(t, err)
+	assert.Equal(t, &containerRecord{ID: "learned", Name: "new", Owner: "user_2"}, record, "Learned owners must be kept")
+	for _, ref := range []string{"stale", "old"} {
+		record, err = store.container(ref)
+		assert.NoError(t, err)
+		assert.Nil(t, record, "Container %s must be unknown", ref)
+	}
+	record, err = store.container("db")
+	assert.NoError(t, err)
+	assert.Equal(t, &containerRecord{ID: "unknown", Name: "db"}, record, "Unlabelled containers must be recorded untracked")
+
+	count, err := store.countObjects(bucketVolumes, "user_1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "Labelled volumes must be learned")
+	count, err = store.countObjects(bucketVolumes, "user_2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "Learned volumes must be kept and stale volumes removed")
+	object, err := store.object(bucketNetworks, "bridge")
+	assert.NoError(t, err)
+	assert.Equal(t, &objectRecord{ID: "n1", Name: "bridge"}, object, "Unlabelled networks must be recorded untracked")
+}
@@ -0,0 +1,184 @@
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// Patch rewrites the body of requests matching an action. Since the docker authorization protocol
+// cannot mutate requests, patches are only applied when the broker runs as a proxy in front of the
+// docker daemon socket. String values may refer to the requesting user as ${user}.
+//
+//	patch:
+//	  set:
+//	    HostConfig:
+//	      Memory: 2147483648
+//	      PidsLimit: 512
+//	    Labels:
+//	      anubis.io/owner: ${user}
+//	  default:
+//	    HostConfig:
+//	      NanoCpus: 1000000000
+//	  append:
+//	    HostConfig:
+//	      SecurityOpt: ["no-new-privileges"]
+type Patch struct {
+	Set     map[string]interface{} `yaml:"set,omitempty"`     // Set overrides body keys, mappings are merged recursively
+	Default map[string]interface{} `yaml:"default,omitempty"` // Default sets body keys that are absent or empty
+	Append  map[string]interface{} `yaml:"append,omitempty"`  // Append adds the elements missing from body lists
+}
+
+// validate verifies the patch is well formed
+func (p *Patch) validate() error {
+	return validateAppend(p.Append, "")
+}
+
+// validateAppend verifies all the leaves of an append patch are lists
+func validateAppend(patch map[string]interface{}, chain string) error {
+	for k, v := range patch {
+		key := chain + "." + k
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := validateAppend(v, key); err != nil {
+				return err
+			}
+		case []interface{}:
+		default:
+			return fmt.Errorf("append key '%s' must be a list", key)
+		}
+	}
+	return nil
+}
+
+// apply applies the patch to the canonical body of the given type (nil if unknown) on behalf of the user.
+// The patch keys are resolved against the body keys like docker daemon decodes them (see canonicalKey),
+// such that a patched key never sits next to the same key with another case.
+func (p *Patch) apply(body map[string]interface{}, t reflect.Type, user string) {
+	applySet(body, p.Set, t, user, true)
+	applySet(body, p.Default, t, user, false)
+	applyAppend(body, p.Append, t, user)
+}
+
+// applySet sets the patch values in the body, merging mappings recursively. Unless override is set,
+// only absent or empty values are set.
+func applySet(body map[string]interface{}, patch map[string]interface{}, t reflect.Type, user string, override bool) {
+	for _, k := range sortedKeys(patch) {
+		v := patch[k]
+		key, vt := canonicalKey(body, k, t)
+		if nested, ok := v.(map[string]interface{}); ok {
+			bodyMap, ok := body[key].(map[string]interface{})
+			if !ok {
+				if !override && !isEmpty(body[key]) {
+					continue
+				}
+				bodyMap = make(map[string]interface{})
+				body[key] = bodyMap
+			}
+			applySet(bodyMap, nested, vt, user, override)
+			continue
+		}
+
+		if override || isEmpty(body[key]) {
+			body[key] = substitute(v, user)
+		}
+	}
+}
+
+// applyAppend appends the patch list elements missing from the body lists
+func applyAppend(body map[string]interface{}, patch map[string]interface{}, t reflect.Type, user string) {
+	for _, k := range sortedKeys(patch) {
+		key, vt := canonicalKey(body, k, t)
+		switch v := patch[k].(type) {
+		case map[string]interface{}:
+			bodyMap, ok := body[key].(map[string]interface{})
+			if !ok {
+				bodyMap = make(map[string]interface{})
+				body[key] = bodyMap
+			}
+			applyAppend(bodyMap, v, vt, user)
+		case []interface{}:
+			list, _ := body[key].([]interface{})
+			for _, e := range v {
+				e = substitute(e, user)
+				if !containsValue(list, e) {
+					list = append(list, e)
+				}
+			}
+			body[key] = list
+		}
+	}
+}
+
+// substitute replaces ${user} in string values with the requesting user
+func substitute(v interface{}, user string) interface{} {
+	if s, ok := v.(string); ok {
+		return strings.ReplaceAll(s, "${user}", user)
+	}
+	return v
+}
+
+// substituteAll replaces ${user} in the string values of nested mappings and lists
+func substituteAll(v interface{}, user string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = substituteAll(e, user)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = substituteAll(e, user)
+		}
+		return out
+	}
+	return substitute(v, user)
+}
+
+// MutateReq applies the patches of the actions matching the request, in policy order
+func (f *anubisAuthorizer) MutateReq(authZReq *authorization.Request) ([]byte, error) {
+	route, err := parseAction(authZReq)
+	if err != nil {
+		return nil, err
+	}
+
+	var patches []*Patch
+	now := f.now()
+	for _, policy := range f.policies() {
+		if !policy.appliesTo(authZReq.User) || !policy.activeAt(now) {
+			continue
+		}
+		for _, policyAction := range policy.Actions {
+			if policyAction.Patch != nil && policyAction.matches(route.Action) {
+				patches = append(patches, policyAction.Patch)
+			}
+		}
+	}
+
+	if len(patches) == 0 || len(authZReq.RequestBody) == 0 {
+		return authZReq.RequestBody, nil
+	}
+
+	// Decode numbers verbatim, such that unpatched values are forwarded unchanged. The keys are canonicalized,
+	// such that patched keys are not overridden by the same keys with another case.
+	body, err := decodeBody(route.Action, authZReq.RequestBody, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request body: %s", err.Error())
+	}
+	if body == nil {
+		body = make(map[string]interface{})
+	}
+
+	for _, patch := range patches {
+		patch.apply(body, bodyTypes[route.Action], authZReq.User)
+	}
+
+	logrus.Debugf("Patched action '%s' for user '%s'", route.Action, authZReq.User)
+	return json.Marshal(body)
+}
@@ -0,0 +1,130 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnubisPatch(t *testing.T) {
+
+	policy := `
+- name: policy_ide
+  users: ["student"]
+  actions:
+    - name: container_create
+      patch:
+        set:
+          HostConfig:
+            Memory: 2147483648
+            PidsLimit: 512
+          Labels:
+            anubis.io/owner: ${user}
+        default:
+          HostConfig:
+            NanoCpus: 1000000000
+        append:
+          HostConfig:
+            SecurityOpt: ["no-new-privileges"]
+      body:
+        HostConfig:
+          Memory: {max: 2Gi}
+    - name: container_start
+`
+
+	const policyFileName = "/tmp/anubis-policy-patch.yaml"
+	err := ioutil.WriteFile(policyFileName, []byte(policy), 0755)
+	assert.NoError(t, err)
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	mutator := authorizer.(*anubisAuthorizer)
+
+	req := &authorization.Request{
+		RequestMethod: http.MethodPost,
+		RequestURI:    "/v1.41/containers/create",
+		User:          "student",
+		RequestBody:   []byte(`{"Image":"alpine","Labels":{"course":"cs101"},"HostConfig":{"Memory":8589934592,"NanoCpus":500000000,"SecurityOpt":["label=disable"],"MemorySwap":-1}}`),
+	}
+	assert.False(t, authorizer.AuthZReq(req).Allow, "Unpatched request exceeds memory limit")
+
+	body, err := mutator.MutateReq(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"Image":"alpine",
+		"Labels":{"course":"cs101","anubis.io/owner":"student"},
+		"HostConfig":{"Memory":2147483648,"PidsLimit":512,"NanoCpus":500000000,"SecurityOpt":["label=disable","no-new-privileges"],"MemorySwap":-1}
+	}`, string(body))
+
+	req.RequestBody = body
+	assert.True(t, authorizer.AuthZReq(req).Allow, "Patched request must be allowed")
+
+	// Patching is idempotent
+	body, err = mutator.MutateReq(req)
+	assert.NoError(t, err)
+	var patched map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &patched))
+	assert.Equal(t, []interface{}{"label=disable", "no-new-privileges"}, patched["HostConfig"].(map[string]interface{})["SecurityOpt"])
+
+	// Keys with another case are merged into the patched keys, and duplicate keys are refused
+	req.RequestBody = []byte(`{"Image":"alpine","hostconfig":{"memory":8589934592,"privileged":false}}`)
+	body, err = mutator.MutateReq(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"Image":"alpine",
+		"Labels":{"anubis.io/owner":"student"},
+		"HostConfig":{"Memory":2147483648,"PidsLimit":512,"NanoCpus":1000000000,"SecurityOpt":["no-new-privileges"],"Privileged":false}
+	}`, string(body))
+
+	req.RequestBody = []byte(`{"Image":"alpine","HostConfig":{},"hostconfig":{"Memory":8589934592}}`)
+	_, err = mutator.MutateReq(req)
+	assert.Error(t, err)
+
+	// Requests without a matching patch are forwarded unchanged
+	req = &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/id/start", User: "student", RequestBody: []byte(`{ }`)}
+	body, err = mutator.MutateReq(req)
+	assert.NoError(t, err)
+	assert.Equal(t, `{ }`, string(body))
+
+	// Patches only apply to the users of the policy
+	req = &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "admin", RequestBody: []byte(`{"Image":"alpine"}`)}
+	body, err = mutator.MutateReq(req)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Image":"alpine"}`, string(body))
+}
+
+func TestPatchKeys(t *testing.T) {
+
+	patch := &Patch{
+		Set: map[string]interface{}{
+			"hostConfig": map[string]interface{}{"memory": 2147483648},
+			"labels":     map[string]interface{}{"anubis.io/owner": "${user}"},
+		},
+		Append: map[string]interface{}{"HOSTCONFIG": map[string]interface{}{"securityopt": []interface{}{"no-new-privileges"}}},
+	}
+
+	// Patch keys are resolved like docker daemon decodes them, while label keys are case-sensitive
+	body, err := decodeBody(core.ActionContainerCreate, []byte(`{"HostConfig":{"Memory":8589934592},"Labels":{"Anubis.io/Owner":"other"}}`), false)
+	assert.NoError(t, err)
+	patch.apply(body, bodyTypes[core.ActionContainerCreate], "student")
+	assert.Equal(t, map[string]interface{}{
+		"HostConfig": map[string]interface{}{"Memory": 2147483648, "SecurityOpt": []interface{}{"no-new-privileges"}},
+		"Labels":     map[string]interface{}{"Anubis.io/Owner": "other", "anubis.io/owner": "student"},
+	}, body)
+
+	// The keys of bodies of unknown type are matched case-insensitively
+	body = map[string]interface{}{"Name": "secret"}
+	(&Patch{Set: map[string]interface{}{"name": "${user}-secret"}}).apply(body, nil, "student")
+	assert.Equal(t, map[string]interface{}{"Name": "student-secret"}, body)
+}
+
+func TestPatchValidate(t *testing.T) {
+	_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_create","patch":{"append":{"HostConfig":{"SecurityOpt":"no-new-privileges"}}}}]}]`))
+	assert.Error(t, err, "Append values must be lists")
+}
@@ -0,0 +1,30 @@
+# Sample rego policy of the opa authorizer, evaluated for every docker request.
+# The input document holds the user, method, path, action, apiVersion, params,
+# query and (decoded) body of the request.
+package docker.authz
+
+import future.keywords.contains
+import future.keywords.if
+import future.keywords.in
+
+default allow := false
+
+# Read only actions are allowed for everyone
+allow if input.method == "GET"
+
+# Admins are allowed everything
+allow if input.user in admins
+
+# Users may create and run unprivileged containers
+allow if {
+	input.user != ""
+	startswith(input.action, "container_")
+}
+
+deny contains "privileged containers are not allowed" if {
+	input.action == "container_create"
+	input.body.HostConfig.Privileged
+	not input.user in admins
+}
+
+admins := {"admin"}
@@ -0,0 +1,98 @@
+package authz
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// validateQuery verifies the query matchers are well formed.
+//
+// For example, the following actions deny force removal of containers and only allow
+// pulling images from the anubis registry (query values are always strings):
+//
+//	actions:
+//	  - name: container_delete
+//	    query:
+//	      force: {forbidden: true}
+//	  - name: image_create
+//	    query:
+//	      fromImage: {required: true, prefix: "registry.anubis-lms.io/"}
+func validateQuery(matchers map[string]*Matcher) error {
+	for k, matcher := range matchers {
+		if matcher == nil {
+			return fmt.Errorf("query parameter '%s' has an empty matcher", k)
+		}
+		if err := matcher.validate(); err != nil {
+			return fmt.Errorf("query parameter '%s': %s", k, err.Error())
+		}
+	}
+	return nil
+}
+
+// CheckQuery checks the request query parameters against the policy query matchers. When a parameter
+// is repeated (e.g. the t parameter of image_build), every value must satisfy the matcher.
+// On failure the returned message names the offending parameter, the parameters being checked in sorted order.
+func CheckQuery(query url.Values, matchers map[string]*Matcher) (bool, string) {
+	for _, k := range sortedKeys(matchers) {
+		matcher := matchers[k]
+		values, ok := query[k]
+
+		if !ok || len(values) == 0 {
+			if matcher.Required {
+				logrus.Errorf("Failing on missing query parameter %s", k)
+				return false, fmt.Sprintf("%s is required", k)
+			}
+			continue
+		}
+
+		for _, v := range values {
+			if matcher.Forbidden {
+				if queryBool(v) {
+					logrus.Errorf("Failing on forbidden query parameter %s=%s", k, v)
+					return false, fmt.Sprintf("%s=%s is forbidden", k, v)
+				}
+				continue
+			}
+
+			check, reason := matcher.matchValue(v)
+			if !check {
+				logrus.Errorf("Failing on query parameter not matching %s: %s", k, reason)
+				return false, fmt.Sprintf("%s: %s", k, reason)
+			}
+		}
+	}
+	return true, ""
+}
+
+// matchQuery returns true if the request query matches the query of a deny action. Unlike CheckQuery,
+// the parameters absent from the request do not match.
+func matchQuery(query url.Values, matchers map[string]*Matcher) bool {
+	for _, k := range sortedKeys(matchers) {
+		matcher := matchers[k]
+		values := query[k]
+		if len(values) == 0 {
+			return false
+		}
+		for _, v := range values {
+			if matcher.Forbidden {
+				if queryBool(v) {
+					return false
+				}
+				continue
+			}
+			if check, _ := matcher.matchValue(v); !check {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryBool converts a query parameter to a boolean the same way the docker daemon does
+func queryBool(v string) bool {
+	v = strings.ToLower(strings.TrimSpace(v))
+	return !(v == "" || v == "0" || v == "no" || v == "false" || v == "none")
+}
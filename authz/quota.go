@@ -0,0 +1,358 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// Quota limits the resources owned by each user a policy applies to. The usage of a user is accounted
+// in the state store from the daemon responses, and the quota is enforced when the resources are created
+// (and when containers are started or updated). The usage requested by the requests in flight is reserved until
+// their responses are learned. Running containers are only accounted from the requests changing their state, such
+// that a container exiting on its own is counted until it is stopped, killed, waited or removed. Zero values are
+// unlimited.
+type Quota struct {
+	Containers int         `yaml:"containers,omitempty"` // Containers is the maximum number of running containers
+	Memory     interface{} `yaml:"memory,omitempty"`     // Memory is the maximum total memory limit of the containers (e.g. 4Gi)
+	NanoCpus   interface{} `yaml:"nanoCpus,omitempty"`   // NanoCpus is the maximum total CPU quota of the containers (in 10^-9 CPUs, e.g. 2G)
+	Volumes    int         `yaml:"volumes,omitempty"`    // Volumes is the maximum number of volumes
+	Networks   int         `yaml:"networks,omitempty"`   // Networks is the maximum number of networks
+
+	memory   int64 // memory is the parsed memory limit
+	nanoCpus int64 // nanoCpus is the parsed CPU limit
+}
+
+// validate parses the quantities of the quota
+func (q *Quota) validate() error {
+	if q.Containers < 0 || q.Volumes < 0 || q.Networks < 0 {
+		return fmt.Errorf("quota limits must not be negative")
+	}
+
+	for _, limit := range []struct {
+		name   string
+		value  interface{}
+		parsed *int64
+	}{{"memory", q.Memory, &q.memory}, {"nanoCpus", q.NanoCpus, &q.nanoCpus}} {
+		if limit.value == nil {
+			*limit.parsed = 0
+			continue
+		}
+		n, err := toNumber(limit.value)
+		if err != nil {
+			return fmt.Errorf("invalid quota %s: %s", limit.name, err.Error())
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid quota %s: %v must not be negative", limit.name, limit.value)
+		}
+		*limit.parsed = int64(n)
+	}
+	return nil
+}
+
+// findQuota returns the quota of the first policy applying to the user (at the given time) that defines one, nil if none
+func findQuota(policies []AnubisPolicy, user string, now time.Time) (*Quota, *AnubisPolicy) {
+	for i := range policies {
+		if policies[i].Quota != nil && policies[i].appliesTo(user) && policies[i].activeAt(now) {
+			return policies[i].Quota, &policies[i]
+		}
+	}
+	return nil, nil
+}
+
+// checkQuota checks the resources requested by an allowed request against the quota of the user, accounting
+// the usage reserved by the requests of the user in flight. Unless dry-run, the usage requested is reserved
+// until the response is learned (see ownership.settle).
+func (f *anubisAuthorizer) checkQuota(req *policyRequest, dryRun bool) (bool, string) {
+	quota, policy := findQuota(f.policies(), req.User, req.now)
+	if quota == nil {
+		return true, ""
+	}
+
+	// Quota checks are serialized with the reservations and the learning of the usage, such that
+	// concurrent requests of the user account each other
+	var reserved quotaUsage
+	if req.owners != nil {
+		req.owners.pending.lock.Lock()
+		defer req.owners.pending.lock.Unlock()
+		reserved = req.owners.pending.reserved(req.User, req.now)
+	}
+
+	check, reason, requested := quota.check(req, reserved)
+	if !check {
+		return false, fmt.Sprintf("action '%s' denied for user '%s' by quota of policy '%s' %s", req.action, req.User, policy.Name, reason)
+	}
+	if !dryRun && req.owners != nil && requested != (quotaUsage{}) {
+		req.owners.pending.reserve(requestKey(req.Request), req.User, requested, req.now)
+	}
+	return true, ""
+}
+
+// check checks the request against the quota, given the usage reserved by the requests of the user in flight.
+// It returns the reason of the denial, reporting the current usage of the user against the limit, or the
+// usage requested.
+func (q *Quota) check(req *policyRequest, reserved quotaUsage) (bool, string, quotaUsage) {
+	switch req.route.Action {
+	case core.ActionContainerCreate, core.ActionContainerUpdate:
+		if q.memory == 0 && q.nanoCpus == 0 {
+			return true, "", quotaUsage{}
+		}
+		return q.checkResources(req, reserved)
+
+	case core.ActionContainerStart, core.ActionContainerRestart:
+		if q.Containers == 0 {
+			return true, "", quotaUsage{}
+		}
+		return q.checkRunning(req, reserved)
+
+	case core.ActionVolumeCreate:
+		check, reason := checkCount(req, bucketVolumes, "volumes", reserved.volumes, q.Volumes)
+		return check, reason, quotaUsage{volumes: 1}
+
+	case core.ActionNetworkCreate:
+		check, reason := checkCount(req, bucketNetworks, "networks", reserved.networks, q.Networks)
+		return check, reason, quotaUsage{networks: 1}
+	}
+	return true, "", quotaUsage{}
+}
+
+// checkResources checks the memory and CPU limits requested by container_create and container_update
+// requests. Containers must set a limit on the resources having a quota.
+func (q *Quota) checkResources(req *policyRequest, reserved quotaUsage) (bool, string, quotaUsage) {
+	if req.owners == nil {
+		return false, "on quota accounting is disabled", quotaUsage{}
+	}
+	if req.bodyErr != nil {
+		return false, "on invalid body", quotaUsage{}
+	}
+
+	// Containers are created with the host config resources, and updated with the top level resources
+	var current containerRecord
+	resources := req.body
+	if req.route.Action == core.ActionContainerCreate {
+		resources, _ = req.body["HostConfig"].(map[string]interface{})
+	} else {
+		ref := req.route.Params[core.ParamContainer]
+		record, err := req.owners.store.container(ref)
+		if err != nil {
+			logrus.Errorf("Failed to lookup container %q error %q", ref, err.Error())
+			return false, fmt.Sprintf("on quota container %s lookup failed", ref), quotaUsage{}
+		}
+		if record == nil {
+			return false, fmt.Sprintf("on quota container %s is unknown", ref), quotaUsage{}
+		}
+		current = *record
+	}
+
+	memory, nanoCpus := current.Memory, current.NanoCpus
+	if value, ok := resourceValue(resources, "Memory"); ok {
+		memory = value
+	}
+	if value, ok := resourceValue(resources, "NanoCpus"); ok {
+		nanoCpus = value
+	}
+
+	containers, err := req.owners.store.ownedContainers(req.User)
+	if err != nil {
+		logrus.Errorf("Failed to account containers of %q error %q", req.User, err.Error())
+		return false, "on quota accounting failed", quotaUsage{}
+	}
+	usedMemory, usedNanoCpus := reserved.memory, reserved.nanoCpus
+	for _, container := range containers {
+		if container.ID != current.ID {
+			usedMemory += container.Memory
+			usedNanoCpus += container.NanoCpus
+		}
+	}
+
+	if check, reason := checkResource("memory", usedMemory, memory, q.memory); !check {
+		return false, reason, quotaUsage{}
+	}
+	if check, reason := checkResource("nanoCpus", usedNanoCpus, nanoCpus, q.nanoCpus); !check {
+		return false, reason, quotaUsage{}
+	}
+	// The resources of an updated container are accounted in the store, only their increase is reserved
+	return true, "", quotaUsage{memory: max64(memory-current.Memory, 0), nanoCpus: max64(nanoCpus-current.NanoCpus, 0)}
+}
+
+// max64 returns the largest of the integers
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// checkResource checks the requested amount of a resource fits in the limit of the quota
+func checkResource(name string, usage, requested, limit int64) (bool, string) {
+	if limit == 0 {
+		return true, ""
+	}
+	if requested <= 0 {
+		return false, fmt.Sprintf("on quota %s (limit required, usage: %d, limit: %d)", name, usage, limit)
+	}
+	if usage+requested > limit {
+		return false, fmt.Sprintf("on quota %s (usage: %d, requested: %d, limit: %d)", name, usage, requested, limit)
+	}
+	return true, ""
+}
+
+// checkRunning checks the number of running containers when a container is started
+func (q *Quota) checkRunning(req *policyRequest, reserved quotaUsage) (bool, string, quotaUsage) {
+	if req.owners == nil {
+		return false, "on quota accounting is disabled", quotaUsage{}
+	}
+	containers, err := req.owners.store.ownedContainers(req.User)
+	if err != nil {
+		logrus.Errorf("Failed to account containers of %q error %q", req.User, err.Error())
+		return false, "on quota accounting failed", quotaUsage{}
+	}
+
+	// Restarting a running container does not change the usage
+	ref := req.route.Params[core.ParamContainer]
+	target, err := req.owners.store.container(ref)
+	if err != nil {
+		logrus.Errorf("Failed to lookup container %q error %q", ref, err.Error())
+		return false, fmt.Sprintf("on quota container %s lookup failed", ref), quotaUsage{}
+	}
+	if target != nil && target.Running {
+		return true, "", quotaUsage{}
+	}
+
+	running := reserved.containers
+	for _, container := range containers {
+		if container.Running {
+			running++
+		}
+	}
+	if running+1 > q.Containers {
+		return false, fmt.Sprintf("on quota containers (usage: %d, limit: %d)", running, q.Containers), quotaUsage{}
+	}
+	return true, "", quotaUsage{containers: 1}
+}
+
+// checkCount checks the number of volumes or networks owned (or reserved) by the user when one is created
+func checkCount(req *policyRequest, bucket []byte, name string, reserved, limit int) (bool, string) {
+	if limit == 0 {
+		return true, ""
+	}
+	if req.owners == nil {
+		return false, "on quota accounting is disabled"
+	}
+	count, err := req.owners.store.countObjects(bucket, req.User)
+	if err != nil {
+		logrus.Errorf("Failed to account %s of %q error %q", name, req.User, err.Error())
+		return false, "on quota accounting failed"
+	}
+	count += reserved
+	if count+1 > limit {
+		return false, fmt.Sprintf("on quota %s (usage: %d, limit: %d)", name, count, limit)
+	}
+	return true, ""
+}
+
+// resourceValue returns the integer resource of the request body, if set
+func resourceValue(resources map[string]interface{}, key string) (int64, bool) {
+	value, ok := resources[key]
+	if !ok || value == nil {
+		return 0, false
+	}
+	n, ok := numberValue(value)
+	if !ok {
+		return 0, false
+	}
+	return int64(n), true
+}
+
+// reservationTTL is the delay after which the usage reserved by a request is released if its response is
+// never learned (e.g. the request was denied by another authorization plugin, or the daemon was unreachable)
+const reservationTTL = time.Minute
+
+// quotaUsage is an amount of the resources accounted by the quotas
+type quotaUsage struct {
+	containers int   // containers is the number of running containers
+	memory     int64 // memory is the total memory limit of the containers
+	nanoCpus   int64 // nanoCpus is the total CPU quota of the containers
+	volumes    int   // volumes is the number of volumes
+	networks   int   // networks is the number of networks
+}
+
+// reservation is the usage reserved by a request allowed by a quota
+type reservation struct {
+	user    string     // user is the requesting user
+	usage   quotaUsage // usage is the usage reserved
+	expires time.Time  // expires is the time the reservation is released if the response is not learned
+}
+
+// reservations holds the usage reserved by the requests allowed by the quotas until their responses are learned.
+// Since the usage is learned from the daemon responses, the requests in flight reserve their usage such that the
+// concurrent requests of a user cannot exceed its quota. The lock serializes the quota checks, the reservations
+// and the learning of the usage.
+type reservations struct {
+	lock     sync.Mutex
+	requests map[string][]reservation // requests maps a request key to the reservations of the identical requests in flight
+}
+
+// newReservations creates the reservations of the requests in flight
+func newReservations() *reservations {
+	return &reservations{requests: make(map[string][]reservation)}
+}
+
+// requestKey identifies a request across its authorization and response phases
+func requestKey(authZReq *authorization.Request) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00", authZReq.User, authZReq.RequestMethod, authZReq.RequestURI)
+	hash.Write(authZReq.RequestBody)
+	return string(hash.Sum(nil))
+}
+
+// reserved returns the usage reserved by the requests of the user in flight at the given time
+func (r *reservations) reserved(user string, now time.Time) quotaUsage {
+	var total quotaUsage
+	for _, reservations := range r.requests {
+		for _, reservation := range reservations {
+			if reservation.user != user || !now.Before(reservation.expires) {
+				continue
+			}
+			total.containers += reservation.usage.containers
+			total.memory += reservation.usage.memory
+			total.nanoCpus += reservation.usage.nanoCpus
+			total.volumes += reservation.usage.volumes
+			total.networks += reservation.usage.networks
+		}
+	}
+	return total
+}
+
+// reserve reserves the usage of the request, and releases the expired reservations
+func (r *reservations) reserve(key, user string, usage quotaUsage, now time.Time) {
+	for k, reservations := range r.requests {
+		live := reservations[:0]
+		for _, reservation := range reservations {
+			if now.Before(reservation.expires) {
+				live = append(live, reservation)
+			}
+		}
+		if len(live) == 0 {
+			delete(r.requests, k)
+		} else {
+			r.requests[k] = live
+		}
+	}
+	r.requests[key] = append(r.requests[key], reservation{user: user, usage: usage, expires: now.Add(reservationTTL)})
+}
+
+// release releases the oldest usage reserved by the request, if any
+func (r *reservations) release(key string) {
+	if reservations := r.requests[key]; len(reservations) > 1 {
+		r.requests[key] = reservations[1:]
+	} else {
+		delete(r.requests, key)
+	}
+}
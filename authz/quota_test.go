@@ -0,0 +1,189 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+const quotaPolicy = `
+- name: students
+  users: ["user_1", "user_2"]
+  quota:
+    containers: 1
+    memory: 1Gi
+    nanoCpus: 1G
+    volumes: 1
+    networks: 1
+  actions:
+    - name: .*
+- name: staff
+  actions:
+    - name: .*
+`
+
+func TestQuota(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFileName := filepath.Join(dir, "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(quotaPolicy), 0644))
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName, StatePath: filepath.Join(dir, "state.db")}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	authorizer.watcher.Close()
+	defer authorizer.owners.store.Close()
+
+	request := func(method, uri, user, body string) *authorization.Request {
+		return &authorization.Request{RequestMethod: method, RequestURI: uri, User: user, RequestBody: []byte(body)}
+	}
+	// do authorizes the request, and responds with the given status and body if allowed
+	do := func(req *authorization.Request, status int, body string) *authorization.Response {
+		res := authorizer.AuthZReq(req)
+		if res.Allow {
+			req.ResponseStatusCode = status
+			req.ResponseBody = []byte(body)
+			assert.True(t, authorizer.AuthZRes(req).Allow)
+		}
+		return res
+	}
+	create := func(user, id, body string) *authorization.Response {
+		return do(request(http.MethodPost, "/v1.41/containers/create", user, body), http.StatusCreated, `{"Id":"`+id+`"}`)
+	}
+
+	// Containers must set the resources having a quota
+	res := create("user_1", "c1", `{"Image":"alpine"}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "by quota of policy 'students' on quota memory (limit required, usage: 0, limit: 1073741824)")
+	res = create("user_1", "c1", `{"Image":"alpine","HostConfig":{"Memory":536870912}}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota nanoCpus (limit required")
+
+	// Resources are accounted across the containers of the user
+	assert.True(t, create("user_1", "c1", `{"Image":"alpine","HostConfig":{"Memory":536870912,"NanoCpus":500000000}}`).Allow)
+	res = create("user_1", "c2", `{"Image":"alpine","HostConfig":{"Memory":1073741824,"NanoCpus":500000000}}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota memory (usage: 536870912, requested: 1073741824, limit: 1073741824)")
+	res = create("user_1", "c2", `{"Image":"alpine","HostConfig":{"Memory":1,"NanoCpus":1},"hostconfig":{"Memory":68719476736}}`)
+	assert.False(t, res.Allow, "Duplicate resources must be denied")
+	assert.Contains(t, res.Msg, "on invalid body")
+	assert.True(t, create("user_1", "c2", `{"image":"alpine","hostconfig":{"memory":536870912,"nanocpus":500000000}}`).Allow)
+	assert.True(t, create("user_2", "c3", `{"Image":"alpine","HostConfig":{"Memory":536870912,"NanoCpus":500000000}}`).Allow, "Quotas must be per user")
+	assert.True(t, create("admin", "c4", `{"Image":"alpine"}`).Allow, "Policies without quota must be unlimited")
+
+	// Resources are accounted whatever the case of the body keys
+	res = create("user_1", "c5", `{"Image":"alpine","HostConfig":{"Memory":1,"NanoCpus":1}}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota memory (usage: 1073741824, requested: 1, limit: 1073741824)")
+
+	// Updates replace the resources of the container
+	res = do(request(http.MethodPost, "/v1.41/containers/c1/update", "user_1", `{"NanoCpus":1000000000}`), http.StatusOK, `{}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota nanoCpus (usage: 500000000, requested: 1000000000, limit: 1000000000)")
+	assert.True(t, do(request(http.MethodPost, "/v1.41/containers/c1/update", "user_1", `{"NanoCpus":250000000}`), http.StatusOK, `{}`).Allow)
+	res = create("user_1", "c5", `{"Image":"alpine","HostConfig":{"Memory":1,"NanoCpus":500000000}}`)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota memory (usage: 1073741824, requested: 1, limit: 1073741824)")
+
+	// Running containers are limited
+	start := func(ref string) *authorization.Response {
+		return do(request(http.MethodPost, "/v1.41/containers/"+ref+"/start", "user_1", ""), http.StatusNoContent, "")
+	}
+	assert.True(t, start("c1").Allow)
+	assert.True(t, start("c1").Allow, "Starting a running container must be allowed")
+	res = start("c2")
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota containers (usage: 1, limit: 1)")
+	assert.True(t, do(request(http.MethodPost, "/v1.41/containers/c1/stop", "user_1", ""), http.StatusNoContent, "").Allow)
+	assert.True(t, start("c2").Allow)
+
+	// Removed containers release their resources
+	assert.True(t, do(request(http.MethodDelete, "/v1.41/containers/c1", "user_1", ""), http.StatusNoContent, "").Allow)
+	assert.True(t, create("user_1", "c6", `{"Image":"alpine","HostConfig":{"Memory":536870912,"NanoCpus":500000000}}`).Allow)
+
+	// Volumes and networks are counted
+	volume := func() *authorization.Response {
+		return do(request(http.MethodPost, "/v1.41/volumes/create", "user_1", `{"Name":"data"}`), http.StatusCreated, `{"Name":"data"}`)
+	}
+	assert.True(t, volume().Allow)
+	res = volume()
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota volumes (usage: 1, limit: 1)")
+	assert.True(t, do(request(http.MethodDelete, "/v1.41/volumes/data", "user_1", ""), http.StatusNoContent, "").Allow)
+	assert.True(t, volume().Allow)
+
+	network := func() *authorization.Response {
+		return do(request(http.MethodPost, "/v1.41/networks/create", "user_1", `{"Name":"net"}`), http.StatusCreated, `{"Id":"n1"}`)
+	}
+	assert.True(t, network().Allow)
+	res = network()
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota networks (usage: 1, limit: 1)")
+	assert.True(t, do(request(http.MethodDelete, "/v1.41/networks/net", "user_1", ""), http.StatusNoContent, "").Allow)
+	assert.True(t, network().Allow)
+
+	// Quotas are denied when accounting is disabled
+	disabled := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, disabled.Reload())
+	res = disabled.AuthZReq(request(http.MethodPost, "/v1.41/volumes/create", "user_1", `{"Name":"data"}`))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "quota accounting is disabled")
+	assert.True(t, disabled.AuthZReq(request(http.MethodGet, "/v1.41/containers/json", "user_1", "")).Allow)
+
+	// Invalid quotas are refused
+	_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","quota":{"memory":"lots"},"actions":[{"name":".*"}]}]`))
+	assert.Error(t, err)
+	_, err = parseAnubisPolicies([]byte(`[{"name":"policy_1","quota":{"volumes":-1},"actions":[{"name":".*"}]}]`))
+	assert.Error(t, err)
+}
+
+func TestQuotaReservations(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFileName := filepath.Join(dir, "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(quotaPolicy), 0644))
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName, StatePath: filepath.Join(dir, "state.db")}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	authorizer.watcher.Close()
+	defer authorizer.owners.store.Close()
+	clock := &fakeClock{current: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	authorizer.now = clock.now
+
+	request := func(method, uri, body string) *authorization.Request {
+		return &authorization.Request{RequestMethod: method, RequestURI: uri, User: "user_1", RequestBody: []byte(body)}
+	}
+	create := func(body string) *authorization.Request {
+		return request(http.MethodPost, "/v1.41/containers/create", body)
+	}
+
+	// Concurrent requests account the usage reserved by the requests in flight
+	first := create(`{"Image":"alpine","HostConfig":{"Memory":536870912,"NanoCpus":500000000}}`)
+	assert.True(t, authorizer.AuthZReq(first).Allow)
+	second := create(`{"Image":"alpine","HostConfig":{"Memory":1073741824,"NanoCpus":500000000}}`)
+	res := authorizer.AuthZReq(second)
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota memory (usage: 536870912, requested: 1073741824, limit: 1073741824)")
+	assert.False(t, authorizer.Explain(second).(*Explanation).Allow, "Explanations must account the reservations")
+
+	// Failed responses release the usage reserved
+	first.ResponseStatusCode = http.StatusInternalServerError
+	assert.True(t, authorizer.AuthZRes(first).Allow)
+	assert.True(t, authorizer.AuthZReq(second).Allow)
+	second.ResponseStatusCode, second.ResponseBody = http.StatusCreated, []byte(`{"Id":"c1"}`)
+	assert.True(t, authorizer.AuthZRes(second).Allow)
+	res = authorizer.AuthZReq(first)
+	assert.False(t, res.Allow, "Learned usage must be accounted once the reservation is released")
+	assert.Contains(t, res.Msg, "on quota memory (usage: 1073741824, requested: 536870912, limit: 1073741824)")
+
+	// Reservations of responses never learned expire
+	volume := request(http.MethodPost, "/v1.41/volumes/create", `{"Name":"data"}`)
+	assert.True(t, authorizer.AuthZReq(volume).Allow)
+	res = authorizer.AuthZReq(request(http.MethodPost, "/v1.41/volumes/create", `{"Name":"other"}`))
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "on quota volumes (usage: 1, limit: 1)")
+	clock.advance(reservationTTL)
+	assert.True(t, authorizer.AuthZReq(request(http.MethodPost, "/v1.41/volumes/create", `{"Name":"other"}`)).Allow)
+}
@@ -0,0 +1,175 @@
+package authz
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Rate limit scopes
+const (
+	// ScopeUser limits the requests of each user separately (default)
+	ScopeUser = "user"
+	// ScopeGlobal limits the requests of all the users of the policy together
+	ScopeGlobal = "global"
+)
+
+// RateLimit limits the rate of the requests matching the action with a token bucket: the bucket holds up
+// to burst tokens, refilled at rate tokens per period, and each request takes a token. Requests are denied
+// while the bucket is empty.
+type RateLimit struct {
+	Action string        `yaml:"action,omitempty"` // Action is the docker action limited (regular expression, every action if empty)
+	Rate   float64       `yaml:"rate"`             // Rate is the number of requests allowed per period
+	Per    time.Duration `yaml:"per,omitempty"`    // Per is the period of the rate (defaults to one second)
+	Burst  int           `yaml:"burst,omitempty"`  // Burst is the number of requests allowed at once (defaults to the rate)
+	Scope  string        `yaml:"scope,omitempty"`  // Scope is the scope of the limit, either user (default) or global
+
+	actionRe *regexp.Regexp // actionRe is the compiled action
+}
+
+// compile compiles the action and validates the limit
+func (r *RateLimit) compile() error {
+	var err error
+	if r.actionRe, err = regexp.Compile(r.Action); err != nil {
+		return fmt.Errorf("invalid rate limit action: %s", err.Error())
+	}
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate limit '%s' must have a positive rate", r.Action)
+	}
+	if r.Per < 0 || r.Burst < 0 {
+		return fmt.Errorf("rate limit '%s' must not have a negative period or burst", r.Action)
+	}
+	if r.Scope != "" && r.Scope != ScopeUser && r.Scope != ScopeGlobal {
+		return fmt.Errorf("unknown rate limit scope '%s' (expected %s or %s)", r.Scope, ScopeUser, ScopeGlobal)
+	}
+	return nil
+}
+
+// period returns the period of the rate
+func (r *RateLimit) period() time.Duration {
+	if r.Per == 0 {
+		return time.Second
+	}
+	return r.Per
+}
+
+// capacity returns the capacity of the bucket
+func (r *RateLimit) capacity() float64 {
+	if r.Burst == 0 {
+		return math.Max(1, math.Floor(r.Rate))
+	}
+	return float64(r.Burst)
+}
+
+// String describes the limit
+func (r *RateLimit) String() string {
+	return fmt.Sprintf("%g per %s", r.Rate, r.period())
+}
+
+// pruneInterval is the minimum delay between the prunings of the buckets
+const pruneInterval = time.Minute
+
+// tokenBucket is the state of a rate limit
+type tokenBucket struct {
+	tokens  float64   // tokens are the tokens left at the last update
+	updated time.Time // updated is the time of the last update
+	full    time.Time // full is the time the bucket is refilled to its capacity
+}
+
+// take updates the bucket at the given time, taking the given tokens
+func (b *tokenBucket) take(limit *RateLimit, tokens float64, now time.Time) {
+	b.tokens -= tokens
+	b.updated = now
+	refill := (limit.capacity() - b.tokens) * float64(limit.period()) / limit.Rate
+	b.full = now.Add(time.Duration(math.Ceil(refill)))
+}
+
+// rateLimiter holds the token buckets of the rate limits of the policies
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket // buckets maps a limit (and user, unless global) to its bucket
+	pruned  time.Time               // pruned is the time of the last pruning of the buckets
+}
+
+// newRateLimiter creates a rate limiter
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the buckets of every rate limit of the policies applying to the user and
+// matching the action at the given time. If any bucket is empty, no token is taken and the request is
+// denied, with the delay after which the request would be allowed.
+func (l *rateLimiter) allow(policies []AnubisPolicy, user, action string, now time.Time) (bool, string) {
+	type limited struct {
+		policy *AnubisPolicy
+		limit  *RateLimit
+		bucket *tokenBucket
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+
+	var limits []limited
+	for i := range policies {
+		policy := &policies[i]
+		if len(policy.RateLimits) == 0 || !policy.appliesTo(user) || !policy.activeAt(now) {
+			continue
+		}
+		for j := range policy.RateLimits {
+			limit := &policy.RateLimits[j]
+			if !limit.actionRe.MatchString(action) {
+				continue
+			}
+
+			// Buckets are keyed by the limit definition, such that they survive the reloads leaving it unchanged
+			key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%s", policy.Name, limit.Action, limit, limit.Burst, limit.Scope)
+			if limit.Scope != ScopeGlobal {
+				key += "\x00" + user
+			}
+			bucket, ok := l.buckets[key]
+			if !ok {
+				bucket = &tokenBucket{tokens: limit.capacity(), updated: now}
+				l.buckets[key] = bucket
+			}
+
+			// Refill the bucket
+			if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+				bucket.tokens = math.Min(limit.capacity(), bucket.tokens+elapsed.Seconds()*limit.Rate/limit.period().Seconds())
+				bucket.take(limit, 0, now)
+			}
+			limits = append(limits, limited{policy: policy, limit: limit, bucket: bucket})
+		}
+	}
+
+	for _, match := range limits {
+		if match.bucket.tokens < 1 {
+			// Time until the bucket holds a token, rounded up to the millisecond
+			wait := (1 - match.bucket.tokens) * float64(match.limit.period()) / match.limit.Rate
+			retry := time.Duration(math.Ceil(wait/float64(time.Millisecond))) * time.Millisecond
+			return false, fmt.Sprintf("action '%s' denied for user '%s' by rate limit of policy '%s' (%s), retry after %s",
+				action, user, match.policy.Name, match.limit, retry)
+		}
+	}
+	for _, match := range limits {
+		match.bucket.take(match.limit, 1, now)
+	}
+	return true, ""
+}
+
+// prune removes the buckets refilled to their capacity, which are identical to the buckets created on demand. Since
+// the buckets of the users idle, and of the limits removed or changed by a reload, are eventually full, the buckets
+// do not accumulate.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < pruneInterval {
+		return
+	}
+	l.pruned = now
+	for key, bucket := range l.buckets {
+		if !now.Before(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
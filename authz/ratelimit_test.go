@@ -0,0 +1,123 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.current }
+
+func (c *fakeClock) advance(d time.Duration) { c.current = c.current.Add(d) }
+
+func TestRateLimit(t *testing.T) {
+
+	policy := `
+- name: students
+  users: ["user_1", "user_2"]
+  rateLimits:
+    - action: container_create
+      rate: 5
+      per: 1m
+  actions:
+    - name: container_create
+      effect: deny
+      body:
+        HostConfig:
+          Privileged: true
+    - name: .*
+- name: everyone
+  rateLimits:
+    - action: container_inspect
+      rate: 2
+      scope: global
+  actions:
+    - name: .*
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+	clock := &fakeClock{current: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	authorizer.now = clock.now
+
+	requestBody := func(method, uri, user, body string) *authorization.Response {
+		return authorizer.AuthZReq(&authorization.Request{RequestMethod: method, RequestURI: uri, User: user, RequestBody: []byte(body)})
+	}
+	request := func(method, uri, user string) *authorization.Response {
+		return requestBody(method, uri, user, `{}`)
+	}
+	create := func(user string) *authorization.Response {
+		return request(http.MethodPost, "/v1.41/containers/create", user)
+	}
+	inspect := func(user string) *authorization.Response {
+		return request(http.MethodGet, "/v1.41/containers/id/json", user)
+	}
+
+	// Denied requests do not take a token
+	for i := 0; i < 10; i++ {
+		res := requestBody(http.MethodPost, "/v1.41/containers/create", "user_1", `{"HostConfig":{"Privileged":true}}`)
+		assert.False(t, res.Allow)
+		assert.Contains(t, res.Msg, "by deny rule of policy 'students'")
+	}
+
+	// The bucket allows a burst of 5 requests per user
+	for i := 0; i < 5; i++ {
+		assert.True(t, create("user_1").Allow, "Request %d must be allowed", i)
+	}
+	res := create("user_1")
+	assert.False(t, res.Allow)
+	assert.Equal(t, "action 'container_create' denied for user 'user_1' by rate limit of policy 'students' (5 per 1m0s), retry after 12s", res.Msg)
+	assert.True(t, create("user_2").Allow, "Limits must be per user")
+	assert.True(t, request(http.MethodGet, "/v1.41/containers/json", "user_1").Allow, "Other actions must not be limited")
+
+	// Tokens are refilled over time
+	clock.advance(6 * time.Second)
+	res = create("user_1")
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "retry after 6s")
+	clock.advance(6 * time.Second)
+	assert.True(t, create("user_1").Allow)
+	assert.False(t, create("user_1").Allow)
+
+	// Global limits are shared by all the users
+	assert.True(t, inspect("user_1").Allow)
+	assert.True(t, inspect("user_2").Allow)
+	res = inspect("admin")
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "by rate limit of policy 'everyone' (2 per 1s), retry after 500ms")
+	clock.advance(500 * time.Millisecond)
+	assert.True(t, inspect("admin").Allow)
+
+	// Buckets survive reloads
+	assert.NoError(t, authorizer.Reload())
+	assert.False(t, inspect("user_2").Allow)
+
+	// Full buckets are pruned, while the others keep their tokens
+	clock.advance(50 * time.Second)
+	assert.True(t, inspect("admin").Allow)
+	assert.Len(t, authorizer.limiter.buckets, 2, "The bucket of user_1 creates must be kept until refilled")
+	clock.advance(time.Minute)
+	assert.True(t, inspect("admin").Allow)
+	assert.Len(t, authorizer.limiter.buckets, 1, "Only the global bucket must be kept")
+	for i := 0; i < 5; i++ {
+		assert.True(t, create("user_1").Allow, "Pruned buckets must be refilled")
+	}
+
+	// Invalid limits are refused
+	for _, limit := range []string{`{"rate":0}`, `{"rate":1,"per":"-1s"}`, `{"rate":1,"scope":"host"}`, `{"rate":1,"action":"("}`} {
+		_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","rateLimits":[` + limit + `],"actions":[]}]`))
+		assert.Error(t, err, limit)
+	}
+}
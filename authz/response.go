@@ -0,0 +1,189 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// ResponsePolicy constrains the docker daemon responses to the requests matching an action.
+// The body constraints apply to the response body, or to each element of an array response
+// body (e.g. container_list), and string values may refer to the requesting user as ${user}.
+// A response with an element not satisfying the body constraints is denied, unless redact paths
+// are defined: the paths are then removed from the offending elements. The body constraints are
+// skipped for empty or non-JSON response bodies, which are only checked by status.
+//
+//	response:
+//	  body:
+//	    Config:
+//	      Labels:
+//	        anubis.io/owner: {required: true, oneOf: ["${user}"]}
+//	  redact: ["Config.Env"]
+//
+// Since the docker authorization protocol cannot mutate responses, redaction is only applied when
+// the broker runs as a proxy. The authorization plugin denies the responses it would redact instead.
+type ResponsePolicy struct {
+	Status []int                  `yaml:"status,omitempty"` // Status are the status codes of the checked responses (defaults to 2xx)
+	Body   map[string]interface{} `yaml:"body,omitempty"`   // Body are the constraints applied to the response body elements
+	Redact []string               `yaml:"redact,omitempty"` // Redact are the paths removed from the elements not satisfying the body constraints
+}
+
+// validate verifies the response policy is well formed
+func (r *ResponsePolicy) validate() error {
+	if err := validateBody(r.Body, ""); err != nil {
+		return fmt.Errorf("response %s", err.Error())
+	}
+	for _, path := range r.Redact {
+		if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return fmt.Errorf("invalid response redact path '%s'", path)
+		}
+	}
+	return nil
+}
+
+// appliesTo returns true if responses with the status code are checked
+func (r *ResponsePolicy) appliesTo(status int) bool {
+	if len(r.Status) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, s := range r.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// check checks the elements of the response body on behalf of the user. Offending elements are redacted
+// if redact is set, otherwise the response is denied if any offending element holds a path to redact.
+// It returns whether the response is allowed, the reason if not, and whether the body was redacted.
+func (r *ResponsePolicy) check(body interface{}, user string, redact bool) (bool, string, bool) {
+	elements := []interface{}{body}
+	if list, ok := body.([]interface{}); ok {
+		elements = list
+	}
+
+	policyBody, _ := substituteAll(r.Body, user).(map[string]interface{})
+	redacted := false
+	for _, element := range elements {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		check, msg := CheckBody(object, policyBody, "")
+		if check {
+			continue
+		}
+		if len(r.Redact) == 0 {
+			return false, fmt.Sprintf("on value '%s'", msg), redacted
+		}
+
+		for _, path := range r.Redact {
+			found := redactPath(object, strings.Split(path, "."), redact)
+			if found && !redact {
+				return false, fmt.Sprintf("on value '%s' (cannot redact '%s')", msg, path), redacted
+			}
+			redacted = redacted || found
+		}
+	}
+	return true, "", redacted
+}
+
+// redactPath looks up the path in the value, descending into the elements of arrays, and removes
+// it if remove is set. It returns true if a non empty value was found.
+func redactPath(v interface{}, keys []string, remove bool) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		value, ok := v[keys[0]]
+		if !ok {
+			return false
+		}
+		if len(keys) > 1 {
+			return redactPath(value, keys[1:], remove)
+		}
+		if remove {
+			delete(v, keys[0])
+		}
+		return !isEmpty(value)
+	case []interface{}:
+		found := false
+		for _, e := range v {
+			found = redactPath(e, keys, remove) || found
+		}
+		return found
+	}
+	return false
+}
+
+// checkResponse checks the response against the response policies of the actions matching the request.
+// Every response policy must be satisfied. It returns whether the response is allowed, the reason if not,
+// and the (possibly redacted) response body.
+func (f *anubisAuthorizer) checkResponse(authZReq *authorization.Request, redact bool) (bool, string, []byte) {
+	route, err := parseAction(authZReq)
+	if err != nil {
+		// Requests with invalid actions are denied by AuthZReq
+		return true, "", authZReq.ResponseBody
+	}
+
+	var body interface{}
+	var bodyErr error
+	decoded, redacted := false, false
+	now := f.now()
+	for _, policy := range f.policies() {
+		if !policy.appliesTo(authZReq.User) || !policy.activeAt(now) {
+			continue
+		}
+
+		for _, policyAction := range policy.Actions {
+			response := policyAction.Response
+			if response == nil || policyAction.Effect == EffectDeny || !policyAction.matches(route.Action) ||
+				!response.appliesTo(authZReq.ResponseStatusCode) {
+				continue
+			}
+
+			if !decoded {
+				// Decode numbers verbatim, such that redacted bodies are forwarded unchanged
+				decoder := json.NewDecoder(bytes.NewReader(authZReq.ResponseBody))
+				decoder.UseNumber()
+				bodyErr = decoder.Decode(&body)
+				decoded = true
+			}
+			if bodyErr != nil {
+				// Empty (e.g. streamed) and non-JSON bodies hold no elements to check, only the status applies
+				logrus.Debugf("Skipped body constraints of response of action '%s': %s", route.Action, bodyErr.Error())
+				continue
+			}
+
+			check, reason, changed := response.check(body, authZReq.User, redact)
+			if !check {
+				return false, fmt.Sprintf("response of action '%s' denied for user '%s' by policy '%s' %s", route.Action, authZReq.User, policy.Name, reason), nil
+			}
+			redacted = redacted || changed
+		}
+	}
+
+	if !redacted {
+		return true, "", authZReq.ResponseBody
+	}
+
+	logrus.Debugf("Redacted response of action '%s' for user '%s'", route.Action, authZReq.User)
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, fmt.Sprintf("response of action '%s' denied for user '%s': %s", route.Action, authZReq.User, err.Error()), nil
+	}
+	return true, "", data
+}
+
+// MutateRes redacts the response body according to the response policies of the actions matching the request
+func (f *anubisAuthorizer) MutateRes(authZReq *authorization.Request) ([]byte, error) {
+	allowed, msg, body := f.checkResponse(authZReq, true)
+	if !allowed {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return body, nil
+}
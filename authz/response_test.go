@@ -0,0 +1,92 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnubisResponse(t *testing.T) {
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_inspect
+      response:
+        body:
+          Config:
+            Labels:
+              anubis.io/owner: {required: true, oneOf: ["${user}"]}
+        redact: ["Config.Env"]
+    - name: container_list
+      response:
+        body:
+          Labels:
+            anubis.io/owner: {required: true, oneOf: ["${user}"]}
+    - name: docker_version
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+
+	const (
+		owned  = `{"Id":"1","Config":{"Env":["PASSWORD=x"],"Labels":{"anubis.io/owner":"user_1"}}}`
+		other  = `{"Id":"2","Config":{"Env":["PASSWORD=y"],"Labels":{"anubis.io/owner":"user_2"}}}`
+		noEnv  = `{"Id":"3","Config":{"Labels":{"anubis.io/owner":"user_2"}}}`
+		list   = `[{"Id":"1","Labels":{"anubis.io/owner":"user_1"}},{"Id":"2","Labels":{"anubis.io/owner":"user_2"}}]`
+		listOk = `[{"Id":"1","Labels":{"anubis.io/owner":"user_1"}}]`
+	)
+	tests := []struct {
+		uri    string
+		status int
+		body   string
+		allow  bool
+		msg    string
+	}{
+		{"/v1.41/containers/id/json", http.StatusOK, owned, true, ""},
+		{"/v1.41/containers/id/json", http.StatusOK, other, false, "cannot redact 'Config.Env'"}, // Plugin cannot redact
+		{"/v1.41/containers/id/json", http.StatusOK, noEnv, true, ""},                            // Nothing to redact
+		{"/v1.41/containers/id/json", http.StatusNotFound, `{"message":"no such container"}`, true, ""},
+		{"/v1.41/containers/id/json", http.StatusOK, "", true, ""},         // Empty bodies are only checked by status
+		{"/v1.41/containers/id/json", http.StatusOK, "not json", true, ""}, // So are non-JSON bodies
+		{"/v1.41/containers/json", http.StatusOK, list, false, "on value '.Labels.anubis.io/owner user_2 not one of [user_1]'"},
+		{"/v1.41/containers/json", http.StatusOK, listOk, true, ""},
+		{"/v1.41/version", http.StatusOK, `{"Version":"27.5.1"}`, true, ""},
+	}
+
+	for _, test := range tests {
+		res := authorizer.AuthZRes(&authorization.Request{RequestMethod: http.MethodGet, RequestURI: test.uri, User: "user_1",
+			ResponseStatusCode: test.status, ResponseBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s: %s", test.uri, test.body, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// The proxy redacts the offending elements
+	req := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/containers/id/json", User: "user_1",
+		ResponseStatusCode: http.StatusOK, ResponseBody: []byte(other)}
+	body, err := authorizer.MutateRes(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Id":"2","Config":{"Labels":{"anubis.io/owner":"user_2"}}}`, string(body))
+	req.ResponseBody = body
+	assert.True(t, authorizer.AuthZRes(req).Allow, "Redacted responses must be allowed")
+
+	req.ResponseBody = []byte(owned)
+	body, err = authorizer.MutateRes(req)
+	assert.NoError(t, err)
+	assert.Equal(t, owned, string(body), "Allowed responses must be unchanged")
+
+	req.RequestURI = "/v1.41/containers/json"
+	req.ResponseBody = []byte(list)
+	_, err = authorizer.MutateRes(req)
+	assert.Error(t, err)
+
+	// Invalid redact paths are refused
+	_, err = parseAnubisPolicies([]byte(`[{"name":"policy_1","actions":[{"name":"container_inspect","response":{"redact":["Config..Env"]}}]}]`))
+	assert.Error(t, err)
+}
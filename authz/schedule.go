@@ -0,0 +1,238 @@
+package authz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds of the duration of the windows starting at cron times
+const (
+	// minWindowDuration is the minimum duration, the resolution of the cron times
+	minWindowDuration = time.Minute
+	// maxWindowDuration is the maximum duration
+	maxWindowDuration = 7 * 24 * time.Hour
+)
+
+// timeLayouts are the accepted layouts of absolute times, without timezone the schedule timezone applies
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Schedule restricts a policy to time windows. A policy with a schedule only applies during one of its
+// windows, either absolute (start and end times) or recurring (cron expression and duration).
+//
+//	schedule:
+//	  timezone: America/New_York
+//	  windows:
+//	    - start: 2023-05-01T09:00
+//	      end: 2023-05-01T12:00
+//	    - cron: "0 9 * * 1-5"
+//	      duration: 8h
+//
+// Cron expressions have the standard five fields (minute, hour, day of month, month and day of week),
+// each being * or a list of values, ranges and steps (e.g. 1-5, */15, 0,30).
+type Schedule struct {
+	Timezone string   `yaml:"timezone,omitempty"` // Timezone is the IANA timezone of the windows (defaults to UTC)
+	Windows  []Window `yaml:"windows"`            // Windows are the time windows the policy applies in
+
+	location *time.Location // location is the loaded timezone
+}
+
+// Window is a time window, either absolute or recurring
+type Window struct {
+	Start    string        `yaml:"start,omitempty"`    // Start is the absolute start time (unbounded if empty)
+	End      string        `yaml:"end,omitempty"`      // End is the absolute end time (unbounded if empty)
+	Cron     string        `yaml:"cron,omitempty"`     // Cron is the cron expression of the recurring start times
+	Duration time.Duration `yaml:"duration,omitempty"` // Duration is the duration of the recurring windows
+
+	start, end time.Time     // start and end are the parsed absolute times
+	cron       *cronSchedule // cron is the parsed cron expression
+}
+
+// cronSchedule is a parsed cron expression, each field being the set of matching values
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool // anyDay and anyWeekday indicate the day fields are unrestricted
+}
+
+// compile loads the timezone and parses the windows
+func (s *Schedule) compile() error {
+	var err error
+	if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid schedule timezone '%s': %s", s.Timezone, err.Error())
+	}
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("schedule must have windows")
+	}
+	for i := range s.Windows {
+		if err := s.Windows[i].compile(s.location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compile parses the window times
+func (w *Window) compile(location *time.Location) error {
+	if w.Cron != "" {
+		if w.Start != "" || w.End != "" {
+			return fmt.Errorf("window '%s' cannot have both a cron expression and start or end times", w.Cron)
+		}
+		if w.Duration < minWindowDuration || w.Duration > maxWindowDuration {
+			return fmt.Errorf("window '%s' must have a duration between %s and %s", w.Cron, minWindowDuration, maxWindowDuration)
+		}
+		var err error
+		if w.cron, err = parseCron(w.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression '%s': %s", w.Cron, err.Error())
+		}
+		return nil
+	}
+
+	if w.Start == "" && w.End == "" {
+		return fmt.Errorf("window must have a cron expression, or start or end times")
+	}
+	if w.Duration != 0 {
+		return fmt.Errorf("window duration requires a cron expression")
+	}
+	var err error
+	if w.start, err = parseTime(w.Start, location); err != nil {
+		return err
+	}
+	if w.end, err = parseTime(w.End, location); err != nil {
+		return err
+	}
+	if !w.start.IsZero() && !w.end.IsZero() && !w.end.After(w.start) {
+		return fmt.Errorf("window end %s must be after start %s", w.End, w.Start)
+	}
+	return nil
+}
+
+// parseTime parses an absolute time in the given location, zero if empty
+func parseTime(value string, location *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s' (expected e.g. 2006-01-02T15:04)", value)
+}
+
+// active returns true if the time is within one of the windows of the schedule
+func (s *Schedule) active(now time.Time) bool {
+	if s.location != nil {
+		now = now.In(s.location)
+	}
+	for i := range s.Windows {
+		if s.Windows[i].contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if the time is within the window
+func (w *Window) contains(now time.Time) bool {
+	if w.cron == nil {
+		return (w.start.IsZero() || !now.Before(w.start)) && (w.end.IsZero() || now.Before(w.end))
+	}
+
+	// Look for a start time within the duration preceding now
+	start := now.Truncate(time.Minute)
+	for elapsed := now.Sub(start); elapsed < w.Duration; elapsed += time.Minute {
+		if w.cron.matches(start) {
+			return true
+		}
+		start = start.Add(-time.Minute)
+	}
+	return false
+}
+
+// matches returns true if the cron expression matches the minute of the time
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	// As in cron, a restricted day of month or day of week is enough when both are restricted
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// parseCron parses a five fields cron expression
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.weekdays[7] {
+		// Sunday is either 0 or 7
+		c.weekdays[0] = true
+	}
+	c.anyDay, c.anyWeekday = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField parses a cron field (e.g. *, 5, 1-5, */15, 0-30/10, 1,15) into the set of its values
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range '%s'", part)
+				}
+			}
+			if low < min || high > max || low > high {
+				return nil, fmt.Errorf("'%s' out of range %d-%d", part, min, max)
+			}
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
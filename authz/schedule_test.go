@@ -0,0 +1,121 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+
+	utc := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		assert.NoError(t, err)
+		return v
+	}
+	tests := []struct {
+		expr    string
+		time    string // 2023-05-01 is a Monday
+		matches bool
+	}{
+		{"* * * * *", "2023-05-01 03:17", true},
+		{"0 9 * * 1-5", "2023-05-01 09:00", true},
+		{"0 9 * * 1-5", "2023-05-06 09:00", false}, // Saturday
+		{"0 9 * * 1-5", "2023-05-01 09:01", false},
+		{"*/15 * * * *", "2023-05-01 10:45", true},
+		{"*/15 * * * *", "2023-05-01 10:46", false},
+		{"0,30 8-10/2 * * *", "2023-05-01 10:30", true},
+		{"0,30 8-10/2 * * *", "2023-05-01 09:30", false},
+		{"0 0 * * 7", "2023-05-07 00:00", true},  // Sunday as 7
+		{"0 0 1 * 0", "2023-05-01 00:00", true},  // Day of month or day of week
+		{"0 0 2 * 0", "2023-05-01 00:00", false}, // Neither
+		{"0 0 1 6 *", "2023-05-01 00:00", false},
+	}
+	for _, test := range tests {
+		cron, err := parseCron(test.expr)
+		assert.NoError(t, err, test.expr)
+		assert.Equal(t, test.matches, cron.matches(utc(test.time)), "%s at %s", test.expr, test.time)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestAnubisSchedule(t *testing.T) {
+
+	policy := `
+- name: exam
+  users: ["user_1"]
+  schedule:
+    timezone: America/New_York
+    windows:
+      - start: 2023-05-01T09:00
+        end: 2023-05-01T12:00
+  actions:
+    - name: container_exec_create
+- name: maintenance
+  users: ["admin"]
+  schedule:
+    windows:
+      - cron: "0 22 * * 6"
+        duration: 4h
+  actions:
+    - name: image_push
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+	clock := &fakeClock{}
+	authorizer.now = clock.now
+
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	tests := []struct {
+		time  time.Time
+		user  string
+		uri   string
+		allow bool
+	}{
+		{time.Date(2023, 5, 1, 9, 0, 0, 0, newYork), "user_1", "/v1.41/containers/id/exec", true},
+		{time.Date(2023, 5, 1, 15, 59, 0, 0, time.UTC), "user_1", "/v1.41/containers/id/exec", true}, // 11:59 in New York
+		{time.Date(2023, 5, 1, 12, 0, 0, 0, newYork), "user_1", "/v1.41/containers/id/exec", false},
+		{time.Date(2023, 5, 1, 8, 59, 0, 0, newYork), "user_1", "/v1.41/containers/id/exec", false},
+		{time.Date(2023, 5, 6, 22, 0, 0, 0, time.UTC), "admin", "/v1.41/images/app/push", true},  // Saturday
+		{time.Date(2023, 5, 7, 1, 59, 0, 0, time.UTC), "admin", "/v1.41/images/app/push", true},  // Window spans midnight
+		{time.Date(2023, 5, 7, 2, 0, 0, 0, time.UTC), "admin", "/v1.41/images/app/push", false},  // Window ended
+		{time.Date(2023, 5, 5, 23, 0, 0, 0, time.UTC), "admin", "/v1.41/images/app/push", false}, // Friday
+	}
+	for _, test := range tests {
+		clock.current = test.time
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: test.uri, User: test.user, RequestBody: []byte(`{}`)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s at %s: %s", test.user, test.uri, test.time, res.Msg)
+		if !test.allow {
+			assert.Contains(t, res.Msg, "no policy applied")
+		}
+	}
+
+	// Invalid schedules are refused
+	for _, schedule := range []string{
+		`{"timezone":"Mars/Olympus","windows":[{"start":"2023-05-01T09:00"}]}`,
+		`{"windows":[]}`,
+		`{"windows":[{"start":"tomorrow"}]}`,
+		`{"windows":[{"start":"2023-05-01T12:00","end":"2023-05-01T09:00"}]}`,
+		`{"windows":[{"cron":"0 9 * * *"}]}`,
+		`{"windows":[{"cron":"0 9 * * *","duration":"1h","start":"2023-05-01T09:00"}]}`,
+		`{"windows":[{"cron":"0 9 * *","duration":"1h"}]}`,
+		`{"windows":[{"cron":"0 9 * * *","duration":"30s"}]}`,
+		`{"windows":[{"cron":"0 9 * * *","duration":"169h"}]}`,
+	} {
+		_, err := parseAnubisPolicies([]byte(`[{"name":"policy_1","schedule":` + schedule + `,"actions":[]}]`))
+		assert.Error(t, err, schedule)
+	}
+}
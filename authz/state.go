@@ -0,0 +1,462 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the state store
+var (
+	bucketContainers = []byte("containers") // bucketContainers maps a container ID to its record
+	bucketNames      = []byte("names")      // bucketNames maps a container name to its ID
+	bucketExecs      = []byte("execs")      // bucketExecs maps an exec ID to its record
+	bucketVolumes    = []byte("volumes")    // bucketVolumes maps a volume name to its record
+	bucketNetworks   = []byte("networks")   // bucketNetworks maps a network ID to its record
+)
+
+// containerRecord is the state of a container known to the broker
+type containerRecord struct {
+	ID       string `json:"id"`                 // ID is the container ID
+	Name     string `json:"name,omitempty"`     // Name is the container name (without leading slash)
+	Owner    string `json:"owner"`              // Owner is the user owning the container, empty if untracked
+	Running  bool   `json:"running,omitempty"`  // Running indicates the container was started
+	Memory   int64  `json:"memory,omitempty"`   // Memory is the memory limit of the container
+	NanoCpus int64  `json:"nanoCpus,omitempty"` // NanoCpus is the CPU quota of the container
+}
+
+// execRecord is the state of an exec instance known to the broker
+type execRecord struct {
+	ID        string `json:"id"`        // ID is the exec ID
+	Container string `json:"container"` // Container is the ID of the container the exec runs in
+	Owner     string `json:"owner"`     // Owner is the user owning the exec
+}
+
+// objectRecord is the state of a docker object (volume or network) known to the broker
+type objectRecord struct {
+	ID    string `json:"id"`             // ID is the object ID
+	Name  string `json:"name,omitempty"` // Name is the object name
+	Owner string `json:"owner"`          // Owner is the user owning the object, empty if untracked
+}
+
+// stateStore persists the state learned by the broker from the docker daemon responses
+// (e.g. the owners of containers) in a bolt database, such that it survives restarts.
+type stateStore struct {
+	db *bolt.DB
+}
+
+// openStateStore opens (or creates) the state store
+func openStateStore(path string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketContainers, bucketNames, bucketExecs, bucketVolumes, bucketNetworks} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+// Close closes the state store
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// containerName normalizes a container name (docker reports names with a leading slash)
+func containerName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// putContainer records a container
+func (s *stateStore) putContainer(record containerRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putContainer(tx, record)
+	})
+}
+
+// putContainer records a container in the transaction
+func putContainer(tx *bolt.Tx, record containerRecord) error {
+	record.Name = containerName(record.Name)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketContainers).Put([]byte(record.ID), data); err != nil {
+		return err
+	}
+	if record.Name != "" {
+		return tx.Bucket(bucketNames).Put([]byte(record.Name), []byte(record.ID))
+	}
+	return nil
+}
+
+// container returns the container referred to by its ID, name or unique ID prefix, nil if unknown
+func (s *stateStore) container(ref string) (*containerRecord, error) {
+	var record *containerRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = findContainer(tx, ref)
+		return err
+	})
+	return record, err
+}
+
+// findContainer returns the container referred to by its ID, name or unique ID prefix, nil if unknown.
+// Like docker daemon, the names are resolved before the ID prefixes, hence the untracked containers must
+// be known too: a reference to the name of an untracked container must not resolve to the ID of another.
+func findContainer(tx *bolt.Tx, ref string) (*containerRecord, error) {
+	ref = containerName(ref)
+	if ref == "" {
+		return nil, nil
+	}
+	containers := tx.Bucket(bucketContainers)
+
+	data := containers.Get([]byte(ref))
+	if data == nil {
+		if id := tx.Bucket(bucketNames).Get([]byte(ref)); id != nil {
+			data = containers.Get(id)
+		}
+	}
+	if data == nil {
+		// Docker accepts any unique prefix of the container ID
+		cursor := containers.Cursor()
+		k, v := cursor.Seek([]byte(ref))
+		if k != nil && bytes.HasPrefix(k, []byte(ref)) {
+			if next, _ := cursor.Next(); next == nil || !bytes.HasPrefix(next, []byte(ref)) {
+				data = v
+			}
+		}
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var record containerRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// renameContainer renames a known container
+func (s *stateStore) renameContainer(ref, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := findContainer(tx, ref)
+		if err != nil || record == nil {
+			return err
+		}
+		if record.Name != "" {
+			if err := tx.Bucket(bucketNames).Delete([]byte(record.Name)); err != nil {
+				return err
+			}
+		}
+		record.Name = name
+		return putContainer(tx, *record)
+	})
+}
+
+// updateContainer updates a known container
+func (s *stateStore) updateContainer(ref string, update func(record *containerRecord)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := findContainer(tx, ref)
+		if err != nil || record == nil {
+			return err
+		}
+		update(record)
+		return putContainer(tx, *record)
+	})
+}
+
+// ownedContainers returns the containers owned by the user
+func (s *stateStore) ownedContainers(owner string) ([]containerRecord, error) {
+	var records []containerRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContainers).ForEach(func(k, v []byte) error {
+			var record containerRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.Owner == owner {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+// removeContainer removes a known container and its execs
+func (s *stateStore) removeContainer(ref string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := findContainer(tx, ref)
+		if err != nil || record == nil {
+			return err
+		}
+		return removeContainer(tx, record)
+	})
+}
+
+// removeContainer removes the container and its execs in the transaction
+func removeContainer(tx *bolt.Tx, record *containerRecord) error {
+	if err := tx.Bucket(bucketContainers).Delete([]byte(record.ID)); err != nil {
+		return err
+	}
+	if record.Name != "" {
+		if err := tx.Bucket(bucketNames).Delete([]byte(record.Name)); err != nil {
+			return err
+		}
+	}
+
+	execs := tx.Bucket(bucketExecs)
+	var stale [][]byte
+	err := execs.ForEach(func(k, v []byte) error {
+		var exec execRecord
+		if err := json.Unmarshal(v, &exec); err != nil || exec.Container == record.ID {
+			stale = append(stale, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := execs.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putExec records an exec instance
+func (s *stateStore) putExec(record execRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketExecs).Put([]byte(record.ID), data)
+	})
+}
+
+// exec returns the exec instance, nil if unknown
+func (s *stateStore) exec(id string) (*execRecord, error) {
+	var record *execRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketExecs).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		record = &execRecord{}
+		return json.Unmarshal(data, record)
+	})
+	return record, err
+}
+
+// putObject records a volume or network in the bucket
+func (s *stateStore) putObject(bucket []byte, record objectRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(record.ID), data)
+	})
+}
+
+// object returns the volume or network of the bucket referred to by its ID or name (or unique ID prefix
+// for networks), nil if unknown
+func (s *stateStore) object(bucket []byte, ref string) (*objectRecord, error) {
+	var record *objectRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		_, record, err = findObject(tx, bucket, ref)
+		return err
+	})
+	return record, err
+}
+
+// findObject returns the key and record of the volume or network of the bucket referred to by its ID or name,
+// or unique ID prefix for networks (volumes are named by their ID), nil if unknown. Like docker daemon, the
+// names are resolved before the ID prefixes.
+func findObject(tx *bolt.Tx, bucket []byte, ref string) ([]byte, *objectRecord, error) {
+	if ref == "" {
+		return nil, nil, nil
+	}
+	objects := tx.Bucket(bucket)
+
+	key, data := []byte(ref), objects.Get([]byte(ref))
+	if data == nil {
+		err := objects.ForEach(func(k, v []byte) error {
+			var record objectRecord
+			if json.Unmarshal(v, &record) == nil && record.Name == ref {
+				key, data = k, v
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if data == nil && bytes.Equal(bucket, bucketNetworks) {
+		cursor := objects.Cursor()
+		k, v := cursor.Seek([]byte(ref))
+		if k != nil && bytes.HasPrefix(k, []byte(ref)) {
+			if next, _ := cursor.Next(); next == nil || !bytes.HasPrefix(next, []byte(ref)) {
+				key, data = k, v
+			}
+		}
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	var record objectRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, nil, err
+	}
+	return key, &record, nil
+}
+
+// removeObject removes the volume or network referred to by its ID or name from the bucket
+func (s *stateStore) removeObject(bucket []byte, ref string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key, record, err := findObject(tx, bucket, ref)
+		if err != nil || record == nil {
+			return err
+		}
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// countObjects returns the number of volumes or networks of the bucket owned by the user
+func (s *stateStore) countObjects(bucket []byte, owner string) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var record objectRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.Owner == owner {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// syncObjects reconciles the known volumes or networks of the bucket with the objects of the docker daemon:
+// the objects that no longer exist are removed, and the owners of the labelled objects are updated.
+// The objects without known owner are recorded untracked, such that their names are resolved (see findObject).
+func (s *stateStore) syncObjects(bucket []byte, existing []objectRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(bucket)
+		known := make(map[string]objectRecord)
+		err := objects.ForEach(func(k, v []byte) error {
+			var record objectRecord
+			json.Unmarshal(v, &record)
+			known[string(k)] = record
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, record := range existing {
+			// Unlabelled objects keep their learned owner, and are recorded untracked otherwise
+			if learned, ok := known[record.ID]; ok && record.Owner == "" {
+				record.Owner = learned.Owner
+			}
+			delete(known, record.ID)
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := objects.Put([]byte(record.ID), data); err != nil {
+				return err
+			}
+		}
+
+		// The remaining objects no longer exist
+		for id := range known {
+			if err := objects.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// syncContainers reconciles the known containers with the containers of the docker daemon: the containers
+// that no longer exist are removed, the owners of the labelled containers and the running states are updated.
+// The containers without known owner are recorded untracked, such that their names and IDs are resolved like
+// docker daemon does (see findContainer).
+func (s *stateStore) syncContainers(existing []containerRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ids := make(map[string]bool, len(existing))
+		for _, record := range existing {
+			ids[record.ID] = true
+		}
+
+		var stale []*containerRecord
+		err := tx.Bucket(bucketContainers).ForEach(func(k, v []byte) error {
+			if ids[string(k)] {
+				return nil
+			}
+			record := &containerRecord{ID: string(k)}
+			json.Unmarshal(v, record)
+			stale = append(stale, record)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range stale {
+			if err := removeContainer(tx, record); err != nil {
+				return err
+			}
+		}
+
+		for _, record := range existing {
+			known, err := findContainer(tx, record.ID)
+			if err != nil {
+				return err
+			}
+			if known != nil {
+				// Unlabelled containers keep their learned owner
+				if record.Owner == "" {
+					record.Owner = known.Owner
+				}
+				record.Memory, record.NanoCpus = known.Memory, known.NanoCpus
+			}
+			if known != nil && known.Name != "" && known.Name != containerName(record.Name) {
+				if err := tx.Bucket(bucketNames).Delete([]byte(known.Name)); err != nil {
+					return err
+				}
+			}
+			if err := putContainer(tx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
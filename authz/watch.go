@@ -0,0 +1,149 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// watchDebounce coalesces the burst of events emitted by a single policy update
+// (e.g. an editor writing a temporary file and renaming it over the policy)
+const watchDebounce = 100 * time.Millisecond
+
+// configMapData is the symlink atomically retargeted by kubelet when a mounted ConfigMap is updated
+const configMapData = "..data"
+
+// policyWatcher reloads a policy when its files change on disk.
+// The parent folder of a policy file is watched rather than the file itself, such that reloads
+// survive the file being replaced (rename, remove then create) or retargeted (symlink swap).
+// A policy folder is watched for policy files being added, changed or removed.
+type policyWatcher struct {
+	path    string          // path is the policy path (file or folder)
+	dir     bool            // dir indicates the policy path is a folder
+	reload  func() error    // reload reloads the policy
+	sources func() []string // sources returns the files of the loaded policy (e.g. included files), may be nil
+	files   map[string]bool // files are the watched policy files
+	folders map[string]bool // folders are the watched folders
+	watcher *fsnotify.Watcher
+}
+
+// watchPolicy starts watching the policy path and invokes reload upon changes.
+// The sources of the policy are watched as well, and refreshed after each reload.
+func watchPolicy(path string, reload func() error, sources func() []string) (*policyWatcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &policyWatcher{
+		path:    path,
+		dir:     info.IsDir(),
+		reload:  reload,
+		sources: sources,
+		files:   make(map[string]bool),
+		folders: make(map[string]bool),
+		watcher: watcher,
+	}
+	folder := filepath.Dir(path)
+	if w.dir {
+		folder = path
+	}
+	if err = w.watchFolder(folder); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	w.watchSources()
+
+	go w.run()
+	return w, nil
+}
+
+// watchFolder starts watching the folder if not watched yet
+func (w *policyWatcher) watchFolder(folder string) error {
+	if w.folders[folder] {
+		return nil
+	}
+	if err := w.watcher.Add(folder); err != nil {
+		return err
+	}
+	w.folders[folder] = true
+	return nil
+}
+
+// watchSources starts watching the folders of the policy sources
+func (w *policyWatcher) watchSources() {
+	if w.sources == nil {
+		return
+	}
+	for _, file := range w.sources() {
+		w.files[file] = true
+		if err := w.watchFolder(filepath.Dir(file)); err != nil {
+			logrus.Errorf("Failed to start watching folder %q", err.Error())
+		}
+	}
+}
+
+// run dispatches the watcher events until the watcher is closed
+func (w *policyWatcher) run() {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.relevant(ev) {
+				logrus.Debugf("Policy change detected (%s)", ev)
+				debounce = time.After(watchDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			// Invalid policies are refused and logged by the loader
+			w.reload()
+			w.watchSources()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("Settings watcher error '%v'", err)
+		}
+	}
+}
+
+// relevant returns true when the event may have changed the content of the policy
+func (w *policyWatcher) relevant(ev fsnotify.Event) bool {
+	name := filepath.Clean(ev.Name)
+	if name == w.path || w.files[name] || filepath.Base(name) == configMapData {
+		return true
+	}
+	if w.dir && filepath.Dir(name) == w.path && (isPolicyFile(name) || isRegoFile(name)) {
+		return true
+	}
+
+	// A policy file is a symlink retargeted to another file of the folder
+	if target, err := filepath.EvalSymlinks(w.path); err == nil && target == name {
+		return true
+	}
+	for file := range w.files {
+		if target, err := filepath.EvalSymlinks(file); err == nil && target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops watching the policy
+func (w *policyWatcher) Close() error {
+	return w.watcher.Close()
+}
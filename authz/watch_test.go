@@ -0,0 +1,96 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+const watchTimeout = 5 * time.Second
+
+// allowsEventually polls the authorizer until the request verdict matches the expected one
+func allowsEventually(t *testing.T, authorizer *anubisAuthorizer, req *authorization.Request, allow bool, msg string) {
+	assert.Eventually(t, func() bool {
+		return authorizer.AuthZReq(req).Allow == allow
+	}, watchTimeout, 10*time.Millisecond, msg)
+}
+
+func TestWatchPolicyRename(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFileName := filepath.Join(dir, "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte("- name: policy_1\n  actions:\n    - name: docker_version\n"), 0644))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	defer authorizer.watcher.Close()
+
+	version := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/version", User: "test"}
+	info := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/info", User: "test"}
+	assert.True(t, authorizer.AuthZReq(version).Allow)
+	assert.False(t, authorizer.AuthZReq(info).Allow)
+
+	// Editors write a temporary file and rename it over the policy
+	tmp := filepath.Join(dir, ".policy.yaml.swp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte("- name: policy_1\n  actions:\n    - name: docker_info\n"), 0644))
+	assert.NoError(t, os.Rename(tmp, policyFileName))
+	allowsEventually(t, authorizer, info, true, "Renamed policy must be reloaded")
+	assert.False(t, authorizer.AuthZReq(version).Allow)
+
+	// Removed then recreated policies are reloaded
+	assert.NoError(t, os.Remove(policyFileName))
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte("- name: policy_1\n  actions:\n    - name: docker_version\n"), 0644))
+	allowsEventually(t, authorizer, version, true, "Recreated policy must be reloaded")
+}
+
+func TestWatchPolicyConfigMap(t *testing.T) {
+
+	// Mimic the layout of a mounted ConfigMap:
+	// policy.yaml -> ..data/policy.yaml, ..data -> ..<timestamp>
+	dir := t.TempDir()
+	writeRevision := func(revision, action string) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, revision), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, revision, "policy.yaml"),
+			[]byte("- name: policy_1\n  actions:\n    - name: "+action+"\n"), 0644))
+	}
+	writeRevision("..rev_1", "docker_version")
+	assert.NoError(t, os.Symlink("..rev_1", filepath.Join(dir, configMapData)))
+	assert.NoError(t, os.Symlink(filepath.Join(configMapData, "policy.yaml"), filepath.Join(dir, "policy.yaml")))
+
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: filepath.Join(dir, "policy.yaml")}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+	defer authorizer.watcher.Close()
+
+	info := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/info", User: "test"}
+	assert.False(t, authorizer.AuthZReq(info).Allow)
+
+	// kubelet atomically swaps the ..data symlink
+	writeRevision("..rev_2", "docker_info")
+	assert.NoError(t, os.Symlink("..rev_2", filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, configMapData)))
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "..rev_1")))
+	allowsEventually(t, authorizer, info, true, "Swapped ConfigMap must be reloaded")
+}
+
+func TestReload(t *testing.T) {
+
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte("- name: policy_1\n  actions:\n    - name: docker_version\n"), 0644))
+
+	// Reload without watching, as triggered upon SIGHUP
+	authorizer := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName}).(*anubisAuthorizer)
+	assert.NoError(t, authorizer.Reload())
+
+	info := &authorization.Request{RequestMethod: http.MethodGet, RequestURI: "/v1.41/info", User: "test"}
+	assert.False(t, authorizer.AuthZReq(info).Allow)
+
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte("- name: policy_1\n  actions:\n    - name: docker_info\n"), 0644))
+	assert.NoError(t, authorizer.Reload())
+	assert.True(t, authorizer.AuthZReq(info).Allow)
+}
@@ -0,0 +1,232 @@
+package authz
+
+import (
+	"bytes"
+	lru "container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AnubisLMS/authz/core"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookPolicy is the policy label of the decisions of the webhook
+const WebhookPolicy = "webhook"
+
+// Webhook defaults
+const (
+	DefaultWebhookTimeout   = 2 * time.Second  // DefaultWebhookTimeout is the default timeout of the webhook requests
+	DefaultWebhookCacheSize = 1000             // DefaultWebhookCacheSize is the default number of cached decisions
+	DefaultWebhookCacheTTL  = 30 * time.Second // DefaultWebhookCacheTTL is the default lifetime of cached decisions
+)
+
+// WebhookAuthorizerSettings provides settings for the webhook authorizer flow
+type WebhookAuthorizerSettings struct {
+	URL       string        // URL is the endpoint the decisions are delegated to
+	Timeout   time.Duration // Timeout is the timeout of the webhook requests (defaults to DefaultWebhookTimeout)
+	FailOpen  bool          // FailOpen indicates requests are allowed when the webhook fails (denied by default)
+	CacheSize int           // CacheSize is the maximum number of cached decisions (caching is disabled if negative)
+	CacheTTL  time.Duration // CacheTTL is the lifetime of cached decisions (defaults to DefaultWebhookCacheTTL)
+}
+
+// webhookRequest is the document posted to the webhook for every docker request
+type webhookRequest struct {
+	User   string              `json:"user"`   // User is the user (TLS common name)
+	Action string              `json:"action"` // Action is the docker action (mapped to authz terminology)
+	Method string              `json:"method"` // Method is the HTTP method
+	URI    string              `json:"uri"`    // URI is the request URI
+	Params map[string]string   `json:"params"` // Params are the path parameters (e.g. container)
+	Query  map[string][]string `json:"query"`  // Query are the query parameters
+	Body   json.RawMessage     `json:"body"`   // Body is the JSON body of POST requests (null otherwise)
+}
+
+// webhookResponse is the decision returned by the webhook
+type webhookResponse struct {
+	Allow bool   `json:"allow"` // Allow indicates the request is allowed
+	Msg   string `json:"msg"`   // Msg is the reason of the decision
+}
+
+type webhookAuthorizer struct {
+	settings *WebhookAuthorizerSettings
+	client   *http.Client
+	cache    *decisionCache
+}
+
+// NewWebhookAuthZAuthorizer creates a new authorizer delegating the decisions to an HTTP endpoint
+func NewWebhookAuthZAuthorizer(settings *WebhookAuthorizerSettings) core.Authorizer {
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	size, ttl := settings.CacheSize, settings.CacheTTL
+	if size == 0 {
+		size = DefaultWebhookCacheSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultWebhookCacheTTL
+	}
+	return &webhookAuthorizer{
+		settings: settings,
+		client:   &http.Client{Timeout: timeout},
+		cache:    newDecisionCache(size, ttl),
+	}
+}
+
+// Init validates the webhook URL
+func (f *webhookAuthorizer) Init() error {
+	u, err := url.Parse(f.settings.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %s", err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid webhook url '%s': expected http or https", f.settings.URL)
+	}
+	return nil
+}
+
+// AuthZReq delegates the decision to the webhook, unless a decision for the same request is cached
+func (f *webhookAuthorizer) AuthZReq(authZReq *authorization.Request) *authorization.Response {
+	res := f.evaluate(authZReq)
+	route, _ := parseAction(authZReq)
+	core.RecordDecision(route.Action, authZReq.User, WebhookPolicy, res.Allow)
+	return res
+}
+
+// evaluate queries the webhook, or the decision cache
+func (f *webhookAuthorizer) evaluate(authZReq *authorization.Request) *authorization.Response {
+	logrus.Debugf("Received AuthZ request, method: '%s', url: '%s'", authZReq.RequestMethod, authZReq.RequestURI)
+
+	route, err := parseAction(authZReq)
+	if err != nil {
+		return &authorization.Response{Allow: false, Msg: err.Error()}
+	}
+
+	document := webhookRequest{User: authZReq.User, Action: route.Action, Method: authZReq.RequestMethod,
+		URI: authZReq.RequestURI, Params: route.Params, Query: map[string][]string{}}
+	if u, err := url.Parse(authZReq.RequestURI); err == nil {
+		document.Query = u.Query()
+	}
+	if authZReq.RequestMethod == http.MethodPost && len(authZReq.RequestBody) > 0 {
+		if !json.Valid(authZReq.RequestBody) {
+			return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' denied for user '%s' on invalid body", route.Action, authZReq.User)}
+		}
+		document.Body = authZReq.RequestBody
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return &authorization.Response{Allow: false, Msg: err.Error()}
+	}
+
+	key := sha256.Sum256(data)
+	if decision, ok := f.cache.get(key); ok {
+		return &authorization.Response{Allow: decision.Allow, Msg: decision.Msg}
+	}
+
+	decision, err := f.decide(data)
+	if err != nil {
+		logrus.Errorf("Failed to query webhook for action %q error %q", route.Action, err.Error())
+		if f.settings.FailOpen {
+			return &authorization.Response{Allow: true, Msg: fmt.Sprintf("action '%s' allowed for user '%s' on webhook failure (fail-open)", route.Action, authZReq.User)}
+		}
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("action '%s' denied for user '%s' on webhook failure", route.Action, authZReq.User)}
+	}
+	if decision.Msg == "" {
+		verdict := "allowed"
+		if !decision.Allow {
+			verdict = "denied"
+		}
+		decision.Msg = fmt.Sprintf("action '%s' %s for user '%s' by webhook", route.Action, verdict, authZReq.User)
+	}
+	f.cache.put(key, decision)
+	return &authorization.Response{Allow: decision.Allow, Msg: decision.Msg}
+}
+
+// decide posts the request document to the webhook and decodes its decision
+func (f *webhookAuthorizer) decide(data []byte) (webhookResponse, error) {
+	var decision webhookResponse
+	res, err := f.client.Post(f.settings.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return decision, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("invalid decision: %s", err.Error())
+	}
+	return decision, nil
+}
+
+// AuthZRes always allow responses from server
+func (f *webhookAuthorizer) AuthZRes(authZReq *authorization.Request) *authorization.Response {
+	return &authorization.Response{Allow: true}
+}
+
+// decisionCache is an LRU cache of webhook decisions, expiring after a TTL
+type decisionCache struct {
+	size  int              // size is the maximum number of entries (caching is disabled if not positive)
+	ttl   time.Duration    // ttl is the lifetime of the entries
+	now   func() time.Time // now returns the current time (replaced by a fake clock in tests)
+	lock  sync.Mutex
+	order *lru.List                 // order holds the entries, most recently used first
+	items map[[32]byte]*lru.Element // items maps a request hash to its entry
+}
+
+// cacheEntry is a cached decision
+type cacheEntry struct {
+	key      [32]byte        // key is the request hash
+	decision webhookResponse // decision is the cached decision
+	expires  time.Time       // expires is the expiry time of the decision
+}
+
+// newDecisionCache creates a decision cache
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	return &decisionCache{size: size, ttl: ttl, now: time.Now, order: lru.New(), items: make(map[[32]byte]*lru.Element)}
+}
+
+// get returns the cached decision of the request, if not expired
+func (c *decisionCache) get(key [32]byte) (webhookResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return webhookResponse{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		return webhookResponse{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.decision, true
+}
+
+// put caches the decision of the request, evicting the least recently used decision if the cache is full
+func (c *decisionCache) put(key [32]byte, decision webhookResponse) {
+	if c.size <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.items[key]; ok {
+		element.Value.(*cacheEntry).decision, element.Value.(*cacheEntry).expires = decision, expires
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, decision: decision, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
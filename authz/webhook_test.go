@@ -0,0 +1,177 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// newWebhookServer creates a webhook stand-in allowing users to manage the containers prefixed by their name
+func newWebhookServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var document webhookRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&document))
+		if document.User == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body struct{ Image string }
+		if document.Body != nil {
+			assert.NoError(t, json.Unmarshal(document.Body, &body))
+		}
+		container := document.Params["container"]
+		switch {
+		case body.Image == "forbidden":
+			json.NewEncoder(w).Encode(webhookResponse{Allow: false, Msg: "image is forbidden"})
+		case container != "" && container != document.User+"-ide":
+			json.NewEncoder(w).Encode(webhookResponse{Allow: false})
+		default:
+			json.NewEncoder(w).Encode(webhookResponse{Allow: true})
+		}
+	}))
+}
+
+func TestWebhook(t *testing.T) {
+
+	var calls int32
+	server := newWebhookServer(t, &calls)
+	defer server.Close()
+
+	authorizer := NewWebhookAuthZAuthorizer(&WebhookAuthorizerSettings{URL: server.URL}).(*webhookAuthorizer)
+	assert.NoError(t, authorizer.Init(), "Initialization must be successful")
+
+	tests := []struct {
+		method string
+		uri    string
+		user   string
+		body   string
+		allow  bool
+		msg    string
+	}{
+		{http.MethodPost, "/v1.41/containers/user_1-ide/start", "user_1", "", true, "action 'container_start' allowed for user 'user_1' by webhook"},
+		{http.MethodPost, "/v1.41/containers/user_2-ide/start", "user_1", "", false, "action 'container_start' denied for user 'user_1' by webhook"},
+		{http.MethodPost, "/v1.41/containers/create", "user_1", `{"Image":"alpine"}`, true, "allowed"},
+		{http.MethodPost, "/v1.41/containers/create", "user_1", `{"Image":"forbidden"}`, false, "image is forbidden"},
+		{http.MethodPost, "/v1.41/containers/create", "user_1", `{`, false, "on invalid body"},
+		{http.MethodPost, "/v1.41/containers/create", "broken", `{"Image":"alpine"}`, false, "on webhook failure"},
+	}
+	for _, test := range tests {
+		res := authorizer.AuthZReq(&authorization.Request{RequestMethod: test.method, RequestURI: test.uri, User: test.user, RequestBody: []byte(test.body)})
+		assert.Equal(t, test.allow, res.Allow, "%s %s (%s): %s", test.method, test.uri, test.user, res.Msg)
+		assert.Contains(t, res.Msg, test.msg)
+	}
+
+	// Decisions are cached, failures are not
+	before := atomic.LoadInt32(&calls)
+	assert.True(t, authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/user_1-ide/start", User: "user_1"}).Allow)
+	assert.False(t, authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "user_1", RequestBody: []byte(`{"Image":"forbidden"}`)}).Allow)
+	assert.Equal(t, before, atomic.LoadInt32(&calls))
+	authorizer.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/create", User: "broken", RequestBody: []byte(`{"Image":"alpine"}`)})
+	assert.Equal(t, before+1, atomic.LoadInt32(&calls))
+
+	// Invalid URLs are refused
+	assert.Error(t, NewWebhookAuthZAuthorizer(&WebhookAuthorizerSettings{URL: "unix:///run/anubis.sock"}).Init())
+}
+
+func TestWebhookFailure(t *testing.T) {
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		json.NewEncoder(w).Encode(webhookResponse{Allow: true})
+	}))
+	defer slow.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>"))
+	}))
+	defer garbage.Close()
+
+	req := &authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/user_1-ide/start", User: "user_1"}
+	for _, url := range []string{slow.URL, garbage.URL, "http://127.0.0.1:1"} {
+		closed := NewWebhookAuthZAuthorizer(&WebhookAuthorizerSettings{URL: url, Timeout: 50 * time.Millisecond})
+		res := closed.AuthZReq(req)
+		assert.False(t, res.Allow, url)
+		assert.Contains(t, res.Msg, "denied for user 'user_1' on webhook failure")
+
+		open := NewWebhookAuthZAuthorizer(&WebhookAuthorizerSettings{URL: url, Timeout: 50 * time.Millisecond, FailOpen: true})
+		res = open.AuthZReq(req)
+		assert.True(t, res.Allow, url)
+		assert.Contains(t, res.Msg, "fail-open")
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+
+	clock := &fakeClock{current: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+	cache := newDecisionCache(2, time.Minute)
+	cache.now = clock.now
+	key := func(s string) [32]byte { var k [32]byte; copy(k[:], s); return k }
+
+	cache.put(key("a"), webhookResponse{Allow: true})
+	cache.put(key("b"), webhookResponse{Allow: false})
+	_, ok := cache.get(key("a")) // a is now the most recently used
+	assert.True(t, ok)
+	cache.put(key("c"), webhookResponse{Allow: true})
+
+	_, ok = cache.get(key("b"))
+	assert.False(t, ok, "Least recently used decision must be evicted")
+	decision, ok := cache.get(key("a"))
+	assert.True(t, ok)
+	assert.True(t, decision.Allow)
+
+	clock.advance(time.Minute)
+	_, ok = cache.get(key("c"))
+	assert.False(t, ok, "Expired decision must not be returned")
+	assert.Equal(t, 1, cache.order.Len())
+
+	// Caching is disabled for a negative size
+	disabled := newDecisionCache(-1, time.Minute)
+	disabled.put(key("a"), webhookResponse{Allow: true})
+	_, ok = disabled.get(key("a"))
+	assert.False(t, ok)
+}
+
+func TestChain(t *testing.T) {
+
+	var calls int32
+	server := newWebhookServer(t, &calls)
+	defer server.Close()
+
+	policy := `
+- name: policy_1
+  actions:
+    - name: container_start
+    - name: container_create
+`
+	policyFileName := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policyFileName, []byte(policy), 0644))
+
+	anubis := NewAnubisAuthZAuthorizer(&AnubisAuthorizerSettings{PolicyPath: policyFileName})
+	chain := NewChainAuthorizer(anubis, NewWebhookAuthZAuthorizer(&WebhookAuthorizerSettings{URL: server.URL}))
+	assert.NoError(t, chain.(*chainAuthorizer).Reload())
+
+	// Both stages must allow the request
+	res := chain.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/user_1-ide/start", User: "user_1"})
+	assert.True(t, res.Allow, res.Msg)
+	res = chain.AuthZReq(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/user_2-ide/start", User: "user_1"})
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "by webhook")
+
+	// The webhook is not queried for requests denied by the policies
+	before := atomic.LoadInt32(&calls)
+	res = chain.AuthZReq(&authorization.Request{RequestMethod: http.MethodDelete, RequestURI: "/v1.41/containers/user_1-ide", User: "user_1"})
+	assert.False(t, res.Allow)
+	assert.Contains(t, res.Msg, "container_delete")
+	assert.Equal(t, before, atomic.LoadInt32(&calls))
+
+	assert.True(t, chain.AuthZRes(&authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/user_1-ide/start", User: "user_1"}).Allow)
+	assert.Equal(t, 1, chain.(*chainAuthorizer).PolicyStatus().Policies)
+}
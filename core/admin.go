@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// AdminSrv serves the probes, metrics and introspection endpoints on a TCP listener, separate from the plugin socket:
+//
+//	/healthz   liveness probe, always ok while the process serves requests
+//	/readyz    readiness probe, ok once the policies are loaded and the auditor is initialized
+//	/policies  status, source hash and content of the active (compiled) policy set
+//	/routes    route table mapping the docker API to actions
+//	/explain   dry-run evaluation of a request (POST), returning the trace of the decision
+//	/metrics   prometheus metrics
+type AdminSrv struct {
+	authorizer Authorizer   // authorizer is the authorizer introspected
+	auditor    Auditor      // auditor is the auditor probed
+	addr       string       // addr is the TCP address the endpoints are served on
+	listener   net.Listener // listener is the admin listener
+}
+
+// policiesDocument is the document served by /policies
+type policiesDocument struct {
+	Status   *PolicyStatus `yaml:"status,omitempty"`   // Status is the status of the policy loads
+	Policies interface{}   `yaml:"policies,omitempty"` // Policies are the active policies
+}
+
+// explainRequest is the document posted to /explain (YAML or JSON). The body is either a
+// JSON string or a document, encoded to JSON.
+type explainRequest struct {
+	Method string      `yaml:"method"` // Method is the request method (default GET)
+	URI    string      `yaml:"uri"`    // URI is the request URI (e.g. /v1.41/containers/create)
+	User   string      `yaml:"user"`   // User is the request user
+	Body   interface{} `yaml:"body"`   // Body is the request body
+}
+
+// NewAdminSrv creates a new admin server
+func NewAdminSrv(plugin Authorizer, auditor Auditor, addr string) *AdminSrv {
+	return &AdminSrv{authorizer: plugin, auditor: auditor, addr: addr}
+}
+
+// Start serves the admin endpoints until the context is done
+func (a *AdminSrv) Start(ctx context.Context) error {
+
+	var err error
+	a.listener, err = net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Serving admin endpoints on %q", a.listener.Addr().String())
+	return serve(ctx, &http.Server{Handler: a.Handler()}, a.listener, DefaultShutdownTimeout)
+}
+
+// Handler returns the http handler of the admin endpoints
+func (a *AdminSrv) Handler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if reasons := a.notReady(); len(reasons) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(strings.Join(reasons, "\n") + "\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/policies", func(w http.ResponseWriter, r *http.Request) {
+		var document policiesDocument
+		if reporter, ok := a.authorizer.(PolicyReporter); ok {
+			status := reporter.PolicyStatus()
+			document.Status = &status
+		}
+		if provider, ok := a.authorizer.(PolicyProvider); ok {
+			document.Policies = provider.ActivePolicies()
+		}
+		writeYAML(w, document)
+	})
+
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeYAML(w, Routes())
+	})
+
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		explainer, ok := a.authorizer.(Explainer)
+		if !ok {
+			http.Error(w, "authorizer does not explain its decisions", http.StatusNotImplemented)
+			return
+		}
+		req, err := decodeExplainRequest(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeYAML(w, explainer.Explain(req))
+	})
+
+	mux.Handle("/metrics", MetricsHandler())
+	return mux
+}
+
+// notReady returns the reasons the broker is not ready to serve requests
+func (a *AdminSrv) notReady() []string {
+	var reasons []string
+	if checker, ok := a.authorizer.(ReadinessChecker); ok {
+		if err := checker.Ready(); err != nil {
+			reasons = append(reasons, fmt.Sprintf("authorizer not ready: %s", err.Error()))
+		}
+	}
+	if reporter, ok := a.authorizer.(PolicyReporter); ok {
+		if status := reporter.PolicyStatus(); status.Reloads == 0 {
+			reason := "policies not loaded"
+			if status.LastError != "" {
+				reason += ": " + status.LastError
+			}
+			reasons = append(reasons, reason)
+		}
+	}
+	if checker, ok := a.auditor.(ReadinessChecker); ok {
+		if err := checker.Ready(); err != nil {
+			reasons = append(reasons, fmt.Sprintf("auditor not ready: %s", err.Error()))
+		}
+	}
+	return reasons
+}
+
+// decodeExplainRequest decodes the request posted to /explain into a docker authorization request
+func decodeExplainRequest(r io.Reader) (*authorization.Request, error) {
+	var document explainRequest
+	if err := yaml.NewDecoder(r).Decode(&document); err != nil {
+		return nil, fmt.Errorf("invalid explain request: %s", err.Error())
+	}
+	if document.URI == "" {
+		return nil, errors.New("invalid explain request: uri is required")
+	}
+	req := &authorization.Request{RequestMethod: strings.ToUpper(document.Method), RequestURI: document.URI, User: document.User}
+	if req.RequestMethod == "" {
+		req.RequestMethod = http.MethodGet
+	}
+	switch body := document.Body.(type) {
+	case nil:
+	case string:
+		req.RequestBody = []byte(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid explain request body: %s", err.Error())
+		}
+		req.RequestBody = data
+	}
+	return req, nil
+}
+
+// writeYAML writes the document as YAML to the response writer
+func writeYAML(w http.ResponseWriter, document interface{}) {
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
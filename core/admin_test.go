@@ -0,0 +1,153 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// reportingAuthorizer reports a policy status and its active policies
+type reportingAuthorizer struct {
+	stubAuthorizer
+	status PolicyStatus
+}
+
+func (r *reportingAuthorizer) PolicyStatus() PolicyStatus { return r.status }
+
+func (r *reportingAuthorizer) ActivePolicies() interface{} {
+	return []map[string]string{{"name": "policy_1"}}
+}
+
+// explainingAuthorizer explains its decisions by echoing the request
+type explainingAuthorizer struct {
+	stubAuthorizer
+}
+
+func (e *explainingAuthorizer) Explain(req *authorization.Request) interface{} {
+	return map[string]string{"method": req.RequestMethod, "uri": req.RequestURI, "user": req.User, "body": string(req.RequestBody)}
+}
+
+// probedAuditor reports the readiness error
+type probedAuditor struct {
+	stubAuditor
+	err error
+}
+
+func (p *probedAuditor) Ready() error { return p.err }
+
+// countingAuditor counts the audited requests
+type countingAuditor struct {
+	stubAuditor
+	requests int
+}
+
+func (c *countingAuditor) AuditRequest(req *authorization.Request, pluginRes *authorization.Response) error {
+	c.requests++
+	return nil
+}
+
+func TestAdmin(t *testing.T) {
+
+	authorizer := &reportingAuthorizer{}
+	auditor := &probedAuditor{err: errors.New("permission denied")}
+	srv := httptest.NewServer(NewAdminSrv(authorizer, auditor, "").Handler())
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(srv.URL + path)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok\n", body)
+
+	// Not ready until the policies are loaded and the auditor is initialized
+	authorizer.status = PolicyStatus{Failures: 1, LastError: "line 5: field bodyy not found"}
+	status, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, "policies not loaded: line 5: field bodyy not found")
+	assert.Contains(t, body, "auditor not ready: permission denied")
+
+	authorizer.status = PolicyStatus{Policies: 1, Reloads: 1, Hash: "sha256:abc", Sources: []string{"/etc/anubis/policy.yaml"}}
+	auditor.err = nil
+	status, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, status, body)
+
+	// Active policies are reported along their source hash
+	status, body = get("/policies")
+	assert.Equal(t, http.StatusOK, status)
+	var document struct {
+		Status   PolicyStatus        `yaml:"status"`
+		Policies []map[string]string `yaml:"policies"`
+	}
+	assert.NoError(t, yaml.Unmarshal([]byte(body), &document))
+	assert.Equal(t, "sha256:abc", document.Status.Hash)
+	assert.Equal(t, []string{"/etc/anubis/policy.yaml"}, document.Status.Sources)
+	assert.Equal(t, "policy_1", document.Policies[0]["name"])
+
+	// The route table is dumped
+	status, body = get("/routes")
+	assert.Equal(t, http.StatusOK, status)
+	var routes []RouteInfo
+	assert.NoError(t, yaml.Unmarshal([]byte(body), &routes))
+	assert.Len(t, routes, len(Routes()))
+	assert.Contains(t, routes, RouteInfo{Method: "POST", Pattern: "/containers/create", Action: ActionContainerCreate})
+
+	status, body = get("/metrics")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "go_goroutines")
+}
+
+func TestAdminExplain(t *testing.T) {
+
+	auditor := &countingAuditor{}
+	srv := httptest.NewServer(NewAdminSrv(&explainingAuthorizer{}, auditor, "").Handler())
+	defer srv.Close()
+
+	post := func(document string) (int, string) {
+		res, err := http.Post(srv.URL+"/explain", "application/json", strings.NewReader(document))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	// Body documents are encoded to JSON, both in JSON and YAML requests
+	status, body := post(`{"method":"post","uri":"/v1.41/containers/create","user":"student","body":{"Image":"alpine"}}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	var explanation map[string]string
+	assert.NoError(t, yaml.Unmarshal([]byte(body), &explanation))
+	assert.Equal(t, map[string]string{"method": "POST", "uri": "/v1.41/containers/create", "user": "student", "body": `{"Image":"alpine"}`}, explanation)
+
+	status, body = post("uri: /containers/json\nuser: student\nbody: '{\"raw\": true}'\n")
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.NoError(t, yaml.Unmarshal([]byte(body), &explanation))
+	assert.Equal(t, "GET", explanation["method"], "Requests default to GET")
+	assert.Equal(t, `{"raw": true}`, explanation["body"], "String bodies are sent as is")
+
+	status, _ = post(`{"user":"student"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	res, err := http.Get(srv.URL + "/explain")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	// Explanations are never audited
+	assert.Zero(t, auditor.requests)
+
+	// Authorizers which do not explain their decisions are reported
+	plain := httptest.NewServer(NewAdminSrv(&stubAuthorizer{}, stubAuditor{}, "").Handler())
+	defer plain.Close()
+	res, err = http.Post(plain.URL+"/explain", "application/json", strings.NewReader(`{"uri":"/_ping"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+}
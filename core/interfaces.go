@@ -20,3 +20,53 @@ type Auditor interface {
 	// Docker daemon -> authorization  -> audit -> Docker client
 	AuditResponse(req *authorization.Request, pluginRes *authorization.Response) error
 }
+
+// Mutator rewrites the body of docker requests before they are forwarded to the docker daemon.
+// The docker authorization protocol cannot mutate requests, hence mutators are only applied by the AuthZProxy.
+type Mutator interface {
+	// MutateReq returns the request body to forward to docker daemon (the original body if unchanged)
+	MutateReq(req *authorization.Request) ([]byte, error)
+}
+
+// PolicyReporter reports the status of the policies loaded by an authorizer
+type PolicyReporter interface {
+	// PolicyStatus returns the status of the policy (re)loads
+	PolicyStatus() PolicyStatus
+}
+
+// Reloader reloads the configuration of a component at runtime (e.g. upon SIGHUP)
+type Reloader interface {
+	// Reload reloads the configuration, keeping the current one if the new one is invalid
+	Reload() error
+}
+
+// ResponseMutator rewrites the body of docker daemon responses before they are returned to docker clients.
+// The docker authorization protocol cannot mutate responses, hence response mutators are only applied by the AuthZProxy.
+type ResponseMutator interface {
+	// MutateRes returns the response body to return to docker client (the original body if unchanged)
+	MutateRes(req *authorization.Request) ([]byte, error)
+}
+
+// Closer releases the resources held by a component (e.g. policy watchers, state databases) on shutdown
+type Closer interface {
+	// Close releases the resources, the component must not be used afterwards
+	Close() error
+}
+
+// PolicyProvider exposes the active policies of an authorizer for introspection
+type PolicyProvider interface {
+	// ActivePolicies returns the active (compiled) policy set, serializable to YAML
+	ActivePolicies() interface{}
+}
+
+// ReadinessChecker reports whether a component is ready to serve requests (e.g. upon readiness probes)
+type ReadinessChecker interface {
+	// Ready returns the reason the component is not ready, nil if ready
+	Ready() error
+}
+
+// Explainer explains the authorization decisions of requests, without auditing them
+type Explainer interface {
+	// Explain evaluates the request as a dry-run and returns the trace of the evaluation, serializable to YAML
+	Explain(req *authorization.Request) interface{}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Phases of the authorization flow, labelling the latency metrics
+const (
+	PhaseRequest  = "request"  // PhaseRequest is the authorization of requests (AuthZPlugin.AuthZReq)
+	PhaseResponse = "response" // PhaseResponse is the authorization of responses (AuthZPlugin.AuthZRes)
+)
+
+// Outcomes of the authorization decisions
+const (
+	OutcomeAllow = "allow" // OutcomeAllow indicates the request was allowed
+	OutcomeDeny  = "deny"  // OutcomeDeny indicates the request was denied
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anubis_authz_decisions_total",
+		Help: "Authorization decisions by action, user, deciding policy and outcome.",
+	}, []string{"action", "user", "policy", "outcome"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "anubis_authz_request_duration_seconds",
+		Help:    "Latency of the authorization of requests and responses.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16), // 100µs to ~3s
+	}, []string{"phase"})
+
+	requestBodySize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "anubis_authz_request_body_bytes",
+		Help:    "Size of the bodies of the authorized requests and responses.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 9), // 64B to 4MiB
+	}, []string{"phase"})
+
+	policyReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "anubis_authz_policy_reloads_total",
+		Help: "Policy (re)loads by result (success, failure).",
+	}, []string{"result"})
+
+	policiesLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "anubis_authz_policies",
+		Help: "Number of active policies.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		decisionsTotal, requestDuration, requestBodySize, policyReloadsTotal, policiesLoaded,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// RecordDecision counts an authorization decision. The policy is the name of the deciding policy,
+// empty if the request was denied before the policies were evaluated (e.g. invalid request).
+func RecordDecision(action, user, policy string, allow bool) {
+	outcome := OutcomeDeny
+	if allow {
+		outcome = OutcomeAllow
+	}
+	decisionsTotal.WithLabelValues(action, user, policy, outcome).Inc()
+}
+
+// RecordPolicyLoad counts a policy (re)load, and the number of active policies if it succeeded
+func RecordPolicyLoad(policies int, err error) {
+	if err != nil {
+		policyReloadsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	policyReloadsTotal.WithLabelValues("success").Inc()
+	policiesLoaded.Set(float64(policies))
+}
+
+// observeRequest records the latency and body size of the authorization of a request or response
+func observeRequest(phase string, start time.Time, bodySize int) {
+	requestDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+	requestBodySize.WithLabelValues(phase).Observe(float64(bodySize))
+}
+
+// MetricsHandler returns the http handler exposing the metrics in the prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrape returns the metrics in the prometheus text format
+func scrape(t *testing.T) string {
+	srv := httptest.NewServer(MetricsHandler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+
+	// The collectors are global, reset them such that the counts only hold this test (e.g. with -count)
+	decisionsTotal.Reset()
+	requestDuration.Reset()
+	requestBodySize.Reset()
+	policyReloadsTotal.Reset()
+	policiesLoaded.Set(0)
+
+	// Plugin requests are timed and their bodies measured
+	srv := httptest.NewServer(NewAuthZSrv(&stubAuthorizer{}, stubAuditor{}, nil).Handler())
+	defer srv.Close()
+	data, _ := json.Marshal(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.41/containers/create", RequestBody: []byte(`{"Image":"alpine"}`)})
+	_, err := http.Post(srv.URL+"/"+authorization.AuthZApiRequest, "application/json", bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, err = http.Post(srv.URL+"/"+authorization.AuthZApiResponse, "application/json", bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	RecordDecision(ActionContainerCreate, "user_1", "policy_1", true)
+	RecordDecision(ActionContainerKill, "user_1", "", false)
+	RecordPolicyLoad(3, nil)
+	RecordPolicyLoad(0, errors.New("invalid policy"))
+
+	metrics := scrape(t)
+	assert.Contains(t, metrics, `anubis_authz_request_duration_seconds_count{phase="request"}`)
+	assert.Contains(t, metrics, `anubis_authz_request_duration_seconds_count{phase="response"}`)
+	assert.Contains(t, metrics, `anubis_authz_request_body_bytes_bucket{phase="request",le="64"} 1`)
+	assert.Contains(t, metrics, `anubis_authz_decisions_total{action="container_create",outcome="allow",policy="policy_1",user="user_1"} 1`)
+	assert.Contains(t, metrics, `anubis_authz_decisions_total{action="container_kill",outcome="deny",policy="",user="user_1"} 1`)
+	assert.Contains(t, metrics, `anubis_authz_policy_reloads_total{result="failure"}`)
+	assert.Contains(t, metrics, "anubis_authz_policies 3", "Failed loads keep the policy count")
+	assert.Contains(t, metrics, "go_goroutines")
+}
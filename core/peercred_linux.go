@@ -0,0 +1,35 @@
+package core
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// peerUser returns the name of the user running the process connected to the unix socket (SO_PEERCRED),
+// or its uid if the user is unknown
+func peerUser(conn *net.UnixConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username, nil
+	}
+	return uid, nil
+}
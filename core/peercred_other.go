@@ -0,0 +1,13 @@
+//go:build !linux
+
+package core
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUser returns the name of the user running the process connected to the unix socket, which is only supported on linux
+func peerUser(conn *net.UnixConn) (string, error) {
+	return "", errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,310 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/sirupsen/logrus"
+)
+
+// maxProxyBodySize is the maximal JSON request body inspected by the proxy (same as docker daemon authorization)
+const maxProxyBodySize = 1048576
+
+// AuthZProxySettings provides settings for the authorization proxy
+type AuthZProxySettings struct {
+	SocketPath   string // SocketPath is the unix socket the proxy listens on (used by docker clients)
+	UpstreamPath string // UpstreamPath is the docker daemon unix socket requests are forwarded to
+
+	ShutdownTimeout time.Duration // ShutdownTimeout is the deadline of in-flight requests on shutdown (defaults to DefaultShutdownTimeout)
+}
+
+// AuthZProxy is a companion to the AuthZSrv that sits in front of the docker daemon socket.
+// Unlike the authorization plugin, the proxy can rewrite requests: each request is mutated by
+// the authorizer (if it implements Mutator), authorized, audited and then forwarded to docker daemon.
+// Since the mutated request is the one authorized, policies are evaluated against the effective request.
+// Likewise, each response is mutated (if the authorizer implements ResponseMutator), authorized and audited.
+type AuthZProxy struct {
+	authorizer Authorizer          // authorizer is the concrete handler for requests
+	auditor    Auditor             // auditor is used to audit input/output
+	settings   *AuthZProxySettings // settings are the proxy settings
+	lock       sync.Mutex          // lock guards the listener and server between Start and Stop
+	listener   net.Listener        // listener is the proxy socket listener
+	server     *http.Server        // server serves the proxied requests
+}
+
+// NewAuthZProxy creates a new authorization proxy
+func NewAuthZProxy(plugin Authorizer, auditor Auditor, settings *AuthZProxySettings) *AuthZProxy {
+	return &AuthZProxy{authorizer: plugin, auditor: auditor, settings: settings}
+}
+
+// Start starts the authorization proxy, until the context is done.
+// In-flight requests are then drained until the shutdown timeout, and the proxy socket is removed.
+func (p *AuthZProxy) Start(ctx context.Context) error {
+
+	err := ValidateRoutes()
+	if err != nil {
+		return err
+	}
+
+	err = p.authorizer.Init()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(p.settings.SocketPath), 0750)
+	if err != nil {
+		return err
+	}
+
+	// The listener and server are set under the lock, such that Stop sees them once the socket exists
+	p.lock.Lock()
+	os.Remove(p.settings.SocketPath)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: p.settings.SocketPath, Net: "unix"})
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	server := &http.Server{Handler: p.Handler(), ConnContext: withPeerConn}
+	p.listener, p.server = listener, server
+	p.lock.Unlock()
+
+	defer os.Remove(p.settings.SocketPath)
+
+	logrus.Infof("Proxying %q to %q", p.settings.SocketPath, p.settings.UpstreamPath)
+	return serve(ctx, server, listener, p.settings.ShutdownTimeout)
+}
+
+// Stop stops the authorization proxy immediately, without draining in-flight requests
+func (p *AuthZProxy) Stop() {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.listener == nil {
+		logrus.Warnf("Listener is nil")
+		return
+	}
+	if p.server != nil {
+		p.server.Close()
+	}
+	p.listener.Close()
+	os.Remove(p.settings.SocketPath)
+}
+
+// Handler returns the http handler authorizing and forwarding requests to docker daemon
+func (p *AuthZProxy) Handler() http.Handler {
+
+	upstream := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "docker"
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", p.settings.UpstreamPath)
+			},
+		},
+		// Flush immediately to support streaming endpoints (logs, events, stats)
+		FlushInterval:  -1,
+		ModifyResponse: p.authorizeResponse,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		authReq, err := newProxyRequest(r)
+		if err != nil {
+			writeProxyErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if mutator, ok := p.authorizer.(Mutator); ok && authReq.RequestBody != nil {
+			body, err := mutator.MutateReq(authReq)
+			if err != nil {
+				writeProxyErr(w, http.StatusForbidden, fmt.Sprintf("failed to mutate request: %s", err.Error()))
+				return
+			}
+			authReq.RequestBody = body
+		}
+
+		start := time.Now()
+		authZRes := p.authorizer.AuthZReq(authReq)
+		observeRequest(PhaseRequest, start, len(authReq.RequestBody))
+		if authZRes != nil {
+			logrus.Debugf(authZRes.Msg)
+		}
+
+		err = p.auditor.AuditRequest(authReq, authZRes)
+		if err != nil {
+			logrus.Errorf("Failed to audit request '%v'", err)
+		}
+
+		if authZRes == nil || authZRes.Err != "" {
+			writeProxyErr(w, http.StatusInternalServerError, "authorization failed")
+			return
+		}
+		if !authZRes.Allow {
+			writeProxyErr(w, http.StatusForbidden, fmt.Sprintf("authorization denied by plugin %s: %s", DefaultPluginName, authZRes.Msg))
+			return
+		}
+
+		if authReq.RequestBody != nil {
+			r.Body = io.NopCloser(bytes.NewReader(authReq.RequestBody))
+			r.ContentLength = int64(len(authReq.RequestBody))
+			r.Header.Set("Content-Length", strconv.Itoa(len(authReq.RequestBody)))
+		}
+		upstream.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, authReq)))
+	})
+}
+
+// proxyRequestKey is the context key of the authorization request of a proxied request
+type proxyRequestKey struct{}
+
+// authorizeResponse mutates, authorizes and audits the docker daemon response. Only JSON bodies of known
+// length are read (e.g. event and log streams are not), and denied responses are replaced by an error.
+func (p *AuthZProxy) authorizeResponse(resp *http.Response) error {
+
+	authReq, ok := resp.Request.Context().Value(proxyRequestKey{}).(*authorization.Request)
+	if !ok {
+		return nil
+	}
+
+	authReq.ResponseStatusCode = resp.StatusCode
+	authReq.ResponseHeaders = make(map[string]string)
+	for k := range resp.Header {
+		authReq.ResponseHeaders[k] = resp.Header.Get(k)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "application/json" && resp.ContentLength >= 0 && resp.ContentLength <= maxProxyBodySize {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		authReq.ResponseBody = body
+		setProxyBody(resp, body)
+	}
+
+	if mutator, ok := p.authorizer.(ResponseMutator); ok && authReq.ResponseBody != nil {
+		body, err := mutator.MutateRes(authReq)
+		if err != nil {
+			setProxyErr(resp, http.StatusForbidden, fmt.Sprintf("authorization denied by plugin %s: %s", DefaultPluginName, err.Error()))
+			return nil
+		}
+		authReq.ResponseBody = body
+		setProxyBody(resp, body)
+	}
+
+	start := time.Now()
+	authZRes := p.authorizer.AuthZRes(authReq)
+	observeRequest(PhaseResponse, start, len(authReq.ResponseBody))
+	if authZRes != nil && authZRes.Msg != "" {
+		logrus.Debugf(authZRes.Msg)
+	}
+
+	err := p.auditor.AuditResponse(authReq, authZRes)
+	if err != nil {
+		logrus.Errorf("Failed to audit response '%v'", err)
+	}
+
+	if authZRes == nil || authZRes.Err != "" {
+		setProxyErr(resp, http.StatusInternalServerError, "authorization failed")
+	} else if !authZRes.Allow {
+		setProxyErr(resp, http.StatusForbidden, fmt.Sprintf("authorization denied by plugin %s: %s", DefaultPluginName, authZRes.Msg))
+	}
+	return nil
+}
+
+// setProxyBody replaces the body of the response
+func setProxyBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// setProxyErr replaces the response by an error response in the docker API format
+func setProxyErr(resp *http.Response, status int, msg string) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	data, _ := json.Marshal(map[string]string{"message": msg})
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	resp.Header = http.Header{"Content-Type": []string{"application/json"}}
+	setProxyBody(resp, data)
+}
+
+// peerConnKey is the context key of the client connection of a proxied request
+type peerConnKey struct{}
+
+// withPeerConn stores the client connection in the context of its requests, to identify the client
+func withPeerConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, peerConnKey{}, c)
+}
+
+// newProxyRequest converts a docker client request to an authorization request. Only JSON bodies are
+// read (e.g. build contexts are streamed), and bodies larger than maxProxyBodySize are rejected.
+// The user is the common name of the client certificate, or the name of the user running the client
+// process connected to the proxy socket (see peerUser).
+func newProxyRequest(r *http.Request) (*authorization.Request, error) {
+
+	authReq := &authorization.Request{
+		RequestMethod:  r.Method,
+		RequestURI:     (&url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}).String(),
+		RequestHeaders: make(map[string]string),
+	}
+
+	for k := range r.Header {
+		authReq.RequestHeaders[k] = r.Header.Get(k)
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		authReq.User = r.TLS.PeerCertificates[0].Subject.CommonName
+		authReq.UserAuthNMethod = "TLS"
+	} else if conn, ok := r.Context().Value(peerConnKey{}).(*net.UnixConn); ok {
+		user, err := peerUser(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to identify client: %s", err.Error())
+		}
+		authReq.User = user
+		authReq.UserAuthNMethod = "peercred"
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || contentType != "application/json" {
+		return authReq, nil
+	}
+
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxProxyBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxProxyBodySize {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxProxyBodySize)
+	}
+	authReq.RequestBody = body
+	return authReq, nil
+}
+
+// writeProxyErr writes an error response in the docker API format
+func writeProxyErr(w http.ResponseWriter, status int, msg string) {
+	data, _ := json.Marshal(map[string]string{"message": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubAuthorizer denies container_kill and rewrites request bodies to a fixed body
+type stubAuthorizer struct {
+	body []byte
+}
+
+func (s *stubAuthorizer) Init() error { return nil }
+
+func (s *stubAuthorizer) AuthZReq(req *authorization.Request) *authorization.Response {
+	if ParseRoute(req.RequestMethod, req.RequestURI).Action == ActionContainerKill {
+		return &authorization.Response{Allow: false, Msg: "kill not allowed"}
+	}
+	return &authorization.Response{Allow: true}
+}
+
+// AuthZRes denies responses exposing secrets
+func (s *stubAuthorizer) AuthZRes(req *authorization.Request) *authorization.Response {
+	if strings.Contains(string(req.ResponseBody), "secret") {
+		return &authorization.Response{Allow: false, Msg: "secret exposed"}
+	}
+	return &authorization.Response{Allow: true}
+}
+
+func (s *stubAuthorizer) MutateReq(req *authorization.Request) ([]byte, error) {
+	return s.body, nil
+}
+
+// MutateRes redacts passwords
+func (s *stubAuthorizer) MutateRes(req *authorization.Request) ([]byte, error) {
+	return []byte(strings.ReplaceAll(string(req.ResponseBody), "password", "********")), nil
+}
+
+type stubAuditor struct{}
+
+func (stubAuditor) AuditRequest(req *authorization.Request, pluginRes *authorization.Response) error {
+	return nil
+}
+
+func (stubAuditor) AuditResponse(req *authorization.Request, pluginRes *authorization.Response) error {
+	return nil
+}
+
+func TestProxy(t *testing.T) {
+
+	// Fake docker daemon echoing the received body
+	upstreamPath := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", upstreamPath)
+	assert.NoError(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path + " " + string(body)))
+	})}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	proxy := NewAuthZProxy(&stubAuthorizer{body: []byte(`{"Image":"patched"}`)}, stubAuditor{}, &AuthZProxySettings{UpstreamPath: upstreamPath})
+	srv := httptest.NewServer(proxy.Handler())
+	defer srv.Close()
+
+	// JSON bodies are mutated before being forwarded
+	res, err := http.Post(srv.URL+"/v1.41/containers/create", "application/json", strings.NewReader(`{"Image":"alpine"}`))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `/v1.41/containers/create {"Image":"patched"}`, string(body))
+
+	// Other bodies are streamed unchanged
+	res, err = http.Post(srv.URL+"/v1.41/build", "application/x-tar", strings.NewReader("context"))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, `/v1.41/build context`, string(body))
+
+	// Denied requests are not forwarded
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/v1.41/containers/id/kill", nil)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Contains(t, string(body), "kill not allowed")
+}
+
+func TestProxyResponse(t *testing.T) {
+
+	// Fake docker daemon returning the requested JSON body, or streaming it
+	upstreamPath := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", upstreamPath)
+	assert.NoError(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body := []byte(r.URL.Query().Get("body"))
+		if r.URL.Query().Get("stream") != "" {
+			// Chunked response of unknown length
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.Write(body)
+	})}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	proxy := NewAuthZProxy(&stubAuthorizer{}, stubAuditor{}, &AuthZProxySettings{UpstreamPath: upstreamPath})
+	srv := httptest.NewServer(proxy.Handler())
+	defer srv.Close()
+
+	get := func(query string) (int, string) {
+		res, err := http.Get(srv.URL + "/v1.41/containers/id/json?" + query)
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get(url.Values{"body": {`{"Env":["password"]}`}}.Encode())
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"Env":["********"]}`, body, "Responses must be mutated")
+
+	status, body = get(url.Values{"body": {`{"Env":["secret"]}`}}.Encode())
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, "secret exposed", "Denied responses must be replaced")
+
+	status, body = get(url.Values{"body": {`{"Env":["secret"]}`}, "stream": {"1"}}.Encode())
+	assert.Equal(t, http.StatusOK, status, "Streamed responses must not be inspected")
+	assert.Equal(t, `{"Env":["secret"]}`, body)
+}
+
+// userAuthorizer denies the requests of users other than the allowed user
+type userAuthorizer struct {
+	stubAuthorizer
+	user string
+}
+
+func (u *userAuthorizer) AuthZReq(req *authorization.Request) *authorization.Response {
+	if req.User != u.user || req.UserAuthNMethod != "peercred" {
+		return &authorization.Response{Allow: false, Msg: fmt.Sprintf("user '%s' not allowed", req.User)}
+	}
+	return &authorization.Response{Allow: true}
+}
+
+func TestProxyPeerUser(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	current, err := user.Current()
+	assert.NoError(t, err)
+
+	upstreamPath := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", upstreamPath)
+	assert.NoError(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	// The clients connected to the proxy socket are identified by the user running them
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	proxy := NewAuthZProxy(&userAuthorizer{user: current.Username}, stubAuditor{}, &AuthZProxySettings{SocketPath: socketPath, UpstreamPath: upstreamPath})
+	go proxy.Start(context.Background())
+	waitFile(t, socketPath)
+	defer proxy.Stop()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}}}
+	res, err := client.Get("http://docker/_ping")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	assert.Equal(t, "OK", string(body))
+}
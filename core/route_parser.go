@@ -1,89 +1,118 @@
 package core
 
 import (
+	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 )
 
+// route maps a docker API path template and method to a docker action.
+// Path templates consist of literal segments and named path parameters, where
+// {name} matches a single path segment and {name:.+} matches one or more segments
+// (e.g. image names that contain a registry or repository).
 type route struct {
 	pattern string
 	method  string
 	action  string
 }
 
+// Route is the result of parsing a docker API request
+type Route struct {
+	Action     string            // Action is the docker action (ActionNone if no route matched)
+	APIVersion string            // APIVersion is the API version prefix of the request (e.g. 1.41), empty for unversioned requests
+	Params     map[string]string // Params are the named path parameters of the route (e.g. container, image, network, exec)
+	Pattern    string            // Pattern is the path template of the matched route
+}
+
 var routes = []route{
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#build-image-from-a-dockerfile
 	{pattern: "/build", method: "POST", action: ActionImageBuild},
+	// https://docs.docker.com/engine/api/v1.47/#operation/BuildPrune
+	{pattern: "/build/prune", method: "POST", action: ActionBuildPrune},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#create-a-new-image-from-a-container-s-changes
 	{pattern: "/commit", method: "POST", action: ActionContainerCommit},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#monitor-docker-s-events
-	{pattern: "/events", method: "POST", action: ActionDockerEvents},
+	{pattern: "/events", method: "GET", action: ActionDockerEvents},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#show-the-docker-version-information
 	{pattern: "/version", method: "GET", action: ActionDockerVersion},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#check-auth-configuration
 	{pattern: "/auth", method: "POST", action: ActionDockerCheckAuth},
+	// https://docs.docker.com/engine/api/v1.47/#operation/SystemDataUsage
+	{pattern: "/system/df", method: "GET", action: ActionDockerDataUsage},
+	// https://docs.docker.com/engine/api/v1.47/#operation/Session
+	{pattern: "/session", method: "POST", action: ActionDockerSession},
+	// BuildKit gRPC endpoint (upgraded to HTTP/2), used by buildx and the docker CLI
+	{pattern: "/grpc", method: "POST", action: ActionDockerGRPC},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#wait-a-container
-	{pattern: "/containers/.+/wait", method: "POST", action: ActionContainerWait},
+	{pattern: "/containers/{container}/wait", method: "POST", action: ActionContainerWait},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#resize-a-container-tty
-	{pattern: "/containers/.+/resize", method: "POST", action: ActionContainerResize},
+	{pattern: "/containers/{container}/resize", method: "POST", action: ActionContainerResize},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#export-a-container
-	{pattern: "/containers/.+/export", method: "POST", action: ActionContainerExport},
+	{pattern: "/containers/{container}/export", method: "GET", action: ActionContainerExport},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#export-a-container
-	{pattern: "/containers/.+/stop", method: "POST", action: ActionContainerStop},
+	{pattern: "/containers/{container}/stop", method: "POST", action: ActionContainerStop},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#kill-a-container
-	{pattern: "/containers/.*/kill", method: "POST", action: ActionContainerKill},
+	{pattern: "/containers/{container}/kill", method: "POST", action: ActionContainerKill},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#restart-a-container
-	{pattern: "/containers/.+/restart", method: "POST", action: ActionContainerRestart},
+	{pattern: "/containers/{container}/restart", method: "POST", action: ActionContainerRestart},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#start-a-container
-	{pattern: "/containers/.+/start", method: "POST", action: ActionContainerStart},
+	{pattern: "/containers/{container}/start", method: "POST", action: ActionContainerStart},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#exec-create
-	{pattern: "/containers/.+/exec", method: "POST", action: ActionContainerExecCreate},
+	{pattern: "/containers/{container}/exec", method: "POST", action: ActionContainerExecCreate},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#unpause-a-container
-	{pattern: "/containers/.+/unpause", method: "POST", action: ActionContainerUnpause},
+	{pattern: "/containers/{container}/unpause", method: "POST", action: ActionContainerUnpause},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#pause-a-container
-	{pattern: "/containers/.+/pause", method: "POST", action: ActionContainerPause},
+	{pattern: "/containers/{container}/pause", method: "POST", action: ActionContainerPause},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#copy-files-or-folders-from-a-container
-	{pattern: "/containers/.+/copy", method: "POST", action: ActionContainerCopyFiles},
+	{pattern: "/containers/{container}/copy", method: "POST", action: ActionContainerCopyFiles},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#extract-an-archive-of-files-or-folders-to-a-directory-in-a-container
-	{pattern: "/containers/.+/archive", method: "PUT", action: ActionContainerArchiveExtract},
-	{pattern: "/containers/.+/archive", method: "HEAD", action: ActionContainerArchiveInfo},
+	{pattern: "/containers/{container}/archive", method: "PUT", action: ActionContainerArchiveExtract},
+	{pattern: "/containers/{container}/archive", method: "HEAD", action: ActionContainerArchiveInfo},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#get-an-archive-of-a-filesystem-resource-in-a-container
-	{pattern: "/containers/.+/archive", method: "GET", action: ActionContainerArchive},
+	{pattern: "/containers/{container}/archive", method: "GET", action: ActionContainerArchive},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#attach-to-a-container-websocket
-	{pattern: "/containers/.+/attach/ws", method: "GET", action: ActionContainerAttachWs},
+	{pattern: "/containers/{container}/attach/ws", method: "GET", action: ActionContainerAttachWs},
 	// http://docs.docker.com/reference/api/docker_remote_api_v1.21/#attach-to-a-container
-	{pattern: "/containers/.+/attach", method: "POST", action: ActionContainerAttach},
+	{pattern: "/containers/{container}/attach", method: "POST", action: ActionContainerAttach},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#list-containers
 	{pattern: "/containers/json", method: "GET", action: ActionContainerList},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#inspect-a-container
-	{pattern: "/containers/.+/json", method: "GET", action: ActionContainerInspect},
+	{pattern: "/containers/{container}/json", method: "GET", action: ActionContainerInspect},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#remove-a-container
-	{pattern: "/containers/.+", method: "DELETE", action: ActionContainerDelete},
+	{pattern: "/containers/{container}", method: "DELETE", action: ActionContainerDelete},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#rename-a-container
-	{pattern: "/containers/.+/rename", method: "POST", action: ActionContainerRename},
+	{pattern: "/containers/{container}/rename", method: "POST", action: ActionContainerRename},
+	// https://docs.docker.com/engine/api/v1.47/#operation/ContainerUpdate
+	{pattern: "/containers/{container}/update", method: "POST", action: ActionContainerUpdate},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#get-container-stats-based-on-resource-usage
-	{pattern: "/containers/.+/stats", method: "GET", action: ActionContainerStats},
+	{pattern: "/containers/{container}/stats", method: "GET", action: ActionContainerStats},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#inspect-changes-on-a-container-s-filesystem
-	{pattern: "/containers/.+/changes", method: "GET", action: ActionContainerChanges},
+	{pattern: "/containers/{container}/changes", method: "GET", action: ActionContainerChanges},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#list-processes-running-inside-a-container
-	{pattern: "/containers/.+/top", method: "GET", action: ActionContainerTop},
+	{pattern: "/containers/{container}/top", method: "GET", action: ActionContainerTop},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#get-container-logs
-	{pattern: "/containers/.+/logs", method: "GET", action: ActionContainerLogs},
+	{pattern: "/containers/{container}/logs", method: "GET", action: ActionContainerLogs},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#create-a-container
 	{pattern: "/containers/create", method: "POST", action: ActionContainerCreate},
+	// https://docs.docker.com/engine/api/v1.47/#operation/ContainerPrune
+	{pattern: "/containers/prune", method: "POST", action: ActionContainerPrune},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#get-a-tarball-containing-all-images
-	{pattern: "/images/.+./get", method: "GET", action: ActionImageArchive},
+	{pattern: "/images/{image:.+}/get", method: "GET", action: ActionImageArchive},
+	// https://docs.docker.com/engine/api/v1.47/#operation/ImageGetAll
+	{pattern: "/images/get", method: "GET", action: ActionImageArchive},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#search-images
 	{pattern: "/images/search", method: "GET", action: ActionImagesSearch},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#tag-an-image-into-a-repository
-	{pattern: "/images/.+/tag", method: "POST", action: ActionImageTag},
+	{pattern: "/images/{image:.+}/tag", method: "POST", action: ActionImageTag},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#inspect-an-image
-	{pattern: "/images/.+/json", method: "GET", action: ActionImageInspect},
+	{pattern: "/images/{image:.+}/json", method: "GET", action: ActionImageInspect},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.18/#inspect-an-image
-	{pattern: "/images/.+", method: "DELETE", action: ActionImageDelete},
+	{pattern: "/images/{image:.+}", method: "DELETE", action: ActionImageDelete},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#get-the-history-of-an-image
-	{pattern: "/images/.+/history", method: "GET", action: ActionImageHistory},
+	{pattern: "/images/{image:.+}/history", method: "GET", action: ActionImageHistory},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#push-an-image-on-the-registry
-	{pattern: "/images/.+/push", method: "POST", action: ActionImagePush},
+	{pattern: "/images/{image:.+}/push", method: "POST", action: ActionImagePush},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#create-an-image
 	{pattern: "/images/create", method: "POST", action: ActionImageCreate},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#load-a-tarball-with-a-set-of-images-and-tags-into-docker
@@ -94,32 +123,42 @@ var routes = []route{
 	{pattern: "/images/prune", method: "POST", action: ActionImagePrune},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#ping-the-docker-server
 	{pattern: "/_ping", method: "GET", action: ActionDockerPing},
+	// https://docs.docker.com/engine/api/v1.47/#operation/SystemPingHead
+	{pattern: "/_ping", method: "HEAD", action: ActionDockerPing},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#display-system-wide-information
 	{pattern: "/info", method: "GET", action: ActionDockerInfo},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#exec-inspect
-	{pattern: "/exec/.+/json", method: "GET", action: ActionContainerExecInspect},
+	{pattern: "/exec/{exec}/json", method: "GET", action: ActionContainerExecInspect},
 	// https://docs.docker.com/reference/api/docker_remote_api_v1.21/#exec-start
-	{pattern: "/exec/.+/start", method: "POST", action: ActionContainerExecStart},
+	{pattern: "/exec/{exec}/start", method: "POST", action: ActionContainerExecStart},
+	// https://docs.docker.com/engine/api/v1.47/#operation/ExecResize
+	{pattern: "/exec/{exec}/resize", method: "POST", action: ActionContainerExecResize},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#inspect-a-volume
-	{pattern: "/volumes/.+", method: "GET", action: ActionVolumeInspect},
+	{pattern: "/volumes/{volume}", method: "GET", action: ActionVolumeInspect},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#list-volumes
 	{pattern: "/volumes", method: "GET", action: ActionVolumeList},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#create-a-volume
 	{pattern: "/volumes/create", method: "POST", action: ActionVolumeCreate},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#remove-a-volume
-	{pattern: "/volumes/.+", method: "DELETE", action: ActionVolumeRemove},
+	{pattern: "/volumes/{volume}", method: "DELETE", action: ActionVolumeRemove},
+	// https://docs.docker.com/engine/api/v1.47/#operation/VolumeUpdate
+	{pattern: "/volumes/{volume}", method: "PUT", action: ActionVolumeUpdate},
+	// https://docs.docker.com/engine/api/v1.47/#operation/VolumePrune
+	{pattern: "/volumes/prune", method: "POST", action: ActionVolumePrune},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#inspect-network
-	{pattern: "/networks/.+", method: "GET", action: ActionNetworkInspect},
+	{pattern: "/networks/{network}", method: "GET", action: ActionNetworkInspect},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#list-networks
 	{pattern: "/networks", method: "GET", action: ActionNetworkList},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#create-a-network
 	{pattern: "/networks/create", method: "POST", action: ActionNetworkCreate},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#connect-a-container-to-a-network
-	{pattern: "/networks/.+/connect", method: "POST", action: ActionNetworkConnect},
+	{pattern: "/networks/{network}/connect", method: "POST", action: ActionNetworkConnect},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#disconnect-a-container-from-a-network
-	{pattern: "/networks/.+/disconnect", method: "POST", action: ActionNetworkDisconnect},
+	{pattern: "/networks/{network}/disconnect", method: "POST", action: ActionNetworkDisconnect},
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#remove-a-network
-	{pattern: "/networks/.+", method: "DELETE", action: ActionNetworkRemove},
+	{pattern: "/networks/{network}", method: "DELETE", action: ActionNetworkRemove},
+	// https://docs.docker.com/engine/api/v1.47/#operation/NetworkPrune
+	{pattern: "/networks/prune", method: "POST", action: ActionNetworkPrune},
 	// https://docs.docker.com/engine/api/v1.37/#operation/SwarmInit
 	{pattern: "/swarm/init", method: "POST", action: ActionSwarmInit},
 	// https://docs.docker.com/engine/api/v1.37/#operation/SwarmJoin
@@ -135,64 +174,221 @@ var routes = []route{
 	// https://docs.docker.com/engine/api/v1.37/#operation/SwarmInspect
 	{pattern: "/swarm", method: "GET", action: ActionSwarmInspect},
 	// https://docs.docker.com/engine/api/v1.39/#operation/NodeUpdate
-	{pattern: "/nodes/.+/update", method: "POST", action: ActionNodeUpdate},
+	{pattern: "/nodes/{node}/update", method: "POST", action: ActionNodeUpdate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/NodeInspect
-	{pattern: "/nodes/.+", method: "GET", action: ActionNodeInspect},
+	{pattern: "/nodes/{node}", method: "GET", action: ActionNodeInspect},
 	// https://docs.docker.com/engine/api/v1.39/#operation/NodeDelete
-	{pattern: "/nodes/.+", method: "DELETE", action: ActionNodeDelete},
+	{pattern: "/nodes/{node}", method: "DELETE", action: ActionNodeDelete},
 	// https://docs.docker.com/engine/api/v1.39/#operation/NodeList
 	{pattern: "/nodes", method: "GET", action: ActionNodeList},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceCreate
 	{pattern: "/services/create", method: "POST", action: ActionServiceCreate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceUpdate
-	{pattern: "/services/.+/update", method: "POST", action: ActionServiceUpdate},
+	{pattern: "/services/{service}/update", method: "POST", action: ActionServiceUpdate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceLogs
-	{pattern: "/services/.+/logs", method: "GET", action: ActionServiceLogs},
+	{pattern: "/services/{service}/logs", method: "GET", action: ActionServiceLogs},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceInspect
-	{pattern: "/services/.+", method: "GET", action: ActionServiceInspect},
+	{pattern: "/services/{service}", method: "GET", action: ActionServiceInspect},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceDelete
-	{pattern: "/services/.+", method: "DELETE", action: ActionServiceDelete},
+	{pattern: "/services/{service}", method: "DELETE", action: ActionServiceDelete},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ServiceList
 	{pattern: "/services", method: "GET", action: ActionServiceList},
 	// https://docs.docker.com/engine/api/v1.39/#operation/TaskInspect
-	{pattern: "/tasks/.+", method: "GET", action: ActionTaskInspect},
+	{pattern: "/tasks/{task}", method: "GET", action: ActionTaskInspect},
+	// https://docs.docker.com/engine/api/v1.47/#operation/TaskLogs
+	{pattern: "/tasks/{task}/logs", method: "GET", action: ActionTaskLogs},
 	// https://docs.docker.com/engine/api/v1.39/#operation/TaskList
 	{pattern: "/tasks", method: "GET", action: ActionTaskList},
 	// https://docs.docker.com/engine/api/v1.39/#operation/SecretCreate
 	{pattern: "/secrets/create", method: "POST", action: ActionSecretCreate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/SecretUpdate
-	{pattern: "/secrets/.+/update", method: "POST", action: ActionSecretUpdate},
+	{pattern: "/secrets/{secret}/update", method: "POST", action: ActionSecretUpdate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/SecretInspect
-	{pattern: "/secrets/.+", method: "GET", action: ActionSecretInspect},
+	{pattern: "/secrets/{secret}", method: "GET", action: ActionSecretInspect},
 	// https://docs.docker.com/engine/api/v1.39/#operation/SecretDelete
-	{pattern: "/secrets/.+", method: "DELETE", action: ActionSecretDelete},
+	{pattern: "/secrets/{secret}", method: "DELETE", action: ActionSecretDelete},
 	// https://docs.docker.com/engine/api/v1.39/#operation/SecretList
 	{pattern: "/secrets", method: "GET", action: ActionSecretList},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ConfigCreate
 	{pattern: "/configs/create", method: "POST", action: ActionConfigCreate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ConfigUpdate
-	{pattern: "/configs/.+/update", method: "POST", action: ActionConfigUpdate},
+	{pattern: "/configs/{config}/update", method: "POST", action: ActionConfigUpdate},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ConfigInspect
-	{pattern: "/configs/.+", method: "GET", action: ActionConfigInspect},
+	{pattern: "/configs/{config}", method: "GET", action: ActionConfigInspect},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ConfigDelete
-	{pattern: "/configs/.+", method: "DELETE", action: ActionConfigDelete},
+	{pattern: "/configs/{config}", method: "DELETE", action: ActionConfigDelete},
 	// https://docs.docker.com/engine/api/v1.39/#operation/ConfigList
 	{pattern: "/configs", method: "GET", action: ActionConfigList},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginList
+	{pattern: "/plugins", method: "GET", action: ActionPluginList},
+	// https://docs.docker.com/engine/api/v1.47/#operation/GetPluginPrivileges
+	{pattern: "/plugins/privileges", method: "GET", action: ActionPluginPrivileges},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginPull
+	{pattern: "/plugins/pull", method: "POST", action: ActionPluginPull},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginCreate
+	{pattern: "/plugins/create", method: "POST", action: ActionPluginCreate},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginInspect
+	{pattern: "/plugins/{plugin:.+}/json", method: "GET", action: ActionPluginInspect},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginDelete
+	{pattern: "/plugins/{plugin:.+}", method: "DELETE", action: ActionPluginDelete},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginEnable
+	{pattern: "/plugins/{plugin:.+}/enable", method: "POST", action: ActionPluginEnable},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginDisable
+	{pattern: "/plugins/{plugin:.+}/disable", method: "POST", action: ActionPluginDisable},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginUpgrade
+	{pattern: "/plugins/{plugin:.+}/upgrade", method: "POST", action: ActionPluginUpgrade},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginPush
+	{pattern: "/plugins/{plugin:.+}/push", method: "POST", action: ActionPluginPush},
+	// https://docs.docker.com/engine/api/v1.47/#operation/PluginSet
+	{pattern: "/plugins/{plugin:.+}/set", method: "POST", action: ActionPluginSet},
 	// https://docs.docker.com/engine/api/v1.39/#operation/DistributionInspect
-	{pattern: "/distribution/.+/json", method: "GET", action: ActionDistributionInspect},
+	{pattern: "/distribution/{image:.+}/json", method: "GET", action: ActionDistributionInspect},
+}
+
+// RouteInfo describes an entry of the route table
+type RouteInfo struct {
+	Method  string `yaml:"method"`  // Method is the HTTP method
+	Pattern string `yaml:"pattern"` // Pattern is the path template (without the API version prefix)
+	Action  string `yaml:"action"`  // Action is the docker action the route maps to
+}
+
+// Routes returns the route table, sorted by pattern and method
+func Routes() []RouteInfo {
+	infos := make([]RouteInfo, 0, len(routes))
+	for _, r := range routes {
+		infos = append(infos, RouteInfo{Method: r.method, Pattern: r.pattern, Action: r.action})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Pattern != infos[j].Pattern {
+			return infos[i].Pattern < infos[j].Pattern
+		}
+		return infos[i].Method < infos[j].Method
+	})
+	return infos
+}
+
+// compiledRoute is a route compiled into an anchored regular expression
+type compiledRoute struct {
+	route
+	segments []string       // segments are the path template segments
+	regex    *regexp.Regexp // regex is the anchored path expression
 }
 
-// ParseRoute convert a method/url pattern to corresponding docker action
-func ParseRoute(method, url string) string {
-	for _, route := range routes {
-		if route.method == method {
-			match, err := regexp.MatchString(route.pattern, url)
-			if err == nil && match {
-				return route.action
+// versionPrefix matches the optional API version prefix of a request path
+var versionPrefix = regexp.MustCompile(`^/v([0-9]+(?:\.[0-9]+)?)(/.*)$`)
+
+// paramSegment matches a named path parameter segment
+var paramSegment = regexp.MustCompile(`^\{([a-z_]+)(:\.\+)?\}$`)
+
+// routeTable holds the compiled routes indexed by method
+var routeTable = compileRoutes(routes)
+
+// compileRoutes compiles the route templates into anchored expressions indexed by method
+func compileRoutes(routes []route) map[string][]*compiledRoute {
+	table := make(map[string][]*compiledRoute)
+	for _, r := range routes {
+		segments := strings.Split(strings.TrimPrefix(r.pattern, "/"), "/")
+		var expr strings.Builder
+		expr.WriteString("^")
+		for _, segment := range segments {
+			expr.WriteString("/")
+			if m := paramSegment.FindStringSubmatch(segment); m != nil {
+				if m[2] != "" {
+					expr.WriteString(fmt.Sprintf("(?P<%s>.+)", m[1]))
+				} else {
+					expr.WriteString(fmt.Sprintf("(?P<%s>[^/]+)", m[1]))
+				}
+			} else {
+				expr.WriteString(regexp.QuoteMeta(segment))
 			}
+		}
+		expr.WriteString("$")
+		table[r.method] = append(table[r.method], &compiledRoute{route: r, segments: segments, regex: regexp.MustCompile(expr.String())})
+	}
+	return table
+}
+
+// ValidateRoutes verifies no request can be matched by more than one route, such that
+// the order of the route table never decides the action
+func ValidateRoutes() error {
+	var conflicts []string
+	methods := make([]string, 0, len(routeTable))
+	for method := range routeTable {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
 
+	for _, method := range methods {
+		table := routeTable[method]
+		for i := 0; i < len(table); i++ {
+			for j := i + 1; j < len(table); j++ {
+				if segmentsOverlap(table[i].segments, table[j].segments) {
+					conflicts = append(conflicts, fmt.Sprintf("%s %s (%s) and %s (%s)", method,
+						table[i].pattern, table[i].action, table[j].pattern, table[j].action))
+				}
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("ambiguous routes: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// segmentsOverlap returns true if a request path exists that matches both path templates
+func segmentsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == 0 && len(b) == 0
+	}
+
+	aParam, aMulti := segmentKind(a[0])
+	bParam, bMulti := segmentKind(b[0])
+
+	switch {
+	case aMulti && bMulti:
+		return segmentsOverlap(a[1:], b[1:]) || segmentsOverlap(a, b[1:]) || segmentsOverlap(a[1:], b)
+	case aMulti:
+		return segmentsOverlap(a[1:], b[1:]) || segmentsOverlap(a, b[1:])
+	case bMulti:
+		return segmentsOverlap(a[1:], b[1:]) || segmentsOverlap(a[1:], b)
+	case aParam || bParam || a[0] == b[0]:
+		return segmentsOverlap(a[1:], b[1:])
+	}
+	return false
+}
+
+// segmentKind returns whether the path template segment is a parameter, and whether it spans multiple segments
+func segmentKind(segment string) (param bool, multi bool) {
+	m := paramSegment.FindStringSubmatch(segment)
+	if m == nil {
+		return false, false
+	}
+	return true, m[2] != ""
+}
+
+// ParseRoute convert a method/url pattern to corresponding docker route, consisting of
+// the docker action, the API version and the named path parameters
+func ParseRoute(method, url string) Route {
+	version := ""
+	if m := versionPrefix.FindStringSubmatch(url); m != nil {
+		version, url = m[1], m[2]
+	}
+
+	for _, r := range routeTable[method] {
+		m := r.regex.FindStringSubmatch(url)
+		if m == nil {
+			continue
+		}
+
+		params := make(map[string]string)
+		for i, name := range r.regex.SubexpNames() {
+			if name != "" {
+				params[name] = m[i]
+			}
 		}
+		return Route{Action: r.action, APIVersion: version, Params: params, Pattern: r.pattern}
 	}
 
-	return ActionNone
+	return Route{Action: ActionNone, APIVersion: version}
 }
@@ -1,9 +1,13 @@
 package core
 
 import (
+	"os"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestRouteParser(t *testing.T) {
@@ -28,7 +32,7 @@ func TestRouteParser(t *testing.T) {
 		{"POST", "/v1.21/exec/id/start", ActionContainerExecStart},
 		{"HEAD", "/v1.21/containers/id/archive", ActionContainerArchiveInfo},
 		{"PUT", "/v1.21/containers/id/archive", ActionContainerArchiveExtract},
-		{"POST", "/v1.21/containers/id/export", ActionContainerExport},
+		{"GET", "/v1.21/containers/id/export", ActionContainerExport},
 		{"POST", "/v1.21/containers/id/attach", ActionContainerAttach},
 		{"GET", "/v1.21/containers/id/attach/ws", ActionContainerAttachWs},
 		{"GET", "/v1.21/containers/id/json", ActionContainerInspect},
@@ -47,7 +51,10 @@ func TestRouteParser(t *testing.T) {
 		{"POST", "/v1.21/images/create", ActionImageCreate},
 		{"POST", "/v1.21/images/load", ActionImageLoad},
 		{"GET", "/v1.21/images/json", ActionImageList},
-		{"POST", "/v1.21/images/build", ActionImageBuild},
+		{"POST", "/v1.21/images/build", ActionNone}, // Routes are anchored, /build must not match
+		{"DELETE", "/v1.21/containers/id/json", ActionNone},
+		{"GET", "/v1.21/containers/id/json/extra", ActionNone},
+		{"GET", "/version", ActionDockerVersion},
 		{"GET", "/v1.21/images/id/json", ActionImageInspect},
 		{"DELETE", "/v1.21/images/id", ActionImageDelete},
 		{"POST", "/v1.37/images/prune", ActionImagePrune},
@@ -93,9 +100,107 @@ func TestRouteParser(t *testing.T) {
 		{"DELETE", "/v1.39/configs/id", ActionConfigDelete},
 		{"POST", "/v1.39/configs/id/update", ActionConfigUpdate},
 		{"GET", "/v1.39/distribution/twistlock/authz-broker:latest/json", ActionDistributionInspect},
+		{"GET", "/v1.47/events", ActionDockerEvents},
+		{"GET", "/v1.47/system/df", ActionDockerDataUsage},
+		{"HEAD", "/_ping", ActionDockerPing},
+		{"POST", "/session", ActionDockerSession},
+		{"POST", "/grpc", ActionDockerGRPC},
+		{"POST", "/v1.47/containers/id/update", ActionContainerUpdate},
+		{"POST", "/v1.47/containers/prune", ActionContainerPrune},
+		{"POST", "/v1.47/exec/id/resize", ActionContainerExecResize},
+		{"GET", "/v1.47/images/registry.anubis-lms.io/anubis/theia:latest/get", ActionImageArchive},
+		{"GET", "/v1.47/images/get", ActionImageArchive},
+		{"POST", "/v1.47/build/prune", ActionBuildPrune},
+		{"POST", "/v1.47/volumes/prune", ActionVolumePrune},
+		{"PUT", "/v1.47/volumes/id", ActionVolumeUpdate},
+		{"POST", "/v1.47/networks/prune", ActionNetworkPrune},
+		{"GET", "/v1.47/tasks/id/logs", ActionTaskLogs},
+		{"GET", "/v1.47/plugins", ActionPluginList},
+		{"GET", "/v1.47/plugins/privileges", ActionPluginPrivileges},
+		{"POST", "/v1.47/plugins/pull", ActionPluginPull},
+		{"POST", "/v1.47/plugins/create", ActionPluginCreate},
+		{"GET", "/v1.47/plugins/vieux/sshfs:latest/json", ActionPluginInspect},
+		{"DELETE", "/v1.47/plugins/vieux/sshfs:latest", ActionPluginDelete},
+		{"POST", "/v1.47/plugins/vieux/sshfs:latest/enable", ActionPluginEnable},
+		{"POST", "/v1.47/plugins/vieux/sshfs:latest/disable", ActionPluginDisable},
+		{"POST", "/v1.47/plugins/vieux/sshfs:latest/upgrade", ActionPluginUpgrade},
+		{"POST", "/v1.47/plugins/vieux/sshfs:latest/push", ActionPluginPush},
+		{"POST", "/v1.47/plugins/vieux/sshfs:latest/set", ActionPluginSet},
 	}
 
 	for _, test := range tests {
-		assert.Equal(t, test.expectedAction, ParseRoute(test.method, test.url))
+		assert.Equal(t, test.expectedAction, ParseRoute(test.method, test.url).Action, "%s %s", test.method, test.url)
+	}
+}
+
+func TestRouteParams(t *testing.T) {
+
+	tests := []struct {
+		method          string
+		url             string
+		expectedAction  string
+		expectedVersion string
+		expectedParams  map[string]string
+	}{
+		{"POST", "/v1.41/containers/3f2a/exec", ActionContainerExecCreate, "1.41", map[string]string{ParamContainer: "3f2a"}},
+		{"DELETE", "/v1.41/containers/my_container", ActionContainerDelete, "1.41", map[string]string{ParamContainer: "my_container"}},
+		{"POST", "/v1.41/exec/9c1d/start", ActionContainerExecStart, "1.41", map[string]string{ParamExec: "9c1d"}},
+		{"GET", "/v1.41/images/registry.anubis-lms.io/anubis/theia:latest/json", ActionImageInspect, "1.41", map[string]string{ParamImage: "registry.anubis-lms.io/anubis/theia:latest"}},
+		{"DELETE", "/v1.41/images/alpine:3.17", ActionImageDelete, "1.41", map[string]string{ParamImage: "alpine:3.17"}},
+		{"POST", "/v1.41/networks/student/connect", ActionNetworkConnect, "1.41", map[string]string{ParamNetwork: "student"}},
+		{"GET", "/v1.41/volumes/ide-home", ActionVolumeInspect, "1.41", map[string]string{ParamVolume: "ide-home"}},
+		{"GET", "/_ping", ActionDockerPing, "", map[string]string{}},
+		{"GET", "/v1.41/unknown", ActionNone, "1.41", nil},
+	}
+
+	for _, test := range tests {
+		route := ParseRoute(test.method, test.url)
+		assert.Equal(t, test.expectedAction, route.Action, "%s %s", test.method, test.url)
+		assert.Equal(t, test.expectedVersion, route.APIVersion, "%s %s", test.method, test.url)
+		assert.Equal(t, test.expectedParams, route.Params, "%s %s", test.method, test.url)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	assert.NoError(t, ValidateRoutes(), "Route table must not contain ambiguous routes")
+
+	assert.True(t, segmentsOverlap([]string{"containers", "{container}"}, []string{"containers", "json"}))
+	assert.True(t, segmentsOverlap([]string{"images", "{image:.+}"}, []string{"images", "{image:.+}", "json"}))
+	assert.False(t, segmentsOverlap([]string{"images", "{image:.+}", "push"}, []string{"images", "{image:.+}", "tag"}))
+	assert.False(t, segmentsOverlap([]string{"images", "{image:.+}", "json"}, []string{"images", "json"}))
+}
+
+// TestRouteCoverage verifies every path of the docker Engine API specification (testdata/swagger.yaml)
+// maps to a route with the same path template. Update the specification to check newer API versions.
+func TestRouteCoverage(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/swagger.yaml")
+	assert.NoError(t, err)
+
+	var spec struct {
+		Info struct {
+			Version string `yaml:"version"`
+		} `yaml:"info"`
+		Paths map[string]map[string]interface{} `yaml:"paths"`
+	}
+	assert.NoError(t, yaml.Unmarshal(data, &spec))
+	assert.NotEmpty(t, spec.Paths)
+
+	param := regexp.MustCompile(`\{[^}]+\}`)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			method = strings.ToUpper(method)
+			if method == "PARAMETERS" {
+				continue
+			}
+
+			url := "/v" + spec.Info.Version + param.ReplaceAllString(path, "x")
+			route := ParseRoute(method, url)
+			if !assert.NotEqual(t, ActionNone, route.Action, "No route for %s %s", method, path) {
+				continue
+			}
+			assert.Equal(t, param.ReplaceAllString(path, "{}"), param.ReplaceAllString(route.Pattern, "{}"),
+				"Route for %s %s has a different path template", method, path)
+		}
 	}
 }
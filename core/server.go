@@ -1,12 +1,19 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/pkg/authorization"
 	"github.com/docker/docker/pkg/plugins"
@@ -15,49 +22,275 @@ import (
 )
 
 const (
-	pluginName   = "anubis-authz"
-	pluginFolder = "/run/docker/plugins"
+	DefaultPluginName       = "anubis-authz"        // DefaultPluginName is the name docker daemon refers to the plugin by
+	DefaultPluginFolder     = "/run/docker/plugins" // DefaultPluginFolder is the folder docker daemon discovers plugin sockets in
+	DefaultPluginSpecFolder = "/etc/docker/plugins" // DefaultPluginSpecFolder is the folder docker daemon discovers TCP plugins in
+	DefaultShutdownTimeout  = 10 * time.Second      // DefaultShutdownTimeout is the default deadline of in-flight requests on shutdown
 )
 
-// AuthZSrv implements the authz plugin specification on top of unix sockets
+// AuthZSrvSettings provides settings for the authorization server
+type AuthZSrvSettings struct {
+	PluginName    string // PluginName is the name of the plugin, used by docker daemon --authorization-plugin (defaults to DefaultPluginName)
+	SocketPath    string // SocketPath is the unix socket the plugin listens on (defaults to <DefaultPluginFolder>/<PluginName>.sock)
+	TCPAddr       string // TCPAddr is the TCP address the plugin listens on instead of the unix socket (e.g. 0.0.0.0:9443)
+	AdvertiseAddr string // AdvertiseAddr is the TCP address docker daemon connects to (defaults to TCPAddr, on 127.0.0.1 if unspecified)
+	SpecFolder    string // SpecFolder is the folder the plugin discovery file of the TCP listener is written to (defaults to DefaultPluginSpecFolder)
+	TLSCert       string // TLSCert is the certificate of the TCP listener (plain TCP if empty)
+	TLSKey        string // TLSKey is the private key of TLSCert
+	TLSCA         string // TLSCA is the CA verifying the plugin certificate, and the docker daemon certificate (mutual TLS)
+	ClientCert    string // ClientCert is the certificate docker daemon presents to the plugin, written to the discovery file
+	ClientKey     string // ClientKey is the private key of ClientCert, written to the discovery file
+
+	ShutdownTimeout time.Duration // ShutdownTimeout is the deadline of in-flight requests on shutdown (defaults to DefaultShutdownTimeout)
+}
+
+// AuthZSrv implements the authz plugin specification on top of unix or TCP sockets
 // the authZSrv uses two core components to manage the flow, the authorizer,
 // which is used to perform the actual authorization and the auditor, which
 // is used to audit the authorization flow
 type AuthZSrv struct {
-	authorizer Authorizer   // authorizer is the concrete handler for plugins
-	auditor    Auditor      // auditor is used to audit input/output
-	listener   net.Listener // listener is the plugin socket listener
+	authorizer Authorizer        // authorizer is the concrete handler for plugins
+	auditor    Auditor           // auditor is used to audit input/output
+	settings   *AuthZSrvSettings // settings are the listener settings
+	lock       sync.Mutex        // lock guards the listener, server and paths between Start and Stop
+	listener   net.Listener      // listener is the plugin socket listener
+	server     *http.Server      // server serves the plugin requests
+	socketPath string            // socketPath is the plugin unix socket
+	specPath   string            // specPath is the plugin discovery file written for the TCP listener
 }
 
 // NewAuthZSrv creates a new authorization server
-func NewAuthZSrv(plugin Authorizer, auditor Auditor) *AuthZSrv {
-	return &AuthZSrv{authorizer: plugin, auditor: auditor}
+func NewAuthZSrv(plugin Authorizer, auditor Auditor, settings *AuthZSrvSettings) *AuthZSrv {
+	if settings == nil {
+		settings = &AuthZSrvSettings{}
+	}
+	return &AuthZSrv{authorizer: plugin, auditor: auditor, settings: settings}
 }
 
-// Start starts the authorization server
-func (a *AuthZSrv) Start() error {
+// pluginName returns the name of the plugin
+func (a *AuthZSrv) pluginName() string {
+	if a.settings.PluginName == "" {
+		return DefaultPluginName
+	}
+	return a.settings.PluginName
+}
 
-	err := a.authorizer.Init()
+// Start starts the authorization server, until the context is done.
+// In-flight requests are then drained until the shutdown timeout, and the plugin socket (or discovery file) is removed.
+func (a *AuthZSrv) Start(ctx context.Context) error {
 
+	err := ValidateRoutes()
 	if err != nil {
 		return err
 	}
 
-	if _, err := os.Stat(pluginFolder); os.IsNotExist(err) {
-		logrus.Infof("Creating plugins folder %q", pluginName)
-		err = os.MkdirAll("/run/docker/plugins/", 0750)
-		if err != nil {
-			return err
+	err = a.authorizer.Init()
+
+	if err != nil {
+		return err
+	}
+
+	// The listener and server are set under the lock, such that Stop sees them once the socket exists
+	a.lock.Lock()
+	var listener net.Listener
+	if a.settings.TCPAddr != "" {
+		listener, err = a.listenTCP()
+	} else {
+		listener, err = a.listenUnix()
+	}
+	if err != nil {
+		a.lock.Unlock()
+		return err
+	}
+	server := &http.Server{Handler: a.Handler()}
+	a.listener, a.server = listener, server
+	a.lock.Unlock()
+
+	defer a.cleanup()
+
+	logrus.Infof("Plugin %q listening on %q", a.pluginName(), listener.Addr().String())
+	return serve(ctx, server, listener, a.settings.ShutdownTimeout)
+}
+
+// serve serves the requests until the context is done, then drains in-flight requests until the timeout
+func serve(ctx context.Context, server *http.Server, listener net.Listener, timeout time.Duration) error {
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		if err == http.ErrServerClosed {
+			return nil
 		}
+		return err
+	case <-ctx.Done():
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
 	}
+	logrus.Infof("Shutting down, draining in-flight requests (timeout: %s)", timeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("failed to drain in-flight requests: %s", err.Error())
+	}
+	return nil
+}
+
+// listenUnix listens on the plugin unix socket, discovered by docker daemon from its name
+func (a *AuthZSrv) listenUnix() (net.Listener, error) {
 
-	pluginPath := fmt.Sprintf("%s/%s.sock", pluginFolder, pluginName)
+	pluginPath := a.settings.SocketPath
+	if pluginPath == "" {
+		pluginPath = filepath.Join(DefaultPluginFolder, a.pluginName()+".sock")
+	}
+
+	if _, err := os.Stat(filepath.Dir(pluginPath)); os.IsNotExist(err) {
+		logrus.Infof("Creating plugins folder %q", filepath.Dir(pluginPath))
+		err = os.MkdirAll(filepath.Dir(pluginPath), 0750)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	os.Remove(pluginPath)
-	a.listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: pluginPath, Net: "unix"})
+	a.socketPath = pluginPath
+	return net.ListenUnix("unix", &net.UnixAddr{Name: pluginPath, Net: "unix"})
+}
+
+// listenTCP listens on the TCP address, with mutual TLS if configured, and writes the plugin discovery file
+func (a *AuthZSrv) listenTCP() (net.Listener, error) {
+
+	tlsConfig, err := a.tlsConfig()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", a.settings.TCPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	} else {
+		logrus.Warnf("Plugin %q listening on plain TCP, requests are not authenticated", a.pluginName())
+	}
+
+	a.specPath, err = a.writeSpec(listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// tlsConfig loads the TLS settings of the TCP listener (nil for plain TCP)
+func (a *AuthZSrv) tlsConfig() (*tls.Config, error) {
+
+	if a.settings.TLSCert == "" && a.settings.TLSKey == "" {
+		if a.settings.TLSCA != "" {
+			return nil, errors.New("a TLS certificate and key are required to verify client certificates")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(a.settings.TLSCert, a.settings.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin certificate: %s", err.Error())
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if a.settings.TLSCA != "" {
+		ca, err := ioutil.ReadFile(a.settings.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid CA %q: no PEM certificate found", a.settings.TLSCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return config, nil
+}
+
+// pluginSpec is the json plugin discovery file (see https://docs.docker.com/engine/extend/plugin_api/#plugin-discovery)
+type pluginSpec struct {
+	Name      string         `json:"Name"`
+	Addr      string         `json:"Addr"`
+	TLSConfig *pluginSpecTLS `json:"TLSConfig,omitempty"`
+}
+
+// pluginSpecTLS holds the files docker daemon uses to connect to the plugin
+type pluginSpecTLS struct {
+	InsecureSkipVerify bool   `json:"InsecureSkipVerify"`
+	CAFile             string `json:"CAFile,omitempty"`
+	CertFile           string `json:"CertFile,omitempty"`
+	KeyFile            string `json:"KeyFile,omitempty"`
+}
+
+// writeSpec writes the discovery file of the TCP listener, a .spec file holding the plugin URL for plain TCP,
+// or a .json file also holding the TLS settings of docker daemon
+func (a *AuthZSrv) writeSpec(addr *net.TCPAddr) (string, error) {
+
+	advertised := a.settings.AdvertiseAddr
+	if advertised == "" {
+		host := addr.IP.String()
+		if addr.IP.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		advertised = net.JoinHostPort(host, fmt.Sprint(addr.Port))
+	}
+
+	folder := a.settings.SpecFolder
+	if folder == "" {
+		folder = DefaultPluginSpecFolder
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", err
+	}
+
+	var specPath string
+	var data []byte
+	if a.settings.TLSCert == "" {
+		specPath = filepath.Join(folder, a.pluginName()+".spec")
+		data = []byte("tcp://" + advertised + "\n")
+	} else {
+		spec := pluginSpec{Name: a.pluginName(), Addr: "https://" + advertised, TLSConfig: &pluginSpecTLS{
+			CAFile:   absPath(a.settings.TLSCA),
+			CertFile: absPath(a.settings.ClientCert),
+			KeyFile:  absPath(a.settings.ClientKey),
+		}}
+		specPath = filepath.Join(folder, a.pluginName()+".json")
+		var err error
+		if data, err = json.MarshalIndent(spec, "", "  "); err != nil {
+			return "", err
+		}
+	}
+
+	logrus.Infof("Writing plugin discovery file %q", specPath)
+	return specPath, ioutil.WriteFile(specPath, data, 0644)
+}
+
+// absPath returns the absolute path of a file referenced by the discovery file (empty if unset)
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Handler returns the http handler implementing the authz plugin protocol
+func (a *AuthZSrv) Handler() http.Handler {
 
 	router := mux.NewRouter()
 	router.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
@@ -89,7 +322,9 @@ func (a *AuthZSrv) Start() error {
 			return
 		}
 
+		start := time.Now()
 		authZRes := a.authorizer.AuthZReq(&authReq)
+		observeRequest(PhaseRequest, start, len(authReq.RequestBody))
 
 		if authZRes != nil {
 			logrus.Debugf(authZRes.Msg)
@@ -121,7 +356,9 @@ func (a *AuthZSrv) Start() error {
 			return
 		}
 
+		start := time.Now()
 		authZRes := a.authorizer.AuthZRes(&authReq)
+		observeRequest(PhaseResponse, start, len(authReq.ResponseBody))
 		err = a.auditor.AuditResponse(&authReq, authZRes)
 		if err != nil {
 			logrus.Errorf("Failed to audit response '%v'", err)
@@ -129,17 +366,32 @@ func (a *AuthZSrv) Start() error {
 		writeResponse(w, authZRes)
 	})
 
-	return http.Serve(a.listener, router)
+	return router
 }
 
-// Stop stops the authorization server
+// Stop stops the authorization server immediately, without draining in-flight requests
 func (a *AuthZSrv) Stop() {
 
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	if a.listener == nil {
 		logrus.Warnf("Listener is nil")
 		return
 	}
+	if a.server != nil {
+		a.server.Close()
+	}
 	a.listener.Close()
+	a.cleanup()
+}
+
+// cleanup removes the plugin socket and discovery file, so that docker daemon does not find a stale plugin
+func (a *AuthZSrv) cleanup() {
+	for _, path := range []string{a.socketPath, a.specPath} {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
 }
 
 // writeResponse writes the authZPlugin response to response writer
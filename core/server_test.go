@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFile waits for the server to create a file (socket or discovery file)
+func waitFile(t *testing.T, path string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s not created", path)
+}
+
+// authZReq posts a kill request to the plugin and decodes the response
+func authZReq(t *testing.T, client *http.Client, base string) (*authorization.Response, error) {
+	data, _ := json.Marshal(authorization.Request{RequestMethod: http.MethodPost, RequestURI: "/v1.41/containers/id/kill", User: "user_1"})
+	res, err := client.Post(base+"/"+authorization.AuthZApiRequest, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var authZRes authorization.Response
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&authZRes))
+	return &authZRes, nil
+}
+
+func TestServerUnix(t *testing.T) {
+
+	socketPath := filepath.Join(t.TempDir(), "plugins", "test-authz.sock")
+	srv := NewAuthZSrv(&stubAuthorizer{}, stubAuditor{}, &AuthZSrvSettings{PluginName: "test-authz", SocketPath: socketPath})
+	go srv.Start(context.Background())
+	waitFile(t, socketPath)
+	defer srv.Stop()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}}}
+
+	res, err := client.Post("http://plugin/Plugin.Activate", "application/json", nil)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	assert.JSONEq(t, `{"Implements":["authz"]}`, string(body))
+
+	authZRes, err := authZReq(t, client, "http://plugin")
+	assert.NoError(t, err)
+	assert.False(t, authZRes.Allow)
+	assert.Equal(t, "kill not allowed", authZRes.Msg)
+}
+
+// newCert issues a certificate signed by the parent (self-signed if nil), written as PEM files to the folder
+func newCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, key
+}
+
+func TestServerTCP(t *testing.T) {
+
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := newCert(t, dir, "ca", &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"}, NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	newCert(t, dir, "server", &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "plugin"}, NotAfter: notAfter,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca, caKey)
+	newCert(t, dir, "client", &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "dockerd"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca, caKey)
+
+	specFolder := filepath.Join(dir, "specs")
+	srv := NewAuthZSrv(&stubAuthorizer{}, stubAuditor{}, &AuthZSrvSettings{
+		PluginName: "test-authz",
+		TCPAddr:    "127.0.0.1:0",
+		SpecFolder: specFolder,
+		TLSCert:    filepath.Join(dir, "server.pem"),
+		TLSKey:     filepath.Join(dir, "server-key.pem"),
+		TLSCA:      filepath.Join(dir, "ca.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	})
+	go srv.Start(context.Background())
+	specPath := filepath.Join(specFolder, "test-authz.json")
+	waitFile(t, specPath)
+
+	// Docker daemon connects with the settings of the discovery file
+	data, err := os.ReadFile(specPath)
+	assert.NoError(t, err)
+	var spec pluginSpec
+	assert.NoError(t, json.Unmarshal(data, &spec))
+	assert.Equal(t, "test-authz", spec.Name)
+	assert.Regexp(t, `^https://127\.0\.0\.1:\d+$`, spec.Addr)
+	assert.Equal(t, filepath.Join(dir, "ca.pem"), spec.TLSConfig.CAFile)
+
+	clientCert, err := tls.LoadX509KeyPair(spec.TLSConfig.CertFile, spec.TLSConfig.KeyFile)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	authZRes, err := authZReq(t, client, spec.Addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "kill not allowed", authZRes.Msg)
+
+	// Clients without a certificate are refused
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = authZReq(t, anonymous, spec.Addr)
+	assert.Error(t, err)
+
+	// The discovery file is removed on stop
+	srv.Stop()
+	_, err = os.Stat(specPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Client certificates cannot be verified without a server certificate
+	err = NewAuthZSrv(&stubAuthorizer{}, stubAuditor{}, &AuthZSrvSettings{TCPAddr: "127.0.0.1:0", TLSCA: filepath.Join(dir, "ca.pem")}).Start(context.Background())
+	assert.Error(t, err)
+}
+
+func TestServerPlainTCP(t *testing.T) {
+
+	specFolder := t.TempDir()
+	srv := NewAuthZSrv(&stubAuthorizer{}, stubAuditor{}, &AuthZSrvSettings{TCPAddr: "0.0.0.0:0", AdvertiseAddr: "authz.local:9000", SpecFolder: specFolder})
+	go srv.Start(context.Background())
+	specPath := filepath.Join(specFolder, DefaultPluginName+".spec")
+	waitFile(t, specPath)
+	defer srv.Stop()
+
+	data, err := os.ReadFile(specPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://authz.local:9000\n", string(data))
+}
+
+// slowAuthorizer holds requests until released
+type slowAuthorizer struct {
+	stubAuthorizer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowAuthorizer) AuthZReq(req *authorization.Request) *authorization.Response {
+	close(s.started)
+	<-s.release
+	return s.stubAuthorizer.AuthZReq(req)
+}
+
+func TestServerShutdown(t *testing.T) {
+
+	socketPath := filepath.Join(t.TempDir(), "test-authz.sock")
+	authorizer := &slowAuthorizer{started: make(chan struct{}), release: make(chan struct{})}
+	srv := NewAuthZSrv(authorizer, stubAuditor{}, &AuthZSrvSettings{SocketPath: socketPath, ShutdownTimeout: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Start(ctx)
+	}()
+	waitFile(t, socketPath)
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}}}
+	responses := make(chan *authorization.Response, 1)
+	go func() {
+		authZRes, err := authZReq(t, client, "http://plugin")
+		assert.NoError(t, err)
+		responses <- authZRes
+	}()
+
+	// The in-flight decision is drained once the context is done
+	<-authorizer.started
+	cancel()
+	select {
+	case <-stopped:
+		t.Fatal("Server must wait for in-flight requests")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(authorizer.release)
+	assert.Equal(t, "kill not allowed", (<-responses).Msg)
+	assert.NoError(t, <-stopped)
+
+	_, err := os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "Socket must be removed on exit")
+}
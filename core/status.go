@@ -0,0 +1,14 @@
+package core
+
+import "time"
+
+// PolicyStatus describes the outcome of the policy (re)loads of an authorizer
+type PolicyStatus struct {
+	Policies  int       `yaml:"policies"`            // Policies is the number of active policies
+	Reloads   uint64    `yaml:"reloads"`             // Reloads is the number of successful loads
+	Failures  uint64    `yaml:"failures"`            // Failures is the number of loads refused due to an invalid policy
+	LastError string    `yaml:"lastError,omitempty"` // LastError is the error of the last failed load (empty if the last load succeeded)
+	LastLoad  time.Time `yaml:"lastLoad"`            // LastLoad is the time of the last successful load
+	Hash      string    `yaml:"hash"`                // Hash is the sha256 of the sources of the active policies
+	Sources   []string  `yaml:"sources"`             // Sources are the files the active policies were loaded from
+}
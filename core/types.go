@@ -57,6 +57,12 @@ var (
 	ActionContainerUnpause = "container_unpause"
 	// ActionContainerWait describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#wait-a-container
 	ActionContainerWait = "container_wait"
+	// ActionContainerUpdate describes https://docs.docker.com/engine/api/v1.47/#operation/ContainerUpdate
+	ActionContainerUpdate = "container_update"
+	// ActionContainerPrune describes https://docs.docker.com/engine/api/v1.47/#operation/ContainerPrune
+	ActionContainerPrune = "container_prune"
+	// ActionContainerExecResize describes https://docs.docker.com/engine/api/v1.47/#operation/ExecResize
+	ActionContainerExecResize = "container_exec_resize"
 	// ActionDockerCheckAuth describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#check-auth-configuration
 	ActionDockerCheckAuth = "docker_auth"
 	// ActionDockerEvents describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#monitor-docker-s-events
@@ -67,6 +73,12 @@ var (
 	ActionDockerPing = "docker_ping"
 	// ActionDockerVersion describes https://docs.docker.com/reference/api/docker_remote_api_v1.20/#show-the-docker-version-information
 	ActionDockerVersion = "docker_version"
+	// ActionDockerDataUsage describes https://docs.docker.com/engine/api/v1.47/#operation/SystemDataUsage
+	ActionDockerDataUsage = "docker_data_usage"
+	// ActionDockerSession describes https://docs.docker.com/engine/api/v1.47/#operation/Session
+	ActionDockerSession = "docker_session"
+	// ActionDockerGRPC describes the BuildKit gRPC endpoint used by buildx
+	ActionDockerGRPC = "docker_grpc"
 	// ActionImageArchive describes https://docs.docker.com/reference/api/docker_remote_api_v1.21/#get-a-tarball-containing-all-images
 	ActionImageArchive = "images_archive"
 	// ActionImageBuild describes https://docs.docker.com/reference/api/docker_remote_api_v1.21/#build-image-from-a-dockerfile
@@ -91,6 +103,8 @@ var (
 	ActionImagesSearch = "images_search"
 	// ActionImageTag describes https://docs.docker.com/reference/api/docker_remote_api_v1.21/#tag-an-image-into-a-repository
 	ActionImageTag = "image_tag"
+	// ActionBuildPrune describes https://docs.docker.com/engine/api/v1.47/#operation/BuildPrune
+	ActionBuildPrune = "build_prune"
 	// ActionVolumeList describes  https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#list-volumes
 	ActionVolumeList = "volume_list"
 	// ActionVolumeCreate describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#create-a-volume
@@ -99,6 +113,10 @@ var (
 	ActionVolumeInspect = "volume_inspect"
 	// ActionVolumeRemove describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#remove-a-volume
 	ActionVolumeRemove = "volume_remove"
+	// ActionVolumeUpdate describes https://docs.docker.com/engine/api/v1.47/#operation/VolumeUpdate
+	ActionVolumeUpdate = "volume_update"
+	// ActionVolumePrune describes https://docs.docker.com/engine/api/v1.47/#operation/VolumePrune
+	ActionVolumePrune = "volume_prune"
 	// ActionNetworkList describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#list-networks
 	ActionNetworkList = "network_list"
 	// ActionNetworkInspect describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#inspect-network
@@ -112,6 +130,8 @@ var (
 	ActionNetworkDisconnect = "network_disconnect"
 	// ActionNetworkRemove describes https://docs.docker.com/engine/reference/api/docker_remote_api_v1.21/#remove-a-network
 	ActionNetworkRemove = "network_remove"
+	// ActionNetworkPrune describes https://docs.docker.com/engine/api/v1.47/#operation/NetworkPrune
+	ActionNetworkPrune = "network_prune"
 	// ActionSwarmInspect describes https://docs.docker.com/engine/api/v1.37/#operation/SwarmInspect
 	ActionSwarmInspect = "swarm_inspect"
 	// ActionSwarmInit describes https://docs.docker.com/engine/api/v1.37/#operation/SwarmInit
@@ -150,6 +170,8 @@ var (
 	ActionTaskList = "task_list"
 	// ActionTaskInspect describes https://docs.docker.com/engine/api/v1.39/#operation/TaskInspect
 	ActionTaskInspect = "task_inspect"
+	// ActionTaskLogs describes https://docs.docker.com/engine/api/v1.47/#operation/TaskLogs
+	ActionTaskLogs = "task_logs"
 	// ActionSecretList describes https://docs.docker.com/engine/api/v1.39/#operation/SecretList
 	ActionSecretList = "secret_list"
 	// ActionSecretCreate describes https://docs.docker.com/engine/api/v1.39/#operation/SecretCreate
@@ -172,6 +194,54 @@ var (
 	ActionConfigUpdate = "config_update"
 	// ActionDistributionInspect describes https://docs.docker.com/engine/api/v1.39/#operation/DistributionInspect
 	ActionDistributionInspect = "distribution_inspect"
+	// ActionPluginList describes https://docs.docker.com/engine/api/v1.47/#operation/PluginList
+	ActionPluginList = "plugin_list"
+	// ActionPluginPrivileges describes https://docs.docker.com/engine/api/v1.47/#operation/GetPluginPrivileges
+	ActionPluginPrivileges = "plugin_privileges"
+	// ActionPluginPull describes https://docs.docker.com/engine/api/v1.47/#operation/PluginPull
+	ActionPluginPull = "plugin_pull"
+	// ActionPluginCreate describes https://docs.docker.com/engine/api/v1.47/#operation/PluginCreate
+	ActionPluginCreate = "plugin_create"
+	// ActionPluginInspect describes https://docs.docker.com/engine/api/v1.47/#operation/PluginInspect
+	ActionPluginInspect = "plugin_inspect"
+	// ActionPluginDelete describes https://docs.docker.com/engine/api/v1.47/#operation/PluginDelete
+	ActionPluginDelete = "plugin_delete"
+	// ActionPluginEnable describes https://docs.docker.com/engine/api/v1.47/#operation/PluginEnable
+	ActionPluginEnable = "plugin_enable"
+	// ActionPluginDisable describes https://docs.docker.com/engine/api/v1.47/#operation/PluginDisable
+	ActionPluginDisable = "plugin_disable"
+	// ActionPluginUpgrade describes https://docs.docker.com/engine/api/v1.47/#operation/PluginUpgrade
+	ActionPluginUpgrade = "plugin_upgrade"
+	// ActionPluginPush describes https://docs.docker.com/engine/api/v1.47/#operation/PluginPush
+	ActionPluginPush = "plugin_push"
+	// ActionPluginSet describes https://docs.docker.com/engine/api/v1.47/#operation/PluginSet
+	ActionPluginSet = "plugin_set"
 	// ActionNone indicates no action matched the given method URL combination
 	ActionNone = ""
 )
+
+// Path parameters extracted by the route parser
+const (
+	// ParamContainer is the container id or name
+	ParamContainer = "container"
+	// ParamImage is the image name or id
+	ParamImage = "image"
+	// ParamExec is the exec instance id
+	ParamExec = "exec"
+	// ParamVolume is the volume name
+	ParamVolume = "volume"
+	// ParamNetwork is the network id or name
+	ParamNetwork = "network"
+	// ParamNode is the swarm node id or name
+	ParamNode = "node"
+	// ParamService is the swarm service id or name
+	ParamService = "service"
+	// ParamTask is the swarm task id
+	ParamTask = "task"
+	// ParamSecret is the swarm secret id
+	ParamSecret = "secret"
+	// ParamConfig is the swarm config id
+	ParamConfig = "config"
+	// ParamPlugin is the plugin name
+	ParamPlugin = "plugin"
+)
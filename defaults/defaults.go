@@ -14,6 +14,35 @@ const (
 	AuditorFlag     = "auditor"
 	AuditorHookFlag = "auditor-hook"
 	PolicyFileFlag  = "policy"
+	CombiningFlag   = "combining"
+
+	StateFlag        = "state"
+	OwnerLabelFlag   = "owner-label"
+	DockerSocketFlag = "docker-socket"
+
+	ShutdownTimeoutFlag = "shutdown-timeout"
+	AdminAddrFlag       = "admin-addr"
+
+	ModeFlag          = "mode"
+	ProxySocketFlag   = "proxy-socket"
+	ProxyUpstreamFlag = "proxy-upstream"
+
+	PluginNameFlag       = "plugin-name"
+	PluginSocketFlag     = "plugin-socket"
+	PluginTCPFlag        = "plugin-tcp"
+	PluginAdvertiseFlag  = "plugin-advertise-addr"
+	PluginSpecFolderFlag = "plugin-spec-folder"
+	PluginTLSCertFlag    = "plugin-tls-cert"
+	PluginTLSKeyFlag     = "plugin-tls-key"
+	PluginTLSCAFlag      = "plugin-tls-ca"
+	PluginClientCertFlag = "plugin-client-cert"
+	PluginClientKeyFlag  = "plugin-client-key"
+
+	WebhookURLFlag       = "webhook-url"
+	WebhookTimeoutFlag   = "webhook-timeout"
+	WebhookFailOpenFlag  = "webhook-fail-open"
+	WebhookCacheSizeFlag = "webhook-cache-size"
+	WebhookCacheTTLFlag  = "webhook-cache-ttl"
 )
 
 // Default configurations
@@ -25,4 +54,23 @@ const (
 	AuthorizerAnubis = "anubis"
 	AuditorAnubis    = "anubis"
 	PolicyFileAnubis = "authz/policy-anubis.yaml"
+
+	AuthorizerOPA = "opa"
+	PolicyFileOPA = "authz/policy-opa.rego"
+
+	AuthorizerWebhook = "webhook"
+)
+
+// Ownership tracking
+const (
+	DockerSocket = "/var/run/docker.sock" // DockerSocket is the docker daemon socket used to rebuild the owners of containers
+)
+
+// Run modes
+const (
+	ModePlugin = "plugin" // ModePlugin runs the broker as a docker authorization plugin
+	ModeProxy  = "proxy"  // ModeProxy runs the broker as a proxy in front of the docker daemon socket
+
+	ProxySocket   = "/run/anubis-authz/docker.sock"
+	ProxyUpstream = "/var/run/docker.sock"
 )
@@ -2,8 +2,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	// Embed the timezone database for the policy schedules (the runtime image has none)
+	_ "time/tzdata"
 
 	"github.com/AnubisLMS/authz/authz"
 	"github.com/AnubisLMS/authz/core"
@@ -30,13 +35,33 @@ func main() {
 			// Configure authorizer
 			switch c.String(defaults.AuthorizerFlag) {
 			case defaults.AuthorizerBasic:
-				authZHandler = authz.NewBasicAuthZAuthorizer(&authz.BasicAuthorizerSettings{PolicyPath: c.String(defaults.PolicyFileFlag)})
+				authZHandler = authz.NewBasicAuthZAuthorizer(&authz.BasicAuthorizerSettings{
+					PolicyPath: c.String(defaults.PolicyFileFlag),
+					Combining:  c.String(defaults.CombiningFlag),
+				})
 			case defaults.AuthorizerAnubis:
-				authZHandler = authz.NewAnubisAuthZAuthorizer(&authz.AnubisAuthorizerSettings{PolicyPath: c.String(defaults.PolicyFileFlag)})
+				authZHandler = authz.NewAnubisAuthZAuthorizer(&authz.AnubisAuthorizerSettings{
+					PolicyPath:   c.String(defaults.PolicyFileFlag),
+					Combining:    c.String(defaults.CombiningFlag),
+					StatePath:    c.String(defaults.StateFlag),
+					OwnerLabel:   c.String(defaults.OwnerLabelFlag),
+					DockerSocket: c.String(defaults.DockerSocketFlag),
+				})
+			case defaults.AuthorizerOPA:
+				authZHandler = authz.NewOPAAuthZAuthorizer(&authz.OPAAuthorizerSettings{
+					PolicyPath: c.String(defaults.PolicyFileFlag),
+				})
+			case defaults.AuthorizerWebhook:
+				authZHandler = newWebhookAuthorizer(c)
 			default:
 				panic(fmt.Sprintf("Unknown authz handler %q", c.String(defaults.AuthorizerFlag)))
 			}
 
+			// The webhook is queried as a second stage once the policies allow a request
+			if c.String(defaults.WebhookURLFlag) != "" && c.String(defaults.AuthorizerFlag) != defaults.AuthorizerWebhook {
+				authZHandler = authz.NewChainAuthorizer(authZHandler, newWebhookAuthorizer(c))
+			}
+
 			// Configure auditor
 			switch c.String(defaults.AuditorFlag) {
 			case defaults.AuditorBasic:
@@ -45,8 +70,50 @@ func main() {
 				panic(fmt.Sprintf("Unknown authz handler %q", c.String(defaults.AuthorizerFlag)))
 			}
 
-			srv := core.NewAuthZSrv(authZHandler, auditor)
-			return srv.Start()
+			reloadOnSignal(authZHandler, auditor)
+			defer closeAll(authZHandler, auditor)
+
+			// In-flight requests are drained on SIGINT/SIGTERM
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			if addr := c.String(defaults.AdminAddrFlag); addr != "" {
+				go func() {
+					if err := core.NewAdminSrv(authZHandler, auditor, addr).Start(ctx); err != nil {
+						logrus.Errorf("Failed to serve admin endpoints %q", err.Error())
+					}
+				}()
+			}
+
+			// Configure mode
+			switch c.String(defaults.ModeFlag) {
+			case defaults.ModePlugin:
+				srv := core.NewAuthZSrv(authZHandler, auditor, &core.AuthZSrvSettings{
+					PluginName:    c.String(defaults.PluginNameFlag),
+					SocketPath:    c.String(defaults.PluginSocketFlag),
+					TCPAddr:       c.String(defaults.PluginTCPFlag),
+					AdvertiseAddr: c.String(defaults.PluginAdvertiseFlag),
+					SpecFolder:    c.String(defaults.PluginSpecFolderFlag),
+					TLSCert:       c.String(defaults.PluginTLSCertFlag),
+					TLSKey:        c.String(defaults.PluginTLSKeyFlag),
+					TLSCA:         c.String(defaults.PluginTLSCAFlag),
+					ClientCert:    c.String(defaults.PluginClientCertFlag),
+					ClientKey:     c.String(defaults.PluginClientKeyFlag),
+
+					ShutdownTimeout: c.Duration(defaults.ShutdownTimeoutFlag),
+				})
+				return srv.Start(ctx)
+			case defaults.ModeProxy:
+				proxy := core.NewAuthZProxy(authZHandler, auditor, &core.AuthZProxySettings{
+					SocketPath:   c.String(defaults.ProxySocketFlag),
+					UpstreamPath: c.String(defaults.ProxyUpstreamFlag),
+
+					ShutdownTimeout: c.Duration(defaults.ShutdownTimeoutFlag),
+				})
+				return proxy.Start(ctx)
+			default:
+				panic(fmt.Sprintf("Unknown mode %q", c.String(defaults.ModeFlag)))
+			}
 		},
 
 		Flags: []cli.Flag{
@@ -61,7 +128,32 @@ func main() {
 			&cli.StringFlag{
 				Name:  defaults.PolicyFileFlag,
 				Value: defaults.PolicyFileAnubis,
-				Usage: "Defines the authz policy file for basic handler",
+				Usage: "Defines the authz policy file (or folder of policy files for the anubis handler, or rego bundle for the opa handler)",
+			},
+
+			// combining algorithm
+			&cli.StringFlag{
+				Name:    defaults.CombiningFlag,
+				Value:   authz.CombiningFirstMatch,
+				EnvVars: []string{"COMBINING"},
+				Usage:   "Defines how the decisions of several matching policies are combined (first-match, deny-overrides, allow-overrides)",
+			},
+
+			// ownership tracking
+			&cli.StringFlag{
+				Name:    defaults.StateFlag,
+				EnvVars: []string{"STATE"},
+				Usage:   "Defines the state database tracking the owners of containers (ownership tracking is disabled if empty)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.OwnerLabelFlag,
+				Value: authz.DefaultOwnerLabel,
+				Usage: "Defines the container label holding the owner of containers",
+			},
+			&cli.StringFlag{
+				Name:  defaults.DockerSocketFlag,
+				Value: defaults.DockerSocket,
+				Usage: "Defines the docker daemon unix socket used to rebuild the owners of containers on startup",
 			},
 
 			// authorizer
@@ -69,7 +161,33 @@ func main() {
 				Name:    defaults.AuthorizerFlag,
 				Value:   defaults.AuthorizerAnubis,
 				EnvVars: []string{"AUTHORIZER"},
-				Usage:   "Defines the authz handler type",
+				Usage:   "Defines the authz handler type (basic, anubis, opa, webhook)",
+			},
+
+			// webhook
+			&cli.StringFlag{
+				Name:    defaults.WebhookURLFlag,
+				EnvVars: []string{"WEBHOOK_URL"},
+				Usage:   "Defines the HTTP endpoint decisions are delegated to (queried after the authz handler if it is not webhook)",
+			},
+			&cli.DurationFlag{
+				Name:  defaults.WebhookTimeoutFlag,
+				Value: authz.DefaultWebhookTimeout,
+				Usage: "Defines the timeout of the webhook requests",
+			},
+			&cli.BoolFlag{
+				Name:  defaults.WebhookFailOpenFlag,
+				Usage: "Allow requests when the webhook fails (requests are denied by default)",
+			},
+			&cli.IntFlag{
+				Name:  defaults.WebhookCacheSizeFlag,
+				Value: authz.DefaultWebhookCacheSize,
+				Usage: "Defines the number of cached webhook decisions (caching is disabled if negative)",
+			},
+			&cli.DurationFlag{
+				Name:  defaults.WebhookCacheTTLFlag,
+				Value: authz.DefaultWebhookCacheTTL,
+				Usage: "Defines the lifetime of cached webhook decisions",
 			},
 
 			// auditor
@@ -85,6 +203,79 @@ func main() {
 				EnvVars: []string{"AUDITOR_HOOK"},
 				Usage:   "Defines the authz auditor hook type (log engine)",
 			},
+
+			// mode
+			&cli.StringFlag{
+				Name:    defaults.ModeFlag,
+				Value:   defaults.ModePlugin,
+				EnvVars: []string{"MODE"},
+				Usage:   "Defines the run mode, either a docker authorization plugin or a proxy in front of the docker socket (plugin, proxy)",
+			},
+			&cli.StringFlag{
+				Name:    defaults.AdminAddrFlag,
+				Aliases: []string{"metrics-addr"},
+				EnvVars: []string{"ADMIN_ADDR", "METRICS_ADDR"},
+				Usage:   "Defines the TCP address of the admin endpoints: /healthz, /readyz, /policies, /routes, /explain and /metrics (disabled if empty, bind to localhost or a private network)",
+			},
+			&cli.DurationFlag{
+				Name:  defaults.ShutdownTimeoutFlag,
+				Value: core.DefaultShutdownTimeout,
+				Usage: "Defines how long in-flight requests are drained on SIGINT/SIGTERM",
+			},
+			&cli.StringFlag{
+				Name:    defaults.PluginNameFlag,
+				Value:   core.DefaultPluginName,
+				EnvVars: []string{"PLUGIN_NAME"},
+				Usage:   "Defines the plugin name, used by the docker daemon --authorization-plugin option",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginSocketFlag,
+				Usage: "Defines the unix socket the plugin listens on (defaults to " + core.DefaultPluginFolder + "/<plugin-name>.sock)",
+			},
+			&cli.StringFlag{
+				Name:    defaults.PluginTCPFlag,
+				EnvVars: []string{"PLUGIN_TCP"},
+				Usage:   "Defines the TCP address the plugin listens on instead of the unix socket (e.g. 0.0.0.0:9443)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginAdvertiseFlag,
+				Usage: "Defines the TCP address docker daemon connects to, written to the plugin discovery file (defaults to the listen address)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginSpecFolderFlag,
+				Value: core.DefaultPluginSpecFolder,
+				Usage: "Defines the folder the plugin discovery file (.spec or .json) of the TCP listener is written to",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginTLSCertFlag,
+				Usage: "Defines the certificate of the TCP listener (plain TCP if empty)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginTLSKeyFlag,
+				Usage: "Defines the private key of the TCP listener certificate",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginTLSCAFlag,
+				Usage: "Defines the CA of the plugin and docker daemon certificates, enabling mutual TLS",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginClientCertFlag,
+				Usage: "Defines the certificate docker daemon presents to the plugin (written to the plugin discovery file)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.PluginClientKeyFlag,
+				Usage: "Defines the private key of the docker daemon certificate (written to the plugin discovery file)",
+			},
+			&cli.StringFlag{
+				Name:  defaults.ProxySocketFlag,
+				Value: defaults.ProxySocket,
+				Usage: "Defines the unix socket the proxy listens on",
+			},
+			&cli.StringFlag{
+				Name:  defaults.ProxyUpstreamFlag,
+				Value: defaults.ProxyUpstream,
+				Usage: "Defines the docker daemon unix socket the proxy forwards to",
+			},
 		},
 	}
 
@@ -94,6 +285,17 @@ func main() {
 	}
 }
 
+// newWebhookAuthorizer creates the webhook authorizer from the command line settings
+func newWebhookAuthorizer(c *cli.Context) core.Authorizer {
+	return authz.NewWebhookAuthZAuthorizer(&authz.WebhookAuthorizerSettings{
+		URL:       c.String(defaults.WebhookURLFlag),
+		Timeout:   c.Duration(defaults.WebhookTimeoutFlag),
+		FailOpen:  c.Bool(defaults.WebhookFailOpenFlag),
+		CacheSize: c.Int(defaults.WebhookCacheSizeFlag),
+		CacheTTL:  c.Duration(defaults.WebhookCacheTTLFlag),
+	})
+}
+
 // initLogger initialize the logger based on the log level
 func initLogger(debug bool) {
 
@@ -108,3 +310,41 @@ func initLogger(debug bool) {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 }
+
+// reloadOnSignal reloads the authorizer policies and the auditor configuration whenever SIGHUP is received
+func reloadOnSignal(components ...interface{}) {
+	var reloaders []core.Reloader
+	for _, component := range components {
+		if reloader, ok := component.(core.Reloader); ok {
+			reloaders = append(reloaders, reloader)
+		}
+	}
+	if len(reloaders) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logrus.Info("SIGHUP received, reloading policies and audit log")
+			for _, reloader := range reloaders {
+				// Invalid policies are refused and logged by the loader
+				if err := reloader.Reload(); err != nil {
+					logrus.Errorf("Failed to reload %q", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// closeAll releases the resources of the components (policy watchers, state database, audit log) on shutdown
+func closeAll(components ...interface{}) {
+	for _, component := range components {
+		if closer, ok := component.(core.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logrus.Errorf("Failed to close %q", err.Error())
+			}
+		}
+	}
+}